@@ -5,6 +5,7 @@ keycard-pair
 keycard-open-secure-channel
 keycard-verify-pin {{ session_pin }}
 
+# run with: keycard shell -key-backed-up < 10-remove-key.sh
 keycard-remove-key
 
 keycard-unpair {{ session_pairing_index }}
@@ -0,0 +1,10 @@
+keycard-select
+keycard-set-secrets 123456 123456789012 KeycardDefaultPairing
+keycard-pair
+
+keycard-open-secure-channel
+keycard-verify-pin {{ session_pin }}
+
+keycard-export-key-keystore m/43'/60'/1581'/1'/0 keystore.json {{ env "KEYSTORE_PASSWORD" }}
+
+keycard-unpair {{ session_pairing_index }}
@@ -0,0 +1,5 @@
+# List the ISD, the executable load files and the application instances
+
+gp-select
+gp-open-secure-channel
+gp-list
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	auditLogFileName = "audit.jsonl"
+	// auditHeadSuffix is appended to the audit log path to get the head file, recording the last entry.
+	auditHeadSuffix = ".head"
+	// auditLockSuffix is appended to the audit log path to get the file locked by the processes appending entries.
+	auditLockSuffix = ".lock"
+	// auditTailSize is the size of the end of the log read to find the last entry, doubled until it holds the entry.
+	auditTailSize = 4096
+)
+
+var (
+	ErrAuditLogTampered = errors.New("audit log tampered")
+
+	errInvalidAuditKey       = errors.New("invalid audit key, expected a hex ed25519 seed or private key")
+	errInvalidAuditPublicKey = errors.New("invalid audit public key")
+
+	// auditGenesisHash is the previous hash of the first entry.
+	auditGenesisHash = strings.Repeat("0", sha256.Size*2)
+)
+
+// AuditEntry is a sensitive operation recorded in the audit log.
+// Hash is the SHA-256 of the entry JSON without Hash and Signature, and chains the entries with PrevHash.
+type AuditEntry struct {
+	Seq         uint64            `json:"seq"`
+	Time        time.Time         `json:"time"`
+	Operation   string            `json:"operation"`
+	Operator    string            `json:"operator,omitempty"`
+	InstanceUID string            `json:"instanceUID,omitempty"`
+	Details     map[string]string `json:"details,omitempty"`
+	PrevHash    string            `json:"prevHash"`
+	// PublicKey is the operator ed25519 public key, set when the entry is signed.
+	PublicKey string `json:"publicKey,omitempty"`
+	Hash      string `json:"hash"`
+	// Signature is the operator ed25519 signature of Hash.
+	Signature string `json:"signature,omitempty"`
+}
+
+// computeHash returns the hash of the entry fields, except Hash and Signature.
+func (e *AuditEntry) computeHash() (string, error) {
+	unsigned := *e
+	unsigned.Hash = ""
+	unsigned.Signature = ""
+
+	data, err := json.Marshal(&unsigned)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// auditHead is the last entry of the audit log. Entries removed from the end of the log don't match it.
+type auditHead struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+// AuditLog is a hash-chained JSON lines file recording the sensitive operations performed on cards.
+// Several processes can append to the same log: the entries are appended under an exclusive file lock.
+// A nil AuditLog doesn't record anything.
+type AuditLog struct {
+	path string
+	key  ed25519.PrivateKey
+	// Operator is recorded in the entries.
+	Operator string
+
+	mu sync.Mutex
+}
+
+// NewAuditLog returns an AuditLog stored at path. If key is not nil, the entries are signed with it.
+func NewAuditLog(path string, key ed25519.PrivateKey) *AuditLog {
+	return &AuditLog{
+		path: path,
+		key:  key,
+	}
+}
+
+// defaultAuditLogPath returns the audit log path in the user config directory.
+func defaultAuditLogPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return auditLogFileName
+	}
+
+	return filepath.Join(dir, "keycard", auditLogFileName)
+}
+
+// LoadAuditKey reads the operator ed25519 key from the file at path, as a hex seed or private key.
+func LoadAuditKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := hex.DecodeString(strings.TrimPrefix(strings.TrimSpace(string(data)), "0x"))
+	if err != nil {
+		return nil, errInvalidAuditKey
+	}
+
+	switch len(key) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(key), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(key), nil
+	default:
+		return nil, errInvalidAuditKey
+	}
+}
+
+// ParseAuditPublicKey parses a hex ed25519 public key.
+func ParseAuditPublicKey(pubKeyHex string) (ed25519.PublicKey, error) {
+	pubKey, err := hex.DecodeString(strings.TrimPrefix(pubKeyHex, "0x"))
+	if err != nil || len(pubKey) != ed25519.PublicKeySize {
+		return nil, errInvalidAuditPublicKey
+	}
+
+	return ed25519.PublicKey(pubKey), nil
+}
+
+// Append records operation on the card with the hex instanceUID, empty if unknown.
+// ctx are key/value pairs of details, like the logger ones.
+// It fails if the end of the log doesn't match the head file, to avoid chaining new entries to a truncated log.
+// Only the end of the log is read.
+func (a *AuditLog) Append(operation string, instanceUID string, ctx ...interface{}) error {
+	if a == nil {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	unlock, err := a.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	head, err := a.readHead()
+	if err != nil {
+		return err
+	}
+
+	prev, err := a.lastEntry()
+	if err != nil {
+		return err
+	}
+
+	if err = checkAuditHead(head, prev); err != nil {
+		return err
+	}
+
+	entry := &AuditEntry{
+		Seq:         prev.Seq + 1,
+		Time:        time.Now().UTC(),
+		Operation:   operation,
+		Operator:    a.Operator,
+		InstanceUID: instanceUID,
+		PrevHash:    prev.Hash,
+	}
+
+	if len(ctx) > 0 {
+		entry.Details = make(map[string]string)
+		for i := 0; i+1 < len(ctx); i += 2 {
+			entry.Details[fmt.Sprint(ctx[i])] = fmt.Sprint(ctx[i+1])
+		}
+	}
+
+	if a.key != nil {
+		entry.PublicKey = hex.EncodeToString(a.key.Public().(ed25519.PublicKey))
+	}
+
+	if entry.Hash, err = entry.computeHash(); err != nil {
+		return err
+	}
+
+	if a.key != nil {
+		hash, _ := hex.DecodeString(entry.Hash)
+		entry.Signature = hex.EncodeToString(ed25519.Sign(a.key, hash))
+	}
+
+	if err = a.write(entry); err != nil {
+		return err
+	}
+
+	return a.writeHead(&auditHead{Seq: entry.Seq, Hash: entry.Hash})
+}
+
+func (a *AuditLog) write(entry *AuditEntry) error {
+	if err := os.MkdirAll(filepath.Dir(a.path), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+// lock takes the exclusive lock of the log, shared with the other processes, and returns the function releasing it.
+func (a *AuditLog) lock() (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(a.path), 0700); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(a.path+auditLockSuffix, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return func() {
+		if err := unlockFile(f); err != nil {
+			logger.Warn("error unlocking the audit log", "error", err)
+		}
+		f.Close()
+	}, nil
+}
+
+// lastEntry returns the last entry of the log, reading only the end of the file.
+// An empty log returns an entry with sequence 0 and the genesis hash.
+func (a *AuditLog) lastEntry() (*AuditEntry, error) {
+	genesis := &AuditEntry{Hash: auditGenesisHash}
+	f, err := os.Open(a.path)
+	if os.IsNotExist(err) {
+		return genesis, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	size := fi.Size()
+	for tail := int64(auditTailSize); ; tail *= 2 {
+		start := size - tail
+		if start < 0 {
+			start = 0
+		}
+
+		buf := make([]byte, size-start)
+		if _, err = f.ReadAt(buf, start); err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		data := bytes.TrimRight(buf, "\n")
+		i := bytes.LastIndexByte(data, '\n')
+		if i < 0 && start > 0 {
+			continue
+		}
+
+		if len(data) == 0 {
+			return genesis, nil
+		}
+
+		entry := &AuditEntry{}
+		if err = json.Unmarshal(data[i+1:], entry); err != nil {
+			return nil, fmt.Errorf("%w: last entry: %v", ErrAuditLogTampered, err)
+		}
+
+		return entry, nil
+	}
+}
+
+// Entries returns the entries of the log.
+func (a *AuditLog) Entries() ([]*AuditEntry, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	unlock, err := a.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return a.entries()
+}
+
+// entries returns the entries of the log. A missing log has no entries.
+func (a *AuditLog) entries() ([]*AuditEntry, error) {
+	f, err := os.Open(a.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []*AuditEntry
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		entry := &AuditEntry{}
+		if err = json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			return nil, fmt.Errorf("%w: line %d: %v", ErrAuditLogTampered, line, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
+
+// readHead returns the head file, or nil if it doesn't exist.
+func (a *AuditLog) readHead() (*auditHead, error) {
+	data, err := os.ReadFile(a.path + auditHeadSuffix)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	head := &auditHead{}
+	if err = json.Unmarshal(data, head); err != nil {
+		return nil, fmt.Errorf("%w: invalid head file: %v", ErrAuditLogTampered, err)
+	}
+
+	return head, nil
+}
+
+// writeHead replaces the head file atomically.
+func (a *AuditLog) writeHead(head *auditHead) error {
+	data, err := json.Marshal(head)
+	if err != nil {
+		return err
+	}
+
+	tmp := a.path + auditHeadSuffix + ".tmp"
+	if err = os.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, a.path+auditHeadSuffix)
+}
+
+// checkAuditHead checks that last is the entry recorded in head.
+// A missing head is only valid for an empty log.
+func checkAuditHead(head *auditHead, last *AuditEntry) error {
+	if head == nil {
+		if last.Seq != 0 {
+			return fmt.Errorf("%w: missing head file", ErrAuditLogTampered)
+		}
+		return nil
+	}
+
+	if head.Seq != last.Seq || head.Hash != last.Hash {
+		return fmt.Errorf("%w: the log ends at entry %d, the head file records entry %d %s", ErrAuditLogTampered, last.Seq, head.Seq, head.Hash)
+	}
+
+	return nil
+}
+
+// AuditVerification is the result of a successful audit log verification.
+type AuditVerification struct {
+	Entries int
+	Signed  int
+	// Head is the hash of the last entry. Keeping it elsewhere detects a rollback of both the log and the head file.
+	Head string
+}
+
+func (v *AuditVerification) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Entries: %d\n", v.Entries)
+	fmt.Fprintf(&buf, "Signed entries: %d\n", v.Signed)
+	fmt.Fprintf(&buf, "Head: %s\n", v.Head)
+
+	return buf.String()
+}
+
+// Verify checks the sequence numbers, the hash chain, the signatures and the head file of the log.
+// If pubKey is not nil, every entry must be signed with it.
+func (a *AuditLog) Verify(pubKey ed25519.PublicKey) (*AuditVerification, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	unlock, err := a.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	entries, err := a.entries()
+	if err != nil {
+		return nil, err
+	}
+
+	head, err := a.readHead()
+	if err != nil {
+		return nil, err
+	}
+
+	v := &AuditVerification{Head: auditGenesisHash}
+	prev := &AuditEntry{Hash: auditGenesisHash}
+	for i, entry := range entries {
+		if err = verifyAuditEntry(entry, prev, pubKey); err != nil {
+			return nil, fmt.Errorf("%w: line %d: %v", ErrAuditLogTampered, i+1, err)
+		}
+
+		if entry.Signature != "" {
+			v.Signed++
+		}
+
+		v.Entries++
+		v.Head = entry.Hash
+		prev = entry
+	}
+
+	if err = checkAuditHead(head, prev); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+func verifyAuditEntry(entry *AuditEntry, prev *AuditEntry, pubKey ed25519.PublicKey) error {
+	if entry.Seq != prev.Seq+1 {
+		return fmt.Errorf("sequence %d after %d", entry.Seq, prev.Seq)
+	}
+
+	if entry.PrevHash != prev.Hash {
+		return fmt.Errorf("previous hash %s doesn't match entry %d hash %s", entry.PrevHash, prev.Seq, prev.Hash)
+	}
+
+	hash, err := entry.computeHash()
+	if err != nil {
+		return err
+	}
+
+	if hash != entry.Hash {
+		return fmt.Errorf("hash %s doesn't match the entry content", entry.Hash)
+	}
+
+	if entry.Signature == "" {
+		if pubKey != nil {
+			return errors.New("entry not signed")
+		}
+		return nil
+	}
+
+	entryPubKey, err := ParseAuditPublicKey(entry.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	if pubKey != nil && !pubKey.Equal(entryPubKey) {
+		return fmt.Errorf("entry signed by %s", entry.PublicKey)
+	}
+
+	hashBytes, _ := hex.DecodeString(entry.Hash)
+	sig, err := hex.DecodeString(entry.Signature)
+	if err != nil || !ed25519.Verify(entryPubKey, hashBytes, sig) {
+		return errors.New("invalid signature")
+	}
+
+	return nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestAuditLog returns an audit log in a temporary directory with 3 entries.
+func newTestAuditLog(t *testing.T, key ed25519.PrivateKey) *AuditLog {
+	a := NewAuditLog(filepath.Join(t.TempDir(), auditLogFileName), key)
+	a.Operator = "tester"
+
+	for _, op := range []string{"install", "init", "delete"} {
+		if err := a.Append(op, "0102", "cardSerial", "0a0b"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return a
+}
+
+func TestAuditLogVerify(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPubKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey := key.Public().(ed25519.PublicKey)
+
+	tests := []struct {
+		name   string
+		key    ed25519.PrivateKey
+		pubKey ed25519.PublicKey
+		signed int
+		err    error
+	}{
+		{name: "unsigned"},
+		{name: "signed", key: key, signed: 3},
+		{name: "signed with the required key", key: key, pubKey: pubKey, signed: 3},
+		{name: "signed with another key", key: key, pubKey: otherPubKey, err: ErrAuditLogTampered},
+		{name: "unsigned with a required key", pubKey: pubKey, err: ErrAuditLogTampered},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := newTestAuditLog(t, test.key)
+			v, err := a.Verify(test.pubKey)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("expected %v, got %v", test.err, err)
+			}
+
+			if err != nil {
+				return
+			}
+
+			entries, err := a.Entries()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if v.Entries != 3 || v.Signed != test.signed || v.Head != entries[2].Hash {
+				t.Fatalf("unexpected verification %+v", v)
+			}
+
+			for i, entry := range entries {
+				if entry.Seq != uint64(i+1) || entry.Operator != "tester" || entry.Details["cardSerial"] != "0a0b" {
+					t.Fatalf("unexpected entry %+v", entry)
+				}
+			}
+
+			if entries[0].PrevHash != auditGenesisHash || entries[1].PrevHash != entries[0].Hash {
+				t.Fatal("entries not chained")
+			}
+		})
+	}
+}
+
+func TestAuditLogTampered(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(lines []string) []string
+		head   func(path string) error
+	}{
+		{
+			name: "modified entry",
+			tamper: func(lines []string) []string {
+				lines[1] = strings.Replace(lines[1], `"operation":"init"`, `"operation":"info"`, 1)
+				return lines
+			},
+		},
+		{
+			name: "removed entry",
+			tamper: func(lines []string) []string {
+				return append(lines[:1], lines[2:]...)
+			},
+		},
+		{
+			name: "reordered entries",
+			tamper: func(lines []string) []string {
+				lines[0], lines[1] = lines[1], lines[0]
+				return lines
+			},
+		},
+		{
+			name: "truncated log",
+			tamper: func(lines []string) []string {
+				return lines[:2]
+			},
+		},
+		{
+			name: "removed head",
+			head: func(path string) error {
+				return os.Remove(path + auditHeadSuffix)
+			},
+		},
+		{
+			name: "invalid head",
+			head: func(path string) error {
+				return os.WriteFile(path+auditHeadSuffix, []byte("{"), 0600)
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := newTestAuditLog(t, nil)
+
+			if test.tamper != nil {
+				data, err := os.ReadFile(a.path)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				lines := test.tamper(strings.Split(strings.TrimSuffix(string(data), "\n"), "\n"))
+				if err = os.WriteFile(a.path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if test.head != nil {
+				if err := test.head(a.path); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if _, err := a.Verify(nil); !errors.Is(err, ErrAuditLogTampered) {
+				t.Fatalf("expected %v, got %v", ErrAuditLogTampered, err)
+			}
+		})
+	}
+}
+
+func TestAuditLogAppendTruncated(t *testing.T) {
+	a := newTestAuditLog(t, nil)
+
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	if err = os.WriteFile(a.path, bytes.Join(lines[:2], nil), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = a.Append("install", ""); !errors.Is(err, ErrAuditLogTampered) {
+		t.Fatalf("expected %v, got %v", ErrAuditLogTampered, err)
+	}
+}
+
+func TestLoadAuditKey(t *testing.T) {
+	seed := bytes.Repeat([]byte{0x01}, ed25519.SeedSize)
+	key := ed25519.NewKeyFromSeed(seed)
+
+	tests := []struct {
+		name    string
+		content string
+		err     error
+	}{
+		{name: "seed", content: hex.EncodeToString(seed) + "\n"},
+		{name: "private key", content: "0x" + hex.EncodeToString(key)},
+		{name: "invalid hex", content: "xyz", err: errInvalidAuditKey},
+		{name: "invalid length", content: "0102", err: errInvalidAuditKey},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.key")
+			if err := os.WriteFile(path, []byte(test.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			loaded, err := LoadAuditKey(path)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("expected %v, got %v", test.err, err)
+			}
+
+			if err == nil && !key.Equal(loaded) {
+				t.Fatalf("unexpected key %x", loaded)
+			}
+		})
+	}
+
+	pubKey, err := ParseAuditPublicKey("0x" + hex.EncodeToString(key.Public().(ed25519.PublicKey)))
+	if err != nil || !pubKey.Equal(key.Public()) {
+		t.Fatalf("unexpected public key %x: %v", pubKey, err)
+	}
+
+	if _, err = ParseAuditPublicKey("0102"); !errors.Is(err, errInvalidAuditPublicKey) {
+		t.Fatalf("expected %v, got %v", errInvalidAuditPublicKey, err)
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+const capMagic = 0xDECAFFED
+
+// capComponents lists the CAP components in the order they are sent to the card.
+// Descriptor and Debug are not part of the load file.
+var capComponents = []string{
+	"Header", "Directory", "Import", "Applet", "Class",
+	"Method", "StaticField", "Export", "ConstantPool", "RefLocation",
+}
+
+var requiredCapComponents = []string{"Header", "Directory", "Import", "Class", "Method", "StaticField", "ConstantPool", "RefLocation"}
+
+// javacardFrameworkAID is the AID of the javacard.framework package.
+var javacardFrameworkAID = []byte{0xA0, 0x00, 0x00, 0x00, 0x62, 0x01, 0x01}
+
+// javacardVersions maps the javacard.framework package version to the Java Card API version.
+var javacardVersions = map[string]string{
+	"1.0": "2.1",
+	"1.1": "2.1.1",
+	"1.2": "2.2.1",
+	"1.3": "2.2.2",
+	"1.4": "3.0.1",
+	"1.5": "3.0.4",
+	"1.6": "3.0.5",
+	"1.8": "3.1",
+}
+
+var (
+	errInvalidCapMagic = errors.New("invalid CAP header magic")
+	errTruncatedCap    = errors.New("truncated CAP component")
+)
+
+// CapVersion is a major.minor version.
+type CapVersion struct {
+	Major uint8
+	Minor uint8
+}
+
+func (v CapVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+// CapImport is a package imported by the CAP file.
+type CapImport struct {
+	AID     []byte
+	Version CapVersion
+}
+
+// CapComponent is a component file found in the CAP archive.
+type CapComponent struct {
+	Name string
+	Path string
+	Size int
+}
+
+// CapFile holds the information parsed from a CAP file.
+type CapFile struct {
+	Components     []CapComponent
+	FormatVersion  CapVersion
+	PackageAID     []byte
+	PackageVersion CapVersion
+	PackageName    string
+	AppletAIDs     [][]byte
+	Imports        []CapImport
+	// JavacardAPIVersion is the Java Card API version required by the imported javacard.framework package.
+	JavacardAPIVersion string
+	// LoadFileSize is the size of the load file data block sent to the card.
+	LoadFileSize   int
+	LoadFileSHA1   []byte
+	LoadFileSHA256 []byte
+	FileSHA256     []byte
+	componentsData map[string][]byte
+}
+
+// ParseCapFile reads and validates the CAP archive f.
+func ParseCapFile(f *os.File) (*CapFile, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	fileHash := sha256.New()
+	if _, err = io.Copy(fileHash, io.NewSectionReader(f, 0, fi.Size())); err != nil {
+		return nil, err
+	}
+
+	z, err := zip.NewReader(f, fi.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	c := &CapFile{
+		FileSHA256:     fileHash.Sum(nil),
+		componentsData: make(map[string][]byte),
+	}
+
+	for _, item := range z.File {
+		if !strings.HasSuffix(item.Name, ".cap") {
+			continue
+		}
+
+		name := strings.TrimSuffix(path.Base(item.Name), ".cap")
+		r, err := item.Open()
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		c.componentsData[name] = data
+		c.Components = append(c.Components, CapComponent{Name: name, Path: item.Name, Size: len(data)})
+	}
+
+	for _, name := range requiredCapComponents {
+		if _, ok := c.componentsData[name]; !ok {
+			return nil, fmt.Errorf("missing CAP component %s", name)
+		}
+	}
+
+	if err = c.parseHeader(); err != nil {
+		return nil, err
+	}
+
+	if err = c.parseApplets(); err != nil {
+		return nil, err
+	}
+
+	if err = c.parseImports(); err != nil {
+		return nil, err
+	}
+
+	var loadFile bytes.Buffer
+	for _, name := range capComponents {
+		loadFile.Write(c.componentsData[name])
+	}
+
+	sha1Sum := sha1.Sum(loadFile.Bytes())
+	sha256Sum := sha256.Sum256(loadFile.Bytes())
+	c.LoadFileSize = loadFile.Len()
+	c.LoadFileSHA1 = sha1Sum[:]
+	c.LoadFileSHA256 = sha256Sum[:]
+
+	return c, nil
+}
+
+// HasApplet returns true if the CAP file contains an applet with the specified AID.
+func (c *CapFile) HasApplet(aid []byte) bool {
+	for _, appletAID := range c.AppletAIDs {
+		if bytes.Equal(appletAID, aid) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// componentInfo returns the info of the component, skipping the tag and size fields.
+func (c *CapFile) componentInfo(name string) ([]byte, error) {
+	data := c.componentsData[name]
+	if len(data) < 3 {
+		return nil, fmt.Errorf("%s: %w", name, errTruncatedCap)
+	}
+
+	size := int(binary.BigEndian.Uint16(data[1:3]))
+	if len(data) < 3+size {
+		return nil, fmt.Errorf("%s: %w", name, errTruncatedCap)
+	}
+
+	return data[3 : 3+size], nil
+}
+
+func (c *CapFile) parseHeader() error {
+	info, err := c.componentInfo("Header")
+	if err != nil {
+		return err
+	}
+
+	if len(info) < 10 {
+		return fmt.Errorf("Header: %w", errTruncatedCap)
+	}
+
+	if binary.BigEndian.Uint32(info[0:4]) != capMagic {
+		return errInvalidCapMagic
+	}
+
+	c.FormatVersion = CapVersion{Minor: info[4], Major: info[5]}
+	// info[6] holds the flags
+	c.PackageVersion = CapVersion{Minor: info[7], Major: info[8]}
+	aidLen := int(info[9])
+	if len(info) < 10+aidLen {
+		return fmt.Errorf("Header: %w", errTruncatedCap)
+	}
+	c.PackageAID = info[10 : 10+aidLen]
+
+	// the package name is present since CAP format 2.2
+	rest := info[10+aidLen:]
+	if len(rest) > 0 && len(rest) >= 1+int(rest[0]) {
+		c.PackageName = strings.ReplaceAll(string(rest[1:1+int(rest[0])]), "/", ".")
+	}
+
+	return nil
+}
+
+func (c *CapFile) parseApplets() error {
+	if _, ok := c.componentsData["Applet"]; !ok {
+		return nil
+	}
+
+	info, err := c.componentInfo("Applet")
+	if err != nil {
+		return err
+	}
+
+	if len(info) < 1 {
+		return fmt.Errorf("Applet: %w", errTruncatedCap)
+	}
+
+	count := int(info[0])
+	offset := 1
+	for i := 0; i < count; i++ {
+		if len(info) < offset+1 {
+			return fmt.Errorf("Applet: %w", errTruncatedCap)
+		}
+
+		aidLen := int(info[offset])
+		// AID followed by the install method offset
+		if len(info) < offset+1+aidLen+2 {
+			return fmt.Errorf("Applet: %w", errTruncatedCap)
+		}
+
+		c.AppletAIDs = append(c.AppletAIDs, info[offset+1:offset+1+aidLen])
+		offset += 1 + aidLen + 2
+	}
+
+	return nil
+}
+
+func (c *CapFile) parseImports() error {
+	info, err := c.componentInfo("Import")
+	if err != nil {
+		return err
+	}
+
+	if len(info) < 1 {
+		return fmt.Errorf("Import: %w", errTruncatedCap)
+	}
+
+	count := int(info[0])
+	offset := 1
+	for i := 0; i < count; i++ {
+		if len(info) < offset+3 {
+			return fmt.Errorf("Import: %w", errTruncatedCap)
+		}
+
+		version := CapVersion{Minor: info[offset], Major: info[offset+1]}
+		aidLen := int(info[offset+2])
+		if len(info) < offset+3+aidLen {
+			return fmt.Errorf("Import: %w", errTruncatedCap)
+		}
+
+		aid := info[offset+3 : offset+3+aidLen]
+		c.Imports = append(c.Imports, CapImport{AID: aid, Version: version})
+		offset += 3 + aidLen
+
+		if bytes.Equal(aid, javacardFrameworkAID) {
+			if v, ok := javacardVersions[version.String()]; ok {
+				c.JavacardAPIVersion = v
+			} else {
+				c.JavacardAPIVersion = fmt.Sprintf("unknown (javacard.framework %s)", version)
+			}
+		}
+	}
+
+	return nil
+}
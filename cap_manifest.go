@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var (
+	ErrUntrustedCapFile    = errors.New("cap file not listed in the trusted manifest")
+	ErrInvalidCapSignature = errors.New("invalid cap manifest signature")
+
+	errCapVersionMismatch     = errors.New("cap package version does not match the trusted manifest")
+	errMissingCapPublicKey    = errors.New("a public key is needed to verify the cap manifest signature")
+	errInvalidCapPublicKey    = errors.New("invalid cap manifest public key")
+	errMissingCapSignature    = errors.New("a signature is needed to verify the cap manifest with the public key")
+	errInvalidCapManifestHash = errors.New("invalid sha256 in cap manifest")
+)
+
+// CapManifest lists the cap files trusted for installation.
+type CapManifest struct {
+	Caps []CapManifestEntry `json:"caps"`
+}
+
+// CapManifestEntry describes a trusted cap file.
+type CapManifestEntry struct {
+	File string `json:"file"`
+	// Version is the release version, only shown when the cap file is verified.
+	Version string `json:"version"`
+	// PackageVersion is optional. If set, it must match the version in the cap Header component.
+	PackageVersion string `json:"packageVersion"`
+	SHA256         string `json:"sha256"`
+}
+
+// LoadCapManifest reads the manifest at path. If pubKeyHex is not empty, the manifest
+// must have a valid ed25519 detached signature, raw or hex encoded, in signaturePath.
+func LoadCapManifest(path string, signaturePath string, pubKeyHex string) (*CapManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if pubKeyHex != "" || signaturePath != "" {
+		if err = verifyCapManifestSignature(data, signaturePath, pubKeyHex); err != nil {
+			return nil, err
+		}
+		logger.Info("cap manifest signature verified")
+	}
+
+	manifest := &CapManifest{}
+	if err = json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("error parsing cap manifest: %v", err)
+	}
+
+	return manifest, nil
+}
+
+// Verify returns the manifest entry matching the cap file hash.
+func (m *CapManifest) Verify(capInfo *CapFile) (*CapManifestEntry, error) {
+	for i := range m.Caps {
+		entry := &m.Caps[i]
+		hash, err := hex.DecodeString(strings.TrimPrefix(entry.SHA256, "0x"))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", errInvalidCapManifestHash, entry.SHA256)
+		}
+
+		if !bytes.Equal(hash, capInfo.FileSHA256) {
+			continue
+		}
+
+		if entry.PackageVersion != "" && entry.PackageVersion != capInfo.PackageVersion.String() {
+			return nil, fmt.Errorf("%w: got %s, expected %s", errCapVersionMismatch, capInfo.PackageVersion, entry.PackageVersion)
+		}
+
+		return entry, nil
+	}
+
+	return nil, fmt.Errorf("%w: sha256 %x", ErrUntrustedCapFile, capInfo.FileSHA256)
+}
+
+func verifyCapManifestSignature(data []byte, signaturePath string, pubKeyHex string) error {
+	if pubKeyHex == "" {
+		return errMissingCapPublicKey
+	}
+
+	if signaturePath == "" {
+		return errMissingCapSignature
+	}
+
+	pubKey, err := hex.DecodeString(strings.TrimPrefix(pubKeyHex, "0x"))
+	if err != nil || len(pubKey) != ed25519.PublicKeySize {
+		return errInvalidCapPublicKey
+	}
+
+	sig, err := os.ReadFile(signaturePath)
+	if err != nil {
+		return err
+	}
+
+	if len(sig) != ed25519.SignatureSize {
+		sig, err = hex.DecodeString(strings.TrimPrefix(strings.TrimSpace(string(sig)), "0x"))
+		if err != nil {
+			return ErrInvalidCapSignature
+		}
+	}
+
+	if !ed25519.Verify(ed25519.PublicKey(pubKey), data, sig) {
+		return ErrInvalidCapSignature
+	}
+
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCapManifestVerify(t *testing.T) {
+	capInfo := &CapFile{FileSHA256: []byte{0x01, 0x02}, PackageVersion: CapVersion{Major: 3, Minor: 0}}
+
+	tests := []struct {
+		name  string
+		entry CapManifestEntry
+		err   error
+	}{
+		{name: "hash match", entry: CapManifestEntry{SHA256: "0x0102"}},
+		{name: "package version match", entry: CapManifestEntry{SHA256: "0102", PackageVersion: "3.0"}},
+		{name: "package version mismatch", entry: CapManifestEntry{SHA256: "0102", PackageVersion: "3.1"}, err: errCapVersionMismatch},
+		{name: "hash mismatch", entry: CapManifestEntry{SHA256: "0103"}, err: ErrUntrustedCapFile},
+		{name: "invalid hash", entry: CapManifestEntry{SHA256: "xyz"}, err: errInvalidCapManifestHash},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			manifest := &CapManifest{Caps: []CapManifestEntry{test.entry}}
+			_, err := manifest.Verify(capInfo)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("expected %v, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestLoadCapManifestSignature(t *testing.T) {
+	pubKey, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "manifest.json")
+	data := []byte(`{"caps": [{"file": "keycard.cap", "version": "3.0.5", "sha256": "0x0102"}]}`)
+	if err = os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	rawSig := filepath.Join(dir, "raw.sig")
+	hexSig := filepath.Join(dir, "hex.sig")
+	badSig := filepath.Join(dir, "bad.sig")
+	sig := ed25519.Sign(key, data)
+	for file, content := range map[string][]byte{
+		rawSig: sig,
+		hexSig: []byte(fmt.Sprintf("0x%x\n", sig)),
+		badSig: ed25519.Sign(key, []byte("other")),
+	} {
+		if err = os.WriteFile(file, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pubKeyHex := hex.EncodeToString(pubKey)
+	tests := []struct {
+		name      string
+		signature string
+		pubKey    string
+		err       error
+	}{
+		{name: "unsigned"},
+		{name: "raw signature", signature: rawSig, pubKey: pubKeyHex},
+		{name: "hex signature", signature: hexSig, pubKey: pubKeyHex},
+		{name: "invalid signature", signature: badSig, pubKey: pubKeyHex, err: ErrInvalidCapSignature},
+		{name: "missing signature", pubKey: pubKeyHex, err: errMissingCapSignature},
+		{name: "missing public key", signature: rawSig, err: errMissingCapPublicKey},
+		{name: "invalid public key", signature: rawSig, pubKey: "0x01", err: errInvalidCapPublicKey},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			manifest, err := LoadCapManifest(path, test.signature, test.pubKey)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("expected %v, got %v", test.err, err)
+			}
+
+			if err == nil && (len(manifest.Caps) != 1 || manifest.Caps[0].Version != "3.0.5") {
+				t.Fatalf("unexpected manifest %+v", manifest)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var (
+	testPackageAID = []byte{0xA0, 0x00, 0x00, 0x08, 0x04, 0x00, 0x01}
+	testAppletAID  = []byte{0xA0, 0x00, 0x00, 0x08, 0x04, 0x00, 0x01, 0x01}
+)
+
+// capComponent returns a component with its tag and size fields.
+func capComponent(tag byte, info []byte) []byte {
+	data := []byte{tag, 0, 0}
+	binary.BigEndian.PutUint16(data[1:], uint16(len(info)))
+	return append(data, info...)
+}
+
+func testCapComponents() map[string][]byte {
+	header := []byte{0xDE, 0xCA, 0xFF, 0xED, 0x02, 0x02, 0x04, 0x01, 0x03, byte(len(testPackageAID))}
+	header = append(header, testPackageAID...)
+	header = append(header, 0x0C)
+	header = append(header, "im/status/kc"...)
+
+	applet := append([]byte{0x01, byte(len(testAppletAID))}, testAppletAID...)
+	applet = append(applet, 0x00, 0x10)
+
+	imports := append([]byte{0x01, 0x06, 0x01, byte(len(javacardFrameworkAID))}, javacardFrameworkAID...)
+
+	components := map[string][]byte{
+		"Header": capComponent(1, header),
+		"Applet": capComponent(3, applet),
+		"Import": capComponent(4, imports),
+	}
+
+	for i, name := range []string{"Directory", "Class", "Method", "StaticField", "ConstantPool", "RefLocation"} {
+		components[name] = capComponent(byte(10+i), []byte{byte(i)})
+	}
+
+	return components
+}
+
+func writeTestCap(t *testing.T, components map[string][]byte) *os.File {
+	t.Helper()
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "test.cap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+
+	z := zip.NewWriter(f)
+	for name, data := range components {
+		w, err := z.Create("im/status/kc/javacard/" + name + ".cap")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = z.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return f
+}
+
+func TestParseCapFile(t *testing.T) {
+	components := testCapComponents()
+	c, err := ParseCapFile(writeTestCap(t, components))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(c.PackageAID, testPackageAID) {
+		t.Fatalf("unexpected package AID %x", c.PackageAID)
+	}
+
+	if c.PackageVersion != (CapVersion{Major: 3, Minor: 1}) || c.FormatVersion != (CapVersion{Major: 2, Minor: 2}) {
+		t.Fatalf("unexpected versions: package %s, format %s", c.PackageVersion, c.FormatVersion)
+	}
+
+	if c.PackageName != "im.status.kc" {
+		t.Fatalf("unexpected package name %s", c.PackageName)
+	}
+
+	if !c.HasApplet(testAppletAID) || len(c.AppletAIDs) != 1 {
+		t.Fatalf("unexpected applets %x", c.AppletAIDs)
+	}
+
+	if c.JavacardAPIVersion != "3.0.5" {
+		t.Fatalf("unexpected Java Card version %s", c.JavacardAPIVersion)
+	}
+
+	var loadFile []byte
+	for _, name := range capComponents {
+		loadFile = append(loadFile, components[name]...)
+	}
+
+	hash := sha256.Sum256(loadFile)
+	if c.LoadFileSize != len(loadFile) || !bytes.Equal(c.LoadFileSHA256, hash[:]) {
+		t.Fatalf("unexpected load file size %d or hash %x", c.LoadFileSize, c.LoadFileSHA256)
+	}
+}
+
+func TestParseCapFileInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(components map[string][]byte)
+		err    error
+	}{
+		{
+			name:   "missing component",
+			modify: func(components map[string][]byte) { delete(components, "Method") },
+		},
+		{
+			name:   "invalid magic",
+			modify: func(components map[string][]byte) { components["Header"][3] = 0 },
+			err:    errInvalidCapMagic,
+		},
+		{
+			name:   "truncated component",
+			modify: func(components map[string][]byte) { components["Import"] = components["Import"][:5] },
+			err:    errTruncatedCap,
+		},
+		{
+			name: "truncated applet",
+			modify: func(components map[string][]byte) {
+				components["Applet"] = capComponent(3, []byte{0x02, 0x01, 0xA0, 0x00, 0x00})
+			},
+			err: errTruncatedCap,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			components := testCapComponents()
+			test.modify(components)
+
+			_, err := ParseCapFile(writeTestCap(t, components))
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if test.err != nil && !errors.Is(err, test.err) {
+				t.Fatalf("expected %v, got %v", test.err, err)
+			}
+		})
+	}
+}
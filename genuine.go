@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	keycard "github.com/status-im/keycard-go"
+	"github.com/status-im/keycard-go/apdu"
+	"github.com/status-im/keycard-go/types"
+)
+
+const identifyChallengeSize = 32
+
+var (
+	ErrCardNotGenuine = errors.New("card is NOT genuine")
+
+	errNoTrustedCA                 = errors.New("no trusted CA public key, specify them with -trusted-cas")
+	errInvalidTrustedCA            = errors.New("invalid trusted CA public key")
+	errInvalidIdentityCertificate  = errors.New("invalid identity certificate")
+	errInvalidIdentitySignature    = errors.New("the challenge signature doesn't match the identity public key")
+	errUntrustedIdentityCertAuthor = errors.New("the identity certificate is not signed by a trusted CA")
+)
+
+// bundledTrustedCAs are the CA public keys trusted without the -trusted-cas flag.
+// None is bundled yet: the keys published by the card manufacturer must be configured.
+var bundledTrustedCAs = []*TrustedCA{}
+
+// TrustedCA is a certificate authority signing the identity certificates of genuine cards.
+type TrustedCA struct {
+	Name string `json:"name"`
+	// PublicKey is the secp256k1 public key in hex, compressed or not.
+	PublicKey string `json:"publicKey"`
+}
+
+// TrustedCAs is the file format of the -trusted-cas flag.
+type TrustedCAs struct {
+	CAs []*TrustedCA `json:"cas"`
+}
+
+// LoadTrustedCAs returns the bundled CAs and the ones in the JSON file at path, if not empty.
+func LoadTrustedCAs(path string) ([]*TrustedCA, error) {
+	cas := append([]*TrustedCA{}, bundledTrustedCAs...)
+	if path == "" {
+		return cas, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := &TrustedCAs{}
+	if err = json.Unmarshal(data, file); err != nil {
+		return nil, fmt.Errorf("error parsing trusted CAs: %v", err)
+	}
+
+	for _, ca := range file.CAs {
+		if _, err = ca.compressedPublicKey(); err != nil {
+			return nil, err
+		}
+	}
+
+	return append(cas, file.CAs...), nil
+}
+
+func (ca *TrustedCA) compressedPublicKey() ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimPrefix(ca.PublicKey, "0x"))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %s", errInvalidTrustedCA, ca.Name, ca.PublicKey)
+	}
+
+	if len(key) == 33 {
+		if _, err = crypto.DecompressPubkey(key); err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", errInvalidTrustedCA, ca.Name, err)
+		}
+		return key, nil
+	}
+
+	pubKey, err := crypto.UnmarshalPubkey(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", errInvalidTrustedCA, ca.Name, err)
+	}
+
+	return crypto.CompressPubkey(pubKey), nil
+}
+
+// GenuineReport is the result of the card genuineness verification.
+type GenuineReport struct {
+	InstanceUID    string `json:"instanceUID,omitempty"`
+	KeycardVersion string `json:"keycardVersion,omitempty"`
+	Challenge      string `json:"challenge"`
+	// IdentityPublicKey is the compressed card identity public key from the certificate.
+	IdentityPublicKey string `json:"identityPublicKey"`
+	// CAPublicKey is the compressed public key recovered from the certificate signature.
+	CAPublicKey string `json:"caPublicKey"`
+	// CASignature is the certificate signature of the SHA-256 of the identity public key, as R || S || V.
+	CASignature string `json:"caSignature"`
+	// CAName is the name of the trusted CA that signed the certificate, empty if none.
+	CAName  string `json:"caName,omitempty"`
+	Genuine bool   `json:"genuine"`
+}
+
+func (r *GenuineReport) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Keycard identity:\n")
+	fmt.Fprintf(&buf, "  InstanceUID: 0x%s\n", r.InstanceUID)
+	fmt.Fprintf(&buf, "  Version: %s\n", r.KeycardVersion)
+	fmt.Fprintf(&buf, "  Challenge: 0x%s\n", r.Challenge)
+	fmt.Fprintf(&buf, "Certificate:\n")
+	fmt.Fprintf(&buf, "  Identity public key: 0x%s\n", r.IdentityPublicKey)
+	fmt.Fprintf(&buf, "  CA public key: 0x%s\n", r.CAPublicKey)
+	fmt.Fprintf(&buf, "  CA signature: 0x%s\n", r.CASignature)
+	if r.Genuine {
+		fmt.Fprintf(&buf, "Genuine: yes, certified by %s\n", r.CAName)
+	} else {
+		fmt.Fprintf(&buf, "Genuine: NO\n")
+	}
+
+	return buf.String()
+}
+
+// VerifyGenuine sends a random challenge with IDENTIFY to the Keycard instance and checks that it's signed
+// with the identity key of the certificate, and that the certificate is signed by one of the trusted CAs.
+// The returned report is not nil if the card answered, even when the verification fails.
+func VerifyGenuine(c types.Channel, instanceIndex int, trustedCAs []*TrustedCA) (*GenuineReport, error) {
+	if len(trustedCAs) == 0 {
+		return nil, errNoTrustedCA
+	}
+
+	kc, err := newInstanceChannel(c, instanceIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	cmdSet := keycard.NewCommandSet(kc)
+	logger.Info("select keycard applet")
+	if err = cmdSet.Select(); err != nil {
+		logger.Error("select failed", "error", err)
+		return nil, err
+	}
+
+	report := &GenuineReport{
+		KeycardVersion: appletVersion(cmdSet.ApplicationInfo.Version),
+	}
+
+	if cmdSet.ApplicationInfo.Initialized {
+		report.InstanceUID = hex.EncodeToString(cmdSet.ApplicationInfo.InstanceUID)
+	}
+
+	challenge := make([]byte, identifyChallengeSize)
+	if _, err = rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	report.Challenge = hex.EncodeToString(challenge)
+
+	logger.Info("identify", "challenge", report.Challenge)
+	resp, err := kc.Send(keycard.NewCommandIdentify(challenge))
+	if err = checkOK(resp, err); err != nil {
+		logger.Error("identify failed", "error", err)
+		return nil, err
+	}
+
+	identityPubKey, r, s, err := parseIdentifyResponse(resp.Data, report)
+	if err != nil {
+		return report, fmt.Errorf("%w: %v", ErrCardNotGenuine, err)
+	}
+
+	if !crypto.VerifySignature(identityPubKey, challenge, append(r, s...)) {
+		return report, fmt.Errorf("%w: %v", ErrCardNotGenuine, errInvalidIdentitySignature)
+	}
+
+	caPubKey, _ := hex.DecodeString(report.CAPublicKey)
+	ca, err := findTrustedCA(trustedCAs, caPubKey)
+	if err != nil {
+		return report, err
+	}
+
+	report.CAName = ca.Name
+	report.Genuine = true
+	return report, nil
+}
+
+// findTrustedCA returns the CA of trustedCAs with the compressed public key caPubKey.
+func findTrustedCA(trustedCAs []*TrustedCA, caPubKey []byte) (*TrustedCA, error) {
+	for _, ca := range trustedCAs {
+		key, err := ca.compressedPublicKey()
+		if err != nil {
+			return nil, err
+		}
+
+		if bytes.Equal(key, caPubKey) {
+			return ca, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %v 0x%x", ErrCardNotGenuine, errUntrustedIdentityCertAuthor, caPubKey)
+}
+
+// parseIdentifyResponse parses the certificate and the challenge signature of the IDENTIFY response, and fills
+// the certificate fields of report. It returns the identity public key and the low S challenge signature.
+// types.VerifyIdentity is not used: it checks the challenge signature by key recovery with unpadded R and S,
+// rejecting genuine cards whose DER integers are shorter than 32 bytes.
+func parseIdentifyResponse(data []byte, report *GenuineReport) ([]byte, []byte, []byte, error) {
+	template, err := apdu.FindTag(data, apdu.Tag{types.TagSignatureTemplate})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	cert, err := apdu.FindTag(template, apdu.Tag{types.TagCertificate})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if _, err = types.ParseCertificate(cert); err != nil {
+		return nil, nil, nil, fmt.Errorf("%w: %v", errInvalidIdentityCertificate, err)
+	}
+
+	// the Certificate fields are unexported, the CA signature is parsed again to read the recovered key
+	identityPubKey := cert[:33]
+	hash := sha256.Sum256(identityPubKey)
+	caSig, err := types.ParseRecoverableSignature(hash[:], cert[33:])
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("%w: %v", errInvalidIdentityCertificate, err)
+	}
+
+	caPubKey, err := crypto.UnmarshalPubkey(caSig.PubKey())
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("%w: CA signature: %v", errInvalidIdentityCertificate, err)
+	}
+
+	report.IdentityPublicKey = hex.EncodeToString(identityPubKey)
+	report.CASignature = hex.EncodeToString(cert[33:])
+	report.CAPublicKey = hex.EncodeToString(crypto.CompressPubkey(caPubKey))
+
+	r, s, err := types.DERSignatureToRS(template)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return identityPubKey, padScalar(r), lowS(padScalar(s)), nil
+}
+
+// padScalar left pads a DER integer to 32 bytes.
+func padScalar(b []byte) []byte {
+	if len(b) >= 32 {
+		return b
+	}
+
+	return append(make([]byte, 32-len(b)), b...)
+}
+
+// lowS returns N - s if s is greater than N/2, as required by crypto.VerifySignature.
+func lowS(s []byte) []byte {
+	n := crypto.S256().Params().N
+	v := new(big.Int).SetBytes(s)
+	if v.Cmp(new(big.Int).Rsh(n, 1)) <= 0 {
+		return s
+	}
+
+	return padScalar(new(big.Int).Sub(n, v).Bytes())
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestFindTrustedCA(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caPubKey := crypto.CompressPubkey(&key.PublicKey)
+	compressed := &TrustedCA{Name: "compressed", PublicKey: fmt.Sprintf("0x%x", caPubKey)}
+	uncompressed := &TrustedCA{Name: "uncompressed", PublicKey: fmt.Sprintf("%x", crypto.FromECDSAPub(&key.PublicKey))}
+	untrusted := &TrustedCA{Name: "other", PublicKey: fmt.Sprintf("%x", crypto.CompressPubkey(&other.PublicKey))}
+
+	tests := []struct {
+		name string
+		cas  []*TrustedCA
+		ca   *TrustedCA
+		err  error
+	}{
+		{name: "compressed", cas: []*TrustedCA{untrusted, compressed}, ca: compressed},
+		{name: "uncompressed", cas: []*TrustedCA{uncompressed}, ca: uncompressed},
+		{name: "untrusted", cas: []*TrustedCA{untrusted}, err: ErrCardNotGenuine},
+		{name: "no CA", err: ErrCardNotGenuine},
+		{name: "invalid CA", cas: []*TrustedCA{{Name: "invalid", PublicKey: "0x0102"}}, err: errInvalidTrustedCA},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ca, err := findTrustedCA(test.cas, caPubKey)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("expected %v, got %v", test.err, err)
+			}
+
+			if ca != test.ca {
+				t.Fatalf("expected CA %v, got %v", test.ca, ca)
+			}
+		})
+	}
+}
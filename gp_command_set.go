@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"os"
+
+	"github.com/status-im/keycard-go/apdu"
+	"github.com/status-im/keycard-go/globalplatform"
+	"github.com/status-im/keycard-go/identifiers"
+	"github.com/status-im/keycard-go/types"
+)
+
+const insGetData = 0xCA
+
+var (
+	tagCPLC        = apdu.Tag{0x9F, 0x7F}
+	errInvalidCPLC = errors.New("invalid CPLC data")
+)
+
+// GPCommandSet sends GlobalPlatform commands to the ISD through a secure channel
+// opened with the configured keys.
+// It has the API of globalplatform.CommandSet from keycard-go, which can't be wrapped: its secure channel
+// is always SCP02 with the development keys, and the commands are sent through its unexported session.
+type GPCommandSet struct {
+	c    types.Channel
+	keys *GPKeyConfig
+	sc   *GPSecureChannel
+}
+
+// NewGPCommandSet returns a new GPCommandSet that opens the secure channel with keys.
+// If keys is nil, the default keys are used.
+func NewGPCommandSet(c types.Channel, keys *GPKeyConfig) *GPCommandSet {
+	return &GPCommandSet{
+		c:    c,
+		keys: keys,
+	}
+}
+
+// Select selects the ISD.
+func (cs *GPCommandSet) Select() error {
+	return cs.SelectAID(nil)
+}
+
+// SelectAID selects the application with the specified AID, or the ISD if aid is nil.
+func (cs *GPCommandSet) SelectAID(aid []byte) error {
+	cmd := globalplatform.NewCommandSelect(aid)
+	cmd.SetLe(0)
+	resp, err := cs.c.Send(cmd)
+
+	return checkOK(resp, err)
+}
+
+// CardSerial returns the IC fabricator and IC serial number from the CPLC data of the selected ISD.
+func (cs *GPCommandSet) CardSerial() ([]byte, error) {
+	cmd := apdu.NewCommand(globalplatform.ClaGp, insGetData, 0x9F, 0x7F, nil)
+	cmd.SetLe(0)
+	resp, err := cs.c.Send(cmd)
+	if err = checkOK(resp, err); err != nil {
+		return nil, err
+	}
+
+	cplc, err := apdu.FindTag(resp.Data, tagCPLC)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cplc) < 16 {
+		return nil, errInvalidCPLC
+	}
+
+	serial := append([]byte{}, cplc[0:2]...)
+	return append(serial, cplc[12:16]...), nil
+}
+
+// OpenSecureChannel opens the SCP02 or SCP03 secure channel with the ISD selected by Select.
+func (cs *GPCommandSet) OpenSecureChannel() error {
+	sc, err := openGPSecureChannel(cs.c, cs.keys)
+	if err != nil {
+		return err
+	}
+
+	logger.Debug("secure channel opened", "scp", sc.SCP, "key version", sc.KeyVersion)
+	cs.sc = sc
+
+	return nil
+}
+
+// Channel returns the channel the commands are sent through, outside of the secure channel.
+func (cs *GPCommandSet) Channel() types.Channel {
+	return cs.c
+}
+
+// SecureChannel returns the open secure channel, or nil.
+func (cs *GPCommandSet) SecureChannel() *GPSecureChannel {
+	return cs.sc
+}
+
+// DeleteKeycardInstancesAndPackage deletes the Keycard package with all its instances.
+func (cs *GPCommandSet) DeleteKeycardInstancesAndPackage() error {
+	return cs.DeleteObjectAndRelatedObject(identifiers.PackageAID)
+}
+
+// DeleteObject deletes the instance or the package with the specified AID.
+func (cs *GPCommandSet) DeleteObject(aid []byte) error {
+	return cs.Delete(aid, globalplatform.P2DeleteObject)
+}
+
+// DeleteObjectAndRelatedObject deletes the package with the specified AID and its instances.
+func (cs *GPCommandSet) DeleteObjectAndRelatedObject(aid []byte) error {
+	return cs.Delete(aid, globalplatform.P2DeleteObjectAndRelatedObject)
+}
+
+// Delete sends DELETE with p2 for the specified AID. Objects not found on the card are not an error.
+func (cs *GPCommandSet) Delete(aid []byte, p2 uint8) error {
+	if cs.sc == nil {
+		return globalplatform.ErrSecureChannelNotOpen
+	}
+
+	cmd := globalplatform.NewCommandDelete(aid, p2)
+	resp, err := cs.sc.Send(cmd)
+
+	return checkOK(resp, err, apdu.SwOK, globalplatform.SwReferencedDataNotFound)
+}
+
+// LoadKeycardPackage loads the Keycard package from capFile.
+func (cs *GPCommandSet) LoadKeycardPackage(capFile *os.File, callback globalplatform.LoadingCallback) error {
+	return cs.LoadPackage(capFile, identifiers.PackageAID, callback)
+}
+
+// LoadPackage loads the package pkgAID from capFile, calling callback before each LOAD block.
+func (cs *GPCommandSet) LoadPackage(capFile *os.File, pkgAID []byte, callback globalplatform.LoadingCallback) error {
+	if cs.sc == nil {
+		return globalplatform.ErrSecureChannelNotOpen
+	}
+
+	preLoad := globalplatform.NewCommandInstallForLoad(pkgAID, []byte{})
+	resp, err := cs.sc.Send(preLoad)
+	if err = checkOK(resp, err); err != nil {
+		return err
+	}
+
+	load, err := globalplatform.NewLoadCommandStream(capFile)
+	if err != nil {
+		return err
+	}
+
+	for load.Next() {
+		cmd := load.GetCommand()
+		callback(int(load.Index()), load.BlocksCount())
+		resp, err = cs.sc.Send(cmd)
+		if err = checkOK(resp, err); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// InstallNDEFApplet installs the NDEF applet with the NDEF record as install parameters.
+func (cs *GPCommandSet) InstallNDEFApplet(ndefRecord []byte) error {
+	return cs.InstallForInstall(
+		identifiers.PackageAID,
+		identifiers.NdefAID,
+		identifiers.NdefInstanceAID,
+		ndefRecord)
+}
+
+// InstallCashApplet installs the Cash applet.
+func (cs *GPCommandSet) InstallCashApplet() error {
+	return cs.InstallForInstall(
+		identifiers.PackageAID,
+		identifiers.CashAID,
+		identifiers.CashInstanceAID,
+		[]byte{})
+}
+
+// InstallForInstall installs the instance instanceAID of the applet appletAID from the package packageAID.
+func (cs *GPCommandSet) InstallForInstall(packageAID, appletAID, instanceAID, params []byte) error {
+	if cs.sc == nil {
+		return globalplatform.ErrSecureChannelNotOpen
+	}
+
+	cmd := globalplatform.NewCommandInstallForInstall(packageAID, appletAID, instanceAID, params)
+	resp, err := cs.sc.Send(cmd)
+
+	return checkOK(resp, err)
+}
+
+// GetStatus returns the life cycle state of the ISD.
+func (cs *GPCommandSet) GetStatus() (*types.CardStatus, error) {
+	if cs.sc == nil {
+		return nil, globalplatform.ErrSecureChannelNotOpen
+	}
+
+	cmd := globalplatform.NewCommandGetStatus([]byte{}, globalplatform.P1GetStatusIssuerSecurityDomain)
+	resp, err := cs.sc.Send(cmd)
+	if err = checkOK(resp, err); err != nil {
+		return nil, err
+	}
+
+	return types.ParseCardStatus(resp.Data)
+}
+
+func checkOK(resp *apdu.Response, err error, allowedResponses ...uint16) error {
+	if err != nil {
+		return err
+	}
+
+	if len(allowedResponses) == 0 {
+		allowedResponses = []uint16{apdu.SwOK}
+	}
+
+	for _, code := range allowedResponses {
+		if code == resp.Sw {
+			return nil
+		}
+	}
+
+	return apdu.NewErrBadResponse(resp.Sw, "unexpected response")
+}
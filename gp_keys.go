@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/status-im/keycard-go/identifiers"
+)
+
+const (
+	DiversificationNone  = ""
+	DiversificationVisa2 = "visa2"
+	DiversificationEMV   = "emv"
+)
+
+var (
+	errMissingGPKeys            = errors.New("both the ENC and MAC keys must be specified")
+	errInvalidGPKeyLength       = errors.New("invalid GP key length")
+	errUnknownDiversification   = errors.New("unknown key diversification scheme")
+	errUnsupportedDiversifyData = errors.New("key diversification data must be 10 bytes")
+)
+
+// GPKeyConfig defines the ISD keys used to open the GlobalPlatform secure channel.
+// If no key is specified, the Keycard development key and the GlobalPlatform default key are tried.
+type GPKeyConfig struct {
+	// Key is a master key used for ENC, MAC and DEK.
+	Key string `json:"key"`
+	Enc string `json:"enc"`
+	Mac string `json:"mac"`
+	Dek string `json:"dek"`
+	// Diversification is the scheme used to derive the card keys from the static keys: "visa2" or "emv".
+	Diversification string `json:"diversification"`
+	// KeyVersion selects the key set on the card. 0 selects the first available key set.
+	KeyVersion int `json:"keyVersion"`
+	// SCP is the required secure channel protocol version, 2 or 3. 0 accepts the version offered by the card.
+	SCP int `json:"scp"`
+}
+
+// gpKeySet is a set of static ISD keys.
+type gpKeySet struct {
+	name string
+	enc  []byte
+	mac  []byte
+	dek  []byte
+}
+
+// LoadGPKeyConfig reads a GPKeyConfig from the JSON file at path.
+func LoadGPKeyConfig(path string) (*GPKeyConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &GPKeyConfig{}
+	if err = json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("error parsing GP key config: %v", err)
+	}
+
+	return config, nil
+}
+
+// Validate checks the keys and the diversification scheme.
+func (c *GPKeyConfig) Validate() error {
+	if _, err := c.keySets(); err != nil {
+		return err
+	}
+
+	switch strings.ToLower(c.Diversification) {
+	case DiversificationNone, DiversificationVisa2, DiversificationEMV:
+	default:
+		return fmt.Errorf("%w: %s", errUnknownDiversification, c.Diversification)
+	}
+
+	if c.KeyVersion < 0 || c.KeyVersion > 0xFF {
+		return fmt.Errorf("invalid key version %d", c.KeyVersion)
+	}
+
+	if c.SCP != 0 && c.SCP != 2 && c.SCP != 3 {
+		return fmt.Errorf("unsupported SCP version %d", c.SCP)
+	}
+
+	return nil
+}
+
+// HasKeys returns true if the config specifies keys instead of using the default ones.
+func (c *GPKeyConfig) HasKeys() bool {
+	return c != nil && (c.Key != "" || c.Enc != "" || c.Mac != "" || c.Dek != "")
+}
+
+func (c *GPKeyConfig) keySets() ([]gpKeySet, error) {
+	if !c.HasKeys() {
+		return []gpKeySet{
+			{"keycard", identifiers.KeycardDevelopmentKey, identifiers.KeycardDevelopmentKey, identifiers.KeycardDevelopmentKey},
+			{"globalplatform", identifiers.GlobalPlatformDefaultKey, identifiers.GlobalPlatformDefaultKey, identifiers.GlobalPlatformDefaultKey},
+		}, nil
+	}
+
+	if c.Key != "" {
+		key, err := decodeGPKey(c.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		return []gpKeySet{{"master", key, key, key}}, nil
+	}
+
+	if c.Enc == "" || c.Mac == "" {
+		return nil, errMissingGPKeys
+	}
+
+	set := gpKeySet{name: "static"}
+	var err error
+	if set.enc, err = decodeGPKey(c.Enc); err != nil {
+		return nil, err
+	}
+
+	if set.mac, err = decodeGPKey(c.Mac); err != nil {
+		return nil, err
+	}
+
+	if c.Dek != "" {
+		if set.dek, err = decodeGPKey(c.Dek); err != nil {
+			return nil, err
+		}
+	}
+
+	return []gpKeySet{set}, nil
+}
+
+func decodeGPKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+	if err != nil {
+		return nil, err
+	}
+
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("%w: %d bytes", errInvalidGPKeyLength, len(key))
+	}
+}
+
+// diversify derives the card keys from the static keys and the key diversification data
+// returned by INITIALIZE UPDATE. 3DES is used with SCP02 and AES with SCP03.
+func (ks gpKeySet) diversify(scheme string, divData []byte, scp byte) (gpKeySet, error) {
+	scheme = strings.ToLower(scheme)
+	if scheme == DiversificationNone {
+		return ks, nil
+	}
+
+	if len(divData) != 10 {
+		return ks, errUnsupportedDiversifyData
+	}
+
+	diversified := gpKeySet{name: fmt.Sprintf("%s (%s)", ks.name, scheme)}
+	keys := []*[]byte{&diversified.enc, &diversified.mac, &diversified.dek}
+	for i, static := range [][]byte{ks.enc, ks.mac, ks.dek} {
+		if static == nil {
+			continue
+		}
+
+		data, err := diversificationData(scheme, divData, byte(i+1))
+		if err != nil {
+			return ks, err
+		}
+
+		key, err := encryptECB(static, data, scp)
+		if err != nil {
+			return ks, err
+		}
+
+		*keys[i] = key
+	}
+
+	return diversified, nil
+}
+
+func diversificationData(scheme string, divData []byte, keyType byte) ([]byte, error) {
+	data := make([]byte, 0, 16)
+
+	switch scheme {
+	case DiversificationVisa2:
+		data = append(data, divData[0:2]...)
+		data = append(data, divData[4:8]...)
+		data = append(data, 0xF0, keyType)
+		data = append(data, divData[0:2]...)
+		data = append(data, divData[4:8]...)
+		data = append(data, 0x0F, keyType)
+	case DiversificationEMV:
+		data = append(data, divData[4:10]...)
+		data = append(data, 0xF0, keyType)
+		data = append(data, divData[4:10]...)
+		data = append(data, 0x0F, keyType)
+	default:
+		return nil, fmt.Errorf("%w: %s", errUnknownDiversification, scheme)
+	}
+
+	return data, nil
+}
+
+func encryptECB(key []byte, data []byte, scp byte) ([]byte, error) {
+	var (
+		block cipher.Block
+		err   error
+	)
+
+	if scp == 3 {
+		block, err = aes.NewCipher(key)
+	} else {
+		block, err = des.NewTripleDESCipher(tripleDESKey(key))
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, len(data))
+	for i := 0; i < len(data); i += block.BlockSize() {
+		block.Encrypt(out[i:i+block.BlockSize()], data[i:i+block.BlockSize()])
+	}
+
+	return out, nil
+}
+
+// tripleDESKey expands a 2-key 3DES key to the 24 bytes form.
+func tripleDESKey(key []byte) []byte {
+	if len(key) != 16 {
+		return key
+	}
+
+	k := make([]byte, 0, 24)
+	k = append(k, key...)
+	return append(k, key[:8]...)
+}
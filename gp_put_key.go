@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"errors"
+	"fmt"
+
+	"github.com/status-im/keycard-go/apdu"
+	"github.com/status-im/keycard-go/globalplatform"
+)
+
+const (
+	insPutKey         = 0xD8
+	p2PutKeyMultiple  = 0x81
+	keyTypeDES        = 0x80
+	keyTypeAES        = 0x88
+	keyCheckValueSize = 3
+)
+
+var (
+	errMissingDek           = errors.New("the DEK key is needed to encrypt the new keys")
+	errMissingNewKeys       = errors.New("the ENC, MAC and DEK keys must all be specified")
+	errKeyCheckValue        = errors.New("key check values returned by the card don't match")
+	errInvalidNewKeyVersion = errors.New("the new key version must be between 1 and 0x7F")
+)
+
+// PutKeys uploads a new ENC, MAC and DEK key set with PUT KEY. If replaceVersion is 0 the
+// key set is added, otherwise the key set with version replaceVersion is replaced.
+func (cs *GPCommandSet) PutKeys(keys gpKeySet, newVersion byte, replaceVersion byte) error {
+	if cs.sc == nil {
+		return globalplatform.ErrSecureChannelNotOpen
+	}
+
+	if len(cs.sc.dek) == 0 {
+		return errMissingDek
+	}
+
+	if keys.enc == nil || keys.mac == nil || keys.dek == nil {
+		return errMissingNewKeys
+	}
+
+	if newVersion == 0 || newVersion > 0x7F {
+		return errInvalidNewKeyVersion
+	}
+
+	data := []byte{newVersion}
+	var kcvs []byte
+	for _, key := range [][]byte{keys.enc, keys.mac, keys.dek} {
+		block, kcv, err := putKeyBlock(cs.sc.SCP, cs.sc.dek, key)
+		if err != nil {
+			return err
+		}
+
+		data = append(data, block...)
+		kcvs = append(kcvs, kcv...)
+	}
+
+	cmd := apdu.NewCommand(globalplatform.ClaGp, insPutKey, replaceVersion, p2PutKeyMultiple, data)
+	cmd.SetLe(0)
+	resp, err := cs.sc.Send(cmd)
+	if err = checkOK(resp, err); err != nil {
+		return err
+	}
+
+	expected := append([]byte{newVersion}, kcvs...)
+	if !bytes.Equal(resp.Data, expected) {
+		return fmt.Errorf("%w: got 0x%x, expected 0x%x", errKeyCheckValue, resp.Data, expected)
+	}
+
+	return nil
+}
+
+// putKeyBlock returns the key data block of key encrypted with dek, and the key check value.
+func putKeyBlock(scp byte, dek []byte, key []byte) ([]byte, []byte, error) {
+	if scp == 3 {
+		return aesPutKeyBlock(dek, key)
+	}
+
+	return desPutKeyBlock(dek, key)
+}
+
+func desPutKeyBlock(dek []byte, key []byte) ([]byte, []byte, error) {
+	if len(key) != 16 {
+		return nil, nil, fmt.Errorf("%w: SCP02 needs 16 bytes keys", errInvalidGPKeyLength)
+	}
+
+	encrypted, err := encryptECB(dek, key, 2)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyBlock, err := des.NewTripleDESCipher(tripleDESKey(key))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	kcv := make([]byte, des.BlockSize)
+	keyBlock.Encrypt(kcv, make([]byte, des.BlockSize))
+	kcv = kcv[:keyCheckValueSize]
+
+	block := []byte{keyTypeDES, byte(len(encrypted))}
+	block = append(block, encrypted...)
+	block = append(block, keyCheckValueSize)
+	block = append(block, kcv...)
+
+	return block, kcv, nil
+}
+
+func aesPutKeyBlock(dek []byte, key []byte) ([]byte, []byte, error) {
+	if len(key)%aes.BlockSize != 0 {
+		return nil, nil, fmt.Errorf("%w: only 16 and 32 bytes AES keys are supported", errInvalidGPKeyLength)
+	}
+
+	dekBlock, err := aes.NewCipher(dek)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	encrypted := make([]byte, len(key))
+	cipher.NewCBCEncrypter(dekBlock, make([]byte, aes.BlockSize)).CryptBlocks(encrypted, key)
+
+	keyBlock, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	kcv := make([]byte, aes.BlockSize)
+	keyBlock.Encrypt(kcv, bytes.Repeat([]byte{0x01}, aes.BlockSize))
+	kcv = kcv[:keyCheckValueSize]
+
+	// the key data is prefixed with the key length
+	block := []byte{keyTypeAES, byte(len(encrypted) + 1), byte(len(key))}
+	block = append(block, encrypted...)
+	block = append(block, keyCheckValueSize)
+	block = append(block, kcv...)
+
+	return block, kcv, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"errors"
+	"testing"
+
+	"github.com/status-im/keycard-go/apdu"
+)
+
+func TestPutKeyBlock(t *testing.T) {
+	// the GlobalPlatform default key, whose check values are 8BAF47 for 3DES and 504A77 for AES
+	key := mustHex(t, "404142434445464748494a4b4c4d4e4f")
+	dek := mustHex(t, "000102030405060708090a0b0c0d0e0f")
+
+	tests := []struct {
+		name   string
+		scp    byte
+		header string
+		kcv    string
+	}{
+		{"3DES", 2, "8010", "8baf47"},
+		{"AES", 3, "881110", "504a77"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			block, kcv, err := putKeyBlock(test.scp, dek, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(kcv, mustHex(t, test.kcv)) {
+				t.Fatalf("expected key check value %s, got %x", test.kcv, kcv)
+			}
+
+			// a single block key is encrypted the same with ECB and with CBC and a zero IV
+			encrypted, err := encryptECB(dek, key, test.scp)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expected := append(mustHex(t, test.header), encrypted...)
+			expected = append(expected, keyCheckValueSize)
+			expected = append(expected, kcv...)
+			if !bytes.Equal(block, expected) {
+				t.Fatalf("expected key block %x, got %x", expected, block)
+			}
+		})
+	}
+
+	if _, _, err := putKeyBlock(2, dek, key[:8]); !errors.Is(err, errInvalidGPKeyLength) {
+		t.Fatalf("expected %v, got %v", errInvalidGPKeyLength, err)
+	}
+}
+
+func TestPutKeys(t *testing.T) {
+	key := "404142434445464748494a4b4c4d4e4f"
+	newKey := mustHex(t, "000102030405060708090a0b0c0d0e0f")
+	newKeys := gpKeySet{enc: newKey, mac: newKey, dek: newKey}
+
+	card := &scp03TestCard{t: t, macKey: mustHex(t, key)}
+	sc, err := openGPSecureChannel(card, &GPKeyConfig{Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, kcv, err := aesPutKeyBlock(sc.dek, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		keys       gpKeySet
+		newVersion byte
+		response   []byte
+		err        error
+	}{
+		{
+			name:       "key check values match",
+			keys:       newKeys,
+			newVersion: 0x31,
+			response:   append(append(append([]byte{0x31}, kcv...), kcv...), kcv...),
+		},
+		{
+			name:       "key check values mismatch",
+			keys:       newKeys,
+			newVersion: 0x31,
+			response:   append([]byte{0x31}, make([]byte, 3*keyCheckValueSize)...),
+			err:        errKeyCheckValue,
+		},
+		{
+			name:       "invalid key version",
+			keys:       newKeys,
+			newVersion: 0x80,
+			err:        errInvalidNewKeyVersion,
+		},
+		{
+			name:       "missing key",
+			keys:       gpKeySet{enc: newKey, mac: newKey},
+			newVersion: 0x31,
+			err:        errMissingNewKeys,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			card.handle = func(cmd *apdu.Command) []byte {
+				if cmd.Ins != insPutKey || cmd.P1 != 0x30 || cmd.P2 != p2PutKeyMultiple || cmd.Data[0] != test.newVersion {
+					t.Fatalf("unexpected command %x %x %x", cmd.Ins, cmd.P1, cmd.P2)
+				}
+
+				// the version followed by 3 AES key blocks
+				if len(cmd.Data) != 1+3*(3+aes.BlockSize+1+keyCheckValueSize) {
+					t.Fatalf("unexpected PUT KEY data length %d", len(cmd.Data))
+				}
+
+				return test.response
+			}
+
+			cs := &GPCommandSet{c: card, sc: sc}
+			if err := cs.PutKeys(test.keys, test.newVersion, 0x30); !errors.Is(err, test.err) {
+				t.Fatalf("expected %v, got %v", test.err, err)
+			}
+		})
+	}
+}
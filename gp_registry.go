@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/status-im/keycard-go/apdu"
+	"github.com/status-im/keycard-go/globalplatform"
+	"github.com/status-im/keycard-go/types"
+)
+
+const (
+	p2GetStatusNext = 0x01
+	swMoreData      = 0x6310
+	swIncorrectP1P2 = 0x6A86
+)
+
+var (
+	tagGPRegistryTemplate    = apdu.Tag{0xE3}
+	tagGPRegistryAID         = apdu.Tag{0x4F}
+	tagGPRegistryLifeCycle   = apdu.Tag{0x9F, 0x70}
+	tagGPRegistryPrivileges  = apdu.Tag{0xC5}
+	tagGPRegistryLoadFileAID = apdu.Tag{0xC4}
+	tagGPRegistryVersion     = apdu.Tag{0xCE}
+	tagGPRegistryModuleAID   = apdu.Tag{0x84}
+	tagGPRegistrySDAID       = apdu.Tag{0xCC}
+)
+
+// GPRegistryEntry is an entry of the GlobalPlatform registry.
+type GPRegistryEntry struct {
+	AID        []byte
+	LifeCycle  byte
+	Privileges []byte
+	// LoadFileAID is the executable load file of an application.
+	LoadFileAID []byte
+	// SecurityDomainAID is the security domain associated to the entry.
+	SecurityDomainAID []byte
+	// Version is the version of an executable load file.
+	Version []byte
+	// Modules are the executable modules of an executable load file.
+	Modules [][]byte
+}
+
+// GPRegistry holds the content of the GlobalPlatform registry.
+type GPRegistry struct {
+	ISD          *GPRegistryEntry
+	LoadFiles    []*GPRegistryEntry
+	Applications []*GPRegistryEntry
+}
+
+// FindLoadFile returns the executable load file with the specified AID, or nil.
+func (r *GPRegistry) FindLoadFile(aid []byte) *GPRegistryEntry {
+	for _, e := range r.LoadFiles {
+		if bytes.Equal(e.AID, aid) {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// FindApplication returns the application with the specified AID, or nil.
+func (r *GPRegistry) FindApplication(aid []byte) *GPRegistryEntry {
+	for _, e := range r.Applications {
+		if bytes.Equal(e.AID, aid) {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// ApplicationsOf returns the applications instantiated from the load file with the specified AID.
+func (r *GPRegistry) ApplicationsOf(loadFileAID []byte) []*GPRegistryEntry {
+	var apps []*GPRegistryEntry
+	for _, e := range r.Applications {
+		if bytes.Equal(e.LoadFileAID, loadFileAID) {
+			apps = append(apps, e)
+		}
+	}
+
+	return apps
+}
+
+// readGPRegistry reads the registry with GET STATUS commands sent through the ISD secure channel c.
+func readGPRegistry(c types.Channel) (*GPRegistry, error) {
+	registry := &GPRegistry{}
+
+	isd, err := getStatus(c, globalplatform.P1GetStatusIssuerSecurityDomain)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(isd) > 0 {
+		registry.ISD = isd[0]
+	}
+
+	registry.Applications, err = getStatus(c, globalplatform.P1GetStatusApplications)
+	if err != nil {
+		return nil, err
+	}
+
+	registry.LoadFiles, err = getStatus(c, globalplatform.P1GetStatusExecLoadFilesAndModules)
+	var e *apdu.ErrBadResponse
+	if errors.As(err, &e) && e.Sw == swIncorrectP1P2 {
+		// some cards don't list the modules
+		registry.LoadFiles, err = getStatus(c, globalplatform.P1GetStatusExecLoadFiles)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return registry, nil
+}
+
+func getStatus(c types.Channel, p1 uint8) ([]*GPRegistryEntry, error) {
+	var entries []*GPRegistryEntry
+
+	cmd := globalplatform.NewCommandGetStatus([]byte{}, p1)
+	for {
+		resp, err := c.Send(cmd)
+		if err != nil {
+			return nil, err
+		}
+
+		switch resp.Sw {
+		case apdu.SwOK, swMoreData:
+		case globalplatform.SwReferencedDataNotFound:
+			// no entries
+			return entries, nil
+		default:
+			return nil, apdu.NewErrBadResponse(resp.Sw, "unexpected response")
+		}
+
+		parsed, err := parseGPRegistryEntries(resp.Data)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, parsed...)
+
+		if resp.Sw == apdu.SwOK {
+			return entries, nil
+		}
+
+		cmd = apdu.NewCommand(globalplatform.ClaGp, globalplatform.InsGetStatus, p1, globalplatform.P2GetStatusTLVData|p2GetStatusNext, cmd.Data)
+	}
+}
+
+func parseGPRegistryEntries(data []byte) ([]*GPRegistryEntry, error) {
+	var entries []*GPRegistryEntry
+
+	for n := 0; ; n++ {
+		tpl, err := apdu.FindTagN(data, n, tagGPRegistryTemplate)
+		if _, ok := err.(*apdu.ErrTagNotFound); ok {
+			return entries, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		entry := &GPRegistryEntry{}
+		if entry.AID, err = apdu.FindTag(tpl, tagGPRegistryAID); err != nil {
+			return nil, err
+		}
+
+		if lc, err := apdu.FindTag(tpl, tagGPRegistryLifeCycle); err == nil && len(lc) == 1 {
+			entry.LifeCycle = lc[0]
+		}
+
+		entry.Privileges, _ = apdu.FindTag(tpl, tagGPRegistryPrivileges)
+		entry.LoadFileAID, _ = apdu.FindTag(tpl, tagGPRegistryLoadFileAID)
+		entry.SecurityDomainAID, _ = apdu.FindTag(tpl, tagGPRegistrySDAID)
+		entry.Version, _ = apdu.FindTag(tpl, tagGPRegistryVersion)
+
+		for m := 0; ; m++ {
+			module, err := apdu.FindTagN(tpl, m, tagGPRegistryModuleAID)
+			if err != nil {
+				break
+			}
+			entry.Modules = append(entry.Modules, module)
+		}
+
+		entries = append(entries, entry)
+	}
+}
+
+var gpPrivileges = [][]string{
+	{"Security Domain", "DAP Verification", "Delegated Management", "Card Lock", "Card Terminate", "Card Reset", "CVM Management", "Mandated DAP Verification"},
+	{"Trusted Path", "Authorized Management", "Token Verification", "Global Delete", "Global Lock", "Global Registry", "Final Application", "Global Service"},
+	{"Receipt Generation", "Ciphered Load File Data Block", "Contactless Activation", "Contactless Self-Activation"},
+}
+
+var (
+	gpCardLifeCycles = map[byte]string{
+		0x01: "OP_READY",
+		0x07: "INITIALIZED",
+		0x0F: "SECURED",
+		0x7F: "CARD_LOCKED",
+		0xFF: "TERMINATED",
+	}
+
+	gpLoadFileLifeCycles = map[byte]string{
+		0x01: "LOADED",
+	}
+
+	gpApplicationLifeCycles = map[byte]string{
+		0x03: "INSTALLED",
+		0x07: "SELECTABLE",
+		0x0F: "PERSONALIZED",
+	}
+)
+
+func (r *GPRegistry) String() string {
+	var buf bytes.Buffer
+
+	if r.ISD != nil {
+		writeGPRegistryEntry(&buf, "ISD", r.ISD, gpCardLifeCycles)
+	}
+
+	for _, e := range r.LoadFiles {
+		writeGPRegistryEntry(&buf, "LOAD FILE", e, gpLoadFileLifeCycles)
+	}
+
+	for _, e := range r.Applications {
+		writeGPRegistryEntry(&buf, "APPLICATION", e, gpApplicationLifeCycles)
+	}
+
+	return buf.String()
+}
+
+func writeGPRegistryEntry(buf *bytes.Buffer, kind string, e *GPRegistryEntry, lifeCycles map[byte]string) {
+	fmt.Fprintf(buf, "%s: %X\n", kind, e.AID)
+	fmt.Fprintf(buf, "  lifecycle: %s (0x%02X)\n", gpLifeCycleName(e.LifeCycle, lifeCycles), e.LifeCycle)
+
+	if len(e.Privileges) > 0 {
+		fmt.Fprintf(buf, "  privileges: %s (0x%X)\n", strings.Join(gpPrivilegeNames(e.Privileges), ", "), e.Privileges)
+	}
+
+	if len(e.Version) == 2 {
+		fmt.Fprintf(buf, "  version: %d.%d\n", e.Version[0], e.Version[1])
+	}
+
+	if len(e.LoadFileAID) > 0 {
+		fmt.Fprintf(buf, "  load file: %X\n", e.LoadFileAID)
+	}
+
+	if len(e.SecurityDomainAID) > 0 {
+		fmt.Fprintf(buf, "  security domain: %X\n", e.SecurityDomainAID)
+	}
+
+	for _, module := range e.Modules {
+		fmt.Fprintf(buf, "  module: %X\n", module)
+	}
+}
+
+func gpLifeCycleName(lc byte, names map[byte]string) string {
+	if name, ok := names[lc]; ok {
+		return name
+	}
+
+	// bit 8 locks applications and security domains
+	if lc&0x80 != 0 && names[0x03] != "" {
+		return "LOCKED"
+	}
+
+	return "APPLICATION SPECIFIC"
+}
+
+func gpPrivilegeNames(privileges []byte) []string {
+	names := []string{}
+	for i, b := range privileges {
+		if i >= len(gpPrivileges) {
+			break
+		}
+
+		for bit, name := range gpPrivileges[i] {
+			if b&(0x80>>uint(bit)) != 0 {
+				names = append(names, name)
+			}
+		}
+	}
+
+	if len(names) == 0 {
+		names = append(names, "none")
+	}
+
+	return names
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"github.com/status-im/keycard-go/apdu"
+	"github.com/status-im/keycard-go/globalplatform"
+	gpcrypto "github.com/status-im/keycard-go/globalplatform/crypto"
+	"github.com/status-im/keycard-go/hexutils"
+	"github.com/status-im/keycard-go/types"
+)
+
+const (
+	scp03DerivationCardCryptogram = 0x00
+	scp03DerivationHostCryptogram = 0x01
+	scp03DerivationSMac           = 0x06
+)
+
+var (
+	derivationPurposeDek = []byte{0x01, 0x81}
+
+	errBadCardCryptogram = errors.New("bad card cryptogram")
+	errUnsupportedSCP    = errors.New("unsupported secure channel protocol")
+)
+
+type gpWrapper interface {
+	Wrap(cmd *apdu.Command) (*apdu.Command, error)
+}
+
+// GPSecureChannel is a GlobalPlatform SCP02 or SCP03 secure channel with C-MAC security level.
+type GPSecureChannel struct {
+	c types.Channel
+	w gpWrapper
+	// SCP is the secure channel protocol version.
+	SCP byte
+	// KeyVersion is the version of the key set used to open the channel.
+	KeyVersion byte
+	// divData is the key diversification data returned by INITIALIZE UPDATE.
+	divData []byte
+	// dek is the key used to encrypt sensitive data: the session DEK with SCP02 and the static DEK with SCP03.
+	dek []byte
+}
+
+// Send sends wrapped commands to the inner channel.
+func (sc *GPSecureChannel) Send(cmd *apdu.Command) (*apdu.Response, error) {
+	rawCmd, err := cmd.Serialize()
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debug("wrapping apdu command", "hex", hexutils.BytesToHexWithSpaces(rawCmd))
+	wrappedCmd, err := sc.w.Wrap(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	return sc.c.Send(wrappedCmd)
+}
+
+// openGPSecureChannel authenticates to the selected security domain with the keys of config.
+func openGPSecureChannel(c types.Channel, config *GPKeyConfig) (*GPSecureChannel, error) {
+	if config == nil {
+		config = &GPKeyConfig{}
+	}
+
+	keySets, err := config.keySets()
+	if err != nil {
+		return nil, err
+	}
+
+	hostChallenge := make([]byte, 8)
+	if _, err = rand.Read(hostChallenge); err != nil {
+		return nil, err
+	}
+
+	cmd := globalplatform.NewCommandInitializeUpdate(hostChallenge)
+	cmd.P1 = uint8(config.KeyVersion)
+	resp, err := c.Send(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.Sw {
+	case apdu.SwOK:
+	case globalplatform.SwSecurityConditionNotSatisfied:
+		return nil, apdu.NewErrBadResponse(resp.Sw, "security condition not satisfied")
+	case globalplatform.SwAuthenticationMethodBlocked:
+		return nil, apdu.NewErrBadResponse(resp.Sw, "authentication method blocked")
+	default:
+		return nil, apdu.NewErrBadResponse(resp.Sw, "unexpected response")
+	}
+
+	if len(resp.Data) < 12 {
+		return nil, apdu.NewErrBadResponse(resp.Sw, fmt.Sprintf("bad data length %d", len(resp.Data)))
+	}
+
+	divData := resp.Data[0:10]
+	keyVersion := resp.Data[10]
+	scp := resp.Data[11]
+	logger.Debug("initialize update", "scp", scp, "key version", keyVersion, "diversification data", fmt.Sprintf("%x", divData))
+
+	if config.SCP != 0 && byte(config.SCP) != scp {
+		return nil, fmt.Errorf("%w: SCP%02d requested, card offers SCP%02d", errUnsupportedSCP, config.SCP, scp)
+	}
+
+	for _, static := range keySets {
+		keys, err := static.diversify(config.Diversification, divData, scp)
+		if err != nil {
+			return nil, err
+		}
+
+		logger.Debug("initialize session", "keys", keys.name)
+
+		var (
+			sc      *GPSecureChannel
+			extAuth *apdu.Command
+		)
+
+		switch scp {
+		case 2:
+			sc, extAuth, err = newSCP02Channel(c, keys, resp.Data, hostChallenge)
+		case 3:
+			sc, extAuth, err = newSCP03Channel(c, keys, resp.Data, hostChallenge)
+		default:
+			return nil, fmt.Errorf("%w: SCP%02d", errUnsupportedSCP, scp)
+		}
+
+		// try the next keys
+		if err == errBadCardCryptogram {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		sc.SCP = scp
+		sc.KeyVersion = keyVersion
+		sc.divData = divData
+
+		resp, err := sc.Send(extAuth)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.Sw != apdu.SwOK {
+			return nil, apdu.NewErrBadResponse(resp.Sw, "external authenticate failed")
+		}
+
+		return sc, nil
+	}
+
+	return nil, errBadCardCryptogram
+}
+
+func newSCP02Channel(c types.Channel, keys gpKeySet, data []byte, hostChallenge []byte) (*GPSecureChannel, *apdu.Command, error) {
+	if len(data) != 28 {
+		return nil, nil, fmt.Errorf("bad SCP02 initialize update data length, expected 28, got %d", len(data))
+	}
+
+	if len(keys.enc) != 16 || len(keys.mac) != 16 {
+		return nil, nil, fmt.Errorf("%w: SCP02 needs 16 bytes keys", errInvalidGPKeyLength)
+	}
+
+	seq := data[12:14]
+	cardChallenge := data[12:20]
+	cardCryptogram := data[20:28]
+
+	sessionEnc, err := gpcrypto.DeriveKey(keys.enc, seq, gpcrypto.DerivationPurposeEnc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sessionMac, err := gpcrypto.DeriveKey(keys.mac, seq, gpcrypto.DerivationPurposeMac)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	verified, err := gpcrypto.VerifyCryptogram(sessionEnc, hostChallenge, cardChallenge, cardCryptogram)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !verified {
+		return nil, nil, errBadCardCryptogram
+	}
+
+	sc := &GPSecureChannel{
+		c: c,
+		w: globalplatform.NewSCP02Wrapper(sessionMac),
+	}
+
+	if len(keys.dek) == 16 {
+		if sc.dek, err = gpcrypto.DeriveKey(keys.dek, seq, derivationPurposeDek); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	extAuth, err := globalplatform.NewCommandExternalAuthenticate(sessionEnc, cardChallenge, hostChallenge)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return sc, extAuth, nil
+}
+
+func newSCP03Channel(c types.Channel, keys gpKeySet, data []byte, hostChallenge []byte) (*GPSecureChannel, *apdu.Command, error) {
+	if len(data) != 29 && len(data) != 32 {
+		return nil, nil, fmt.Errorf("bad SCP03 initialize update data length, expected 29 or 32, got %d", len(data))
+	}
+
+	cardChallenge := data[13:21]
+	cardCryptogram := data[21:29]
+
+	context := make([]byte, 0, 16)
+	context = append(context, hostChallenge...)
+	context = append(context, cardChallenge...)
+
+	// with the C-MAC security level only the session MAC key is needed
+	sessionMac, err := scp03KDF(keys.mac, scp03DerivationSMac, len(keys.mac)*8, context)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	expected, err := scp03KDF(sessionMac, scp03DerivationCardCryptogram, 64, context)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !bytes.Equal(expected, cardCryptogram) {
+		return nil, nil, errBadCardCryptogram
+	}
+
+	hostCryptogram, err := scp03KDF(sessionMac, scp03DerivationHostCryptogram, 64, context)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sc := &GPSecureChannel{
+		c:   c,
+		w:   &scp03Wrapper{macKey: sessionMac, chaining: make([]byte, aes.BlockSize)},
+		dek: keys.dek,
+	}
+
+	extAuth := apdu.NewCommand(
+		globalplatform.ClaMac,
+		globalplatform.InsExternalAuthenticate,
+		globalplatform.P1ExternalAuthenticateCMAC,
+		0,
+		hostCryptogram,
+	)
+
+	return sc, extAuth, nil
+}
+
+// scp03Wrapper adds the SCP03 C-MAC to the commands.
+type scp03Wrapper struct {
+	macKey   []byte
+	chaining []byte
+}
+
+func (w *scp03Wrapper) Wrap(cmd *apdu.Command) (*apdu.Command, error) {
+	cla := cmd.Cla | 0x04
+
+	macData := make([]byte, 0, len(w.chaining)+5+len(cmd.Data))
+	macData = append(macData, w.chaining...)
+	macData = append(macData, cla, cmd.Ins, cmd.P1, cmd.P2, uint8(len(cmd.Data)+8))
+	macData = append(macData, cmd.Data...)
+
+	mac, err := aesCMAC(w.macKey, macData)
+	if err != nil {
+		return nil, err
+	}
+
+	w.chaining = mac
+
+	newData := make([]byte, 0, len(cmd.Data)+8)
+	newData = append(newData, cmd.Data...)
+	newData = append(newData, mac[:8]...)
+
+	newCmd := apdu.NewCommand(cla, cmd.Ins, cmd.P1, cmd.P2, newData)
+	if ok, le := cmd.Le(); ok {
+		newCmd.SetLe(le)
+	}
+
+	return newCmd, nil
+}
+
+// scp03KDF is the NIST SP 800-108 KDF in counter mode with AES-CMAC defined by SCP03.
+func scp03KDF(key []byte, constant byte, bits int, context []byte) ([]byte, error) {
+	var out []byte
+	for counter := byte(1); len(out)*8 < bits; counter++ {
+		data := make([]byte, 11, 16+len(context))
+		data = append(data, constant, 0x00, byte(bits>>8), byte(bits), counter)
+		data = append(data, context...)
+
+		mac, err := aesCMAC(key, data)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, mac...)
+	}
+
+	return out[:bits/8], nil
+}
+
+// aesCMAC computes the AES-CMAC defined in RFC 4493.
+func aesCMAC(key []byte, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	k1, k2 := cmacSubkeys(block)
+
+	n := (len(data) + aes.BlockSize - 1) / aes.BlockSize
+	if n == 0 {
+		n = 1
+	}
+
+	last := make([]byte, aes.BlockSize)
+	rest := data[(n-1)*aes.BlockSize:]
+	if len(rest) == aes.BlockSize {
+		xorBlock(last, rest, k1)
+	} else {
+		copy(last, rest)
+		last[len(rest)] = 0x80
+		xorBlock(last, last, k2)
+	}
+
+	x := make([]byte, aes.BlockSize)
+	for i := 0; i < n-1; i++ {
+		xorBlock(x, x, data[i*aes.BlockSize:(i+1)*aes.BlockSize])
+		block.Encrypt(x, x)
+	}
+
+	xorBlock(x, x, last)
+	block.Encrypt(x, x)
+
+	return x, nil
+}
+
+func cmacSubkeys(block cipher.Block) ([]byte, []byte) {
+	l := make([]byte, aes.BlockSize)
+	block.Encrypt(l, l)
+
+	k1 := cmacShift(l)
+	k2 := cmacShift(k1)
+
+	return k1, k2
+}
+
+func cmacShift(in []byte) []byte {
+	out := make([]byte, len(in))
+	var carry byte
+	for i := len(in) - 1; i >= 0; i-- {
+		out[i] = in[i]<<1 | carry
+		carry = in[i] >> 7
+	}
+
+	if in[0]&0x80 != 0 {
+		out[len(out)-1] ^= 0x87
+	}
+
+	return out
+}
+
+func xorBlock(dst, a, b []byte) {
+	for i := range dst {
+		dst[i] = a[i] ^ b[i]
+	}
+}
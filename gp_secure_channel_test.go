@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"errors"
+	"testing"
+
+	"github.com/status-im/keycard-go/apdu"
+	"github.com/status-im/keycard-go/globalplatform"
+)
+
+func TestAESCMAC(t *testing.T) {
+	// RFC 4493 section 4 examples
+	key := "2b7e151628aed2a6abf7158809cf4f3c"
+	message := "6bc1bee22e409f96e93d7e117393172aae2d8a571e03ac9c9eb76fac45af8e5130c81c46a35ce411e5fbc1191a0a52eff69f2445df4f9b17ad2b417be66c3710"
+
+	tests := []struct {
+		length int
+		mac    string
+	}{
+		{0, "bb1d6929e95937287fa37d129b756746"},
+		{16, "070a16b46b4d4144f79bdd9dd04a287c"},
+		{40, "dfa66747de9ae63030ca32611497c827"},
+		{64, "51f0bebf7e3b9d92fc49741779363cfe"},
+	}
+
+	for _, test := range tests {
+		mac, err := aesCMAC(mustHex(t, key), mustHex(t, message)[:test.length])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(mac, mustHex(t, test.mac)) {
+			t.Fatalf("length %d: expected %s, got %x", test.length, test.mac, mac)
+		}
+	}
+}
+
+func TestSCP03KDF(t *testing.T) {
+	key := mustHex(t, "404142434445464748494a4b4c4d4e4f")
+	context := mustHex(t, "00112233445566778899aabbccddeeff")
+
+	// GP Amendment D 4.1.5: 11 zero bytes and the derivation constant as label, a zero separator,
+	// the output length in bits on 2 bytes, the counter and the context
+	derivationData := func(constant byte, bits uint16, counter byte) []byte {
+		data := make([]byte, 11)
+		data = append(data, constant, 0x00, byte(bits>>8), byte(bits), counter)
+		return append(data, context...)
+	}
+
+	tests := []struct {
+		name     string
+		constant byte
+		bits     int
+		blocks   [][]byte
+	}{
+		{"card cryptogram", scp03DerivationCardCryptogram, 64, [][]byte{derivationData(0x00, 64, 1)}},
+		{"S-MAC AES-128", scp03DerivationSMac, 128, [][]byte{derivationData(0x06, 128, 1)}},
+		{"S-MAC AES-256", scp03DerivationSMac, 256, [][]byte{derivationData(0x06, 256, 1), derivationData(0x06, 256, 2)}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var expected []byte
+			for _, data := range test.blocks {
+				mac, err := aesCMAC(key, data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				expected = append(expected, mac...)
+			}
+			expected = expected[:test.bits/8]
+
+			out, err := scp03KDF(key, test.constant, test.bits, context)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(out, expected) {
+				t.Fatalf("expected %x, got %x", expected, out)
+			}
+		})
+	}
+}
+
+func TestSCP03WrapperChaining(t *testing.T) {
+	key := mustHex(t, "404142434445464748494a4b4c4d4e4f")
+	w := &scp03Wrapper{macKey: key, chaining: make([]byte, aes.BlockSize)}
+
+	chaining := make([]byte, aes.BlockSize)
+	for i, data := range [][]byte{{0x01, 0x02}, nil} {
+		cmd := apdu.NewCommand(globalplatform.ClaGp, globalplatform.InsDelete, 0x00, 0x80, data)
+		wrapped, err := w.Wrap(cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		macData := append(append([]byte{}, chaining...), globalplatform.ClaMac, globalplatform.InsDelete, 0x00, 0x80, byte(len(data)+8))
+		mac, err := aesCMAC(key, append(macData, data...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		chaining = mac
+
+		if wrapped.Cla != globalplatform.ClaMac || !bytes.Equal(wrapped.Data, append(append([]byte{}, data...), mac[:8]...)) {
+			t.Fatalf("command %d: unexpected wrapped command %x %x", i, wrapped.Cla, wrapped.Data)
+		}
+	}
+}
+
+// scp03TestCard is an ISD accepting SCP03 with the static MAC key macKey.
+// Commands received after EXTERNAL AUTHENTICATE are passed to handle without their C-MAC.
+type scp03TestCard struct {
+	t             *testing.T
+	macKey        []byte
+	sessionMac    []byte
+	chaining      []byte
+	authenticated bool
+	handle        func(cmd *apdu.Command) []byte
+}
+
+func (c *scp03TestCard) Send(cmd *apdu.Command) (*apdu.Response, error) {
+	t := c.t
+	switch {
+	case cmd.Ins == globalplatform.InsInitializeUpdate:
+		cardChallenge := mustHex(t, "0102030405060708")
+		context := append(append([]byte{}, cmd.Data...), cardChallenge...)
+		sessionMac, err := scp03KDF(c.macKey, scp03DerivationSMac, 128, context)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cryptogram, err := scp03KDF(sessionMac, scp03DerivationCardCryptogram, 64, context)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hostCryptogram, err := scp03KDF(sessionMac, scp03DerivationHostCryptogram, 64, context)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c.sessionMac = sessionMac
+		c.chaining = make([]byte, aes.BlockSize)
+		c.handle = func(cmd *apdu.Command) []byte {
+			if cmd.Ins != globalplatform.InsExternalAuthenticate || !bytes.Equal(cmd.Data, hostCryptogram) {
+				t.Fatalf("unexpected external authenticate %x", cmd.Data)
+			}
+			c.authenticated = true
+			return nil
+		}
+
+		data := mustHex(t, "00000000000000000000300300")
+		data = append(data, cardChallenge...)
+		data = append(data, cryptogram...)
+		return apdu.ParseResponse(append(data, 0x90, 0x00))
+	case cmd.Cla == globalplatform.ClaMac:
+		data := cmd.Data[:len(cmd.Data)-8]
+		macData := append(append([]byte{}, c.chaining...), cmd.Cla, cmd.Ins, cmd.P1, cmd.P2, byte(len(cmd.Data)))
+		mac, err := aesCMAC(c.sessionMac, append(macData, data...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(mac[:8], cmd.Data[len(data):]) {
+			t.Fatalf("invalid C-MAC for command %x", cmd.Ins)
+		}
+		c.chaining = mac
+
+		return apdu.ParseResponse(append(c.handle(apdu.NewCommand(globalplatform.ClaGp, cmd.Ins, cmd.P1, cmd.P2, data)), 0x90, 0x00))
+	default:
+		t.Fatalf("unexpected command %x", cmd.Ins)
+		return nil, nil
+	}
+}
+
+func TestOpenGPSecureChannelSCP03(t *testing.T) {
+	key := "404142434445464748494a4b4c4d4e4f"
+
+	card := &scp03TestCard{t: t, macKey: mustHex(t, key)}
+	sc, err := openGPSecureChannel(card, &GPKeyConfig{Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !card.authenticated || sc.SCP != 3 || sc.KeyVersion != 0x30 || !bytes.Equal(sc.dek, mustHex(t, key)) {
+		t.Fatalf("unexpected secure channel: authenticated %v, SCP %d, key version %x", card.authenticated, sc.SCP, sc.KeyVersion)
+	}
+
+	card = &scp03TestCard{t: t, macKey: mustHex(t, key)}
+	if _, err = openGPSecureChannel(card, &GPKeyConfig{Key: "000102030405060708090a0b0c0d0e0f"}); !errors.Is(err, errBadCardCryptogram) {
+		t.Fatalf("expected %v, got %v", errBadCardCryptogram, err)
+	}
+
+	card = &scp03TestCard{t: t, macKey: mustHex(t, key)}
+	if _, err = openGPSecureChannel(card, &GPKeyConfig{Key: key, SCP: 2}); !errors.Is(err, errUnsupportedSCP) {
+		t.Fatalf("expected %v, got %v", errUnsupportedSCP, err)
+	}
+}
+
+func TestDiversificationData(t *testing.T) {
+	divData := mustHex(t, "00010203040506070809")
+
+	tests := []struct {
+		scheme   string
+		keyType  byte
+		expected string
+	}{
+		{DiversificationVisa2, 1, "000104050607f001000104050607" + "0f01"},
+		{DiversificationEMV, 2, "040506070809f002040506070809" + "0f02"},
+	}
+
+	for _, test := range tests {
+		data, err := diversificationData(test.scheme, divData, test.keyType)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(data, mustHex(t, test.expected)) {
+			t.Fatalf("%s: expected %s, got %x", test.scheme, test.expected, data)
+		}
+	}
+
+	if _, err := diversificationData("other", divData, 1); !errors.Is(err, errUnknownDiversification) {
+		t.Fatalf("expected %v, got %v", errUnknownDiversification, err)
+	}
+}
+
+func TestEncryptECB(t *testing.T) {
+	tests := []struct {
+		name       string
+		scp        byte
+		key        string
+		plaintext  string
+		ciphertext string
+	}{
+		// FIPS-197 appendix C.1
+		{"AES", 3, "000102030405060708090a0b0c0d0e0f", "00112233445566778899aabbccddeeff", "69c4e0d86a7b0430d8cdb78070b4c55a"},
+		// a 2-key 3DES key with equal halves is single DES: FIPS 81 example
+		{"3DES", 2, "0123456789abcdef0123456789abcdef", "4e6f772069732074", "3fa40e8a984d4815"},
+	}
+
+	for _, test := range tests {
+		out, err := encryptECB(mustHex(t, test.key), mustHex(t, test.plaintext), test.scp)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(out, mustHex(t, test.ciphertext)) {
+			t.Fatalf("%s: expected %s, got %x", test.name, test.ciphertext, out)
+		}
+	}
+}
@@ -22,58 +22,75 @@ var (
 
 // Initializer defines a struct with methods to install applets and initialize a card.
 type Initializer struct {
-	c types.Channel
+	c             types.Channel
+	instanceIndex int
 }
 
-// NewInitializer returns a new Initializer that communicates to Transmitter t.
-func NewInitializer(t io.Transmitter) *Initializer {
+// NewInitializer returns a new Initializer that communicates to Transmitter t
+// with the Keycard instance with the specified index.
+func NewInitializer(t io.Transmitter, instanceIndex int) *Initializer {
 	return &Initializer{
-		c: io.NewNormalChannel(t),
+		c:             io.NewNormalChannel(t),
+		instanceIndex: instanceIndex,
 	}
 }
 
 func (i *Initializer) Init() (*keycard.Secrets, error) {
-	logger.Info("initialization started")
-	cmdSet := keycard.NewCommandSet(i.c)
-
 	secrets, err := keycard.GenerateSecrets()
 	if err != nil {
 		return nil, err
 	}
 
+	if err = i.InitWithSecrets(secrets); err != nil {
+		return nil, err
+	}
+
+	return secrets, nil
+}
+
+// InitWithSecrets initializes the card with the specified secrets.
+func (i *Initializer) InitWithSecrets(secrets *keycard.Secrets) error {
+	logger.Info("initialization started")
+	kc, err := newInstanceChannel(i.c, i.instanceIndex)
+	if err != nil {
+		return err
+	}
+
+	cmdSet := keycard.NewCommandSet(kc)
+
 	logger.Info("select keycard applet")
 	err = cmdSet.Select()
 	if err != nil {
 		logger.Error("select failed", "error", err)
-		return nil, err
+		return err
 	}
 
 	if !cmdSet.ApplicationInfo.Installed {
 		logger.Error("initialization failed", "error", errAppletNotInstalled)
-		return nil, errAppletNotInstalled
+		return errAppletNotInstalled
 	}
 
 	if cmdSet.ApplicationInfo.Initialized {
 		logger.Error("initialization failed", "error", errCardAlreadyInitialized)
-		return nil, errCardAlreadyInitialized
+		return errCardAlreadyInitialized
 	}
 
 	logger.Info("initializing")
-	err = cmdSet.Init(secrets)
-	if err != nil {
-		return nil, err
-	}
-
-	return secrets, nil
+	return cmdSet.Init(secrets)
 }
 
 // Info returns a types.ApplicationInfo struct with info about the card.
 func (i *Initializer) Info() (*types.ApplicationInfo, *types.CashApplicationInfo, error) {
 	logger.Info("info started")
-	cmdSet := keycard.NewCommandSet(i.c)
+	kc, err := newInstanceChannel(i.c, i.instanceIndex)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cmdSet := keycard.NewCommandSet(kc)
 
 	logger.Info("select keycard applet")
-	err := cmdSet.Select()
+	err = cmdSet.Select()
 	if err != nil {
 		if e, ok := err.(*apdu.ErrBadResponse); ok && e.Sw == globalplatform.SwFileNotFound {
 			err = nil
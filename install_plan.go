@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/status-im/keycard-go/apdu"
+	"github.com/status-im/keycard-go/globalplatform"
+	"github.com/status-im/keycard-go/identifiers"
+)
+
+// PlannedObject is an object removed by a DELETE command.
+type PlannedObject struct {
+	Kind string
+	AID  []byte
+}
+
+// PlannedDeletion is a DELETE command.
+type PlannedDeletion struct {
+	AID []byte
+	P2  uint8
+	// Removes lists the objects removed by the command.
+	Removes []PlannedObject
+}
+
+// PlannedLoad describes the package loaded to the card.
+type PlannedLoad struct {
+	File         string
+	PackageAID   []byte
+	Version      CapVersion
+	LoadFileSize int
+	Blocks       int
+}
+
+// PlannedInstall describes an install-for-install command.
+type PlannedInstall struct {
+	Name        string
+	PackageAID  []byte
+	AppletAID   []byte
+	InstanceAID []byte
+	Params      []byte
+	// ParamsNote explains parameters that can only be computed during the installation.
+	ParamsNote string
+}
+
+// InstallPlan describes the commands an installation or a deletion would send to the card.
+type InstallPlan struct {
+	Registry  *GPRegistry
+	Deletions []PlannedDeletion
+	Load      *PlannedLoad
+	Installs  []PlannedInstall
+	// Skipped lists the requested applets that are not installed, with the reason.
+	Skipped []string
+	// Abort is set if the operation would stop before changing the card.
+	Abort error
+}
+
+func (p *InstallPlan) String() string {
+	var buf bytes.Buffer
+
+	if p.Abort != nil {
+		fmt.Fprintf(&buf, "ABORT: %v\n", p.Abort)
+	}
+
+	fmt.Fprintf(&buf, "Delete:\n")
+	if len(p.Deletions) == 0 {
+		fmt.Fprintf(&buf, "  nothing\n")
+	}
+	for _, d := range p.Deletions {
+		for _, obj := range d.Removes {
+			fmt.Fprintf(&buf, "  %s 0x%x\n", obj.Kind, obj.AID)
+		}
+		fmt.Fprintf(&buf, "    command: %s\n", serializeCommand(globalplatform.NewCommandDelete(d.AID, d.P2)))
+	}
+
+	if p.Load != nil {
+		fmt.Fprintf(&buf, "Load:\n")
+		fmt.Fprintf(&buf, "  file: %s\n", p.Load.File)
+		fmt.Fprintf(&buf, "  package 0x%x version %s\n", p.Load.PackageAID, p.Load.Version)
+		fmt.Fprintf(&buf, "  load file size: %d bytes in %d LOAD blocks\n", p.Load.LoadFileSize, p.Load.Blocks)
+		fmt.Fprintf(&buf, "  install for load: %s\n", serializeCommand(globalplatform.NewCommandInstallForLoad(p.Load.PackageAID, []byte{})))
+	}
+
+	if len(p.Installs) > 0 {
+		fmt.Fprintf(&buf, "Install:\n")
+	}
+	for _, in := range p.Installs {
+		fmt.Fprintf(&buf, "  %s applet 0x%x, instance 0x%x, params 0x%x\n", in.Name, in.AppletAID, in.InstanceAID, in.Params)
+		if in.ParamsNote != "" {
+			fmt.Fprintf(&buf, "    %s\n", in.ParamsNote)
+		}
+		fmt.Fprintf(&buf, "    command: %s\n", serializeCommand(globalplatform.NewCommandInstallForInstall(in.PackageAID, in.AppletAID, in.InstanceAID, in.Params)))
+	}
+
+	if len(p.Skipped) > 0 {
+		fmt.Fprintf(&buf, "Not installed:\n")
+	}
+	for _, s := range p.Skipped {
+		fmt.Fprintf(&buf, "  %s\n", s)
+	}
+
+	return buf.String()
+}
+
+// sharedInstance is a cash or NDEF instance, shared by all the Keycard instances of the package.
+type sharedInstance struct {
+	name      string
+	aid       []byte
+	installed bool
+}
+
+// String explains why the instance is not installed with a new Keycard instance.
+func (si sharedInstance) String() string {
+	if si.installed {
+		return fmt.Sprintf("%s applet: shared by the Keycard instances, the installed instance 0x%x is kept", si.name, si.aid)
+	}
+
+	return fmt.Sprintf("%s applet: not installed in the loaded package, reinstall the package with -f to add it", si.name)
+}
+
+// sharedInstances returns the requested cash and NDEF instances, which are not installed when
+// a Keycard instance is added to the loaded package.
+func sharedInstances(registry *GPRegistry, installCash bool, installNDEF bool) []sharedInstance {
+	var instances []sharedInstance
+	if installCash {
+		instances = append(instances, sharedInstance{"cash", identifiers.CashInstanceAID, registry.FindApplication(identifiers.CashInstanceAID) != nil})
+	}
+	if installNDEF {
+		instances = append(instances, sharedInstance{"NDEF", identifiers.NdefInstanceAID, registry.FindApplication(identifiers.NdefInstanceAID) != nil})
+	}
+
+	return instances
+}
+
+// KeycardInstances returns the indexes of the Keycard instances deleted by the plan.
+func (p *InstallPlan) KeycardInstances() []int {
+	var indexes []int
+	for _, d := range p.Deletions {
+		for _, obj := range d.Removes {
+			if len(obj.AID) == len(identifiers.KeycardAID)+1 && bytes.HasPrefix(obj.AID, identifiers.KeycardAID) {
+				indexes = append(indexes, int(obj.AID[len(identifiers.KeycardAID)]))
+			}
+		}
+	}
+
+	return indexes
+}
+
+// PlanInstall reads the card registry and returns the plan of Install without changing the card.
+func (i *Installer) PlanInstall(capFile *os.File, overwriteApplet bool, installKeycard bool, installCash bool, installNDEF bool, ndefSpec *NDEFSpec) (*InstallPlan, error) {
+	capInfo, err := ParseCapFile(capFile)
+	if err != nil {
+		logger.Error("parsing cap file failed", "error", err)
+		return nil, err
+	}
+
+	if err = validateKeycardCap(capInfo, installKeycard, installCash, installNDEF); err != nil {
+		logger.Error("cap file validation failed", "error", err)
+		return nil, err
+	}
+
+	load, err := globalplatform.NewLoadCommandStream(capFile)
+	if err != nil {
+		return nil, err
+	}
+
+	keycardInstanceAID, err := identifiers.KeycardInstanceAID(i.instanceIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	registry, err := i.Registry()
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &InstallPlan{Registry: registry}
+	if registry.FindApplication(keycardInstanceAID) != nil && !overwriteApplet {
+		plan.Abort = ErrAppletAlreadyInstalled
+	}
+
+	loadFile := registry.FindLoadFile(identifiers.PackageAID)
+	if installKeycard && i.instanceIndex != identifiers.KeycardDefaultInstanceIndex && loadFile != nil {
+		// only the Keycard instance is installed in the loaded package
+		if len(loadFile.Version) == 2 && (CapVersion{Major: loadFile.Version[0], Minor: loadFile.Version[1]}) != capInfo.PackageVersion {
+			plan.Abort = fmt.Errorf("%w: loaded package version %d.%d, cap %s", ErrPackageVersionMismatch, loadFile.Version[0], loadFile.Version[1], capInfo.PackageVersion)
+		}
+
+		if registry.FindApplication(keycardInstanceAID) != nil {
+			plan.Deletions = append(plan.Deletions, planInstanceDeletion("keycard", keycardInstanceAID))
+		}
+
+		plan.Installs = append(plan.Installs, PlannedInstall{
+			Name:        "keycard",
+			PackageAID:  identifiers.PackageAID,
+			AppletAID:   identifiers.KeycardAID,
+			InstanceAID: keycardInstanceAID,
+			Params:      []byte{},
+		})
+
+		for _, si := range sharedInstances(registry, installCash, installNDEF) {
+			plan.Skipped = append(plan.Skipped, si.String())
+		}
+
+		return plan, nil
+	}
+
+	plan.Deletions = planPackageDeletion(registry)
+	if err = checkKeycardInstancesWiped(registry, overwriteApplet); err != nil && plan.Abort == nil {
+		plan.Abort = err
+	}
+
+	plan.Load = &PlannedLoad{
+		File:         capFile.Name(),
+		PackageAID:   capInfo.PackageAID,
+		Version:      capInfo.PackageVersion,
+		LoadFileSize: capInfo.LoadFileSize,
+		Blocks:       load.BlocksCount(),
+	}
+
+	if installKeycard {
+		plan.Installs = append(plan.Installs, PlannedInstall{
+			Name:        "keycard",
+			PackageAID:  identifiers.PackageAID,
+			AppletAID:   identifiers.KeycardAID,
+			InstanceAID: keycardInstanceAID,
+			Params:      []byte{},
+		})
+	}
+
+	if installCash {
+		plan.Installs = append(plan.Installs, PlannedInstall{
+			Name:        "cash",
+			PackageAID:  identifiers.PackageAID,
+			AppletAID:   identifiers.CashAID,
+			InstanceAID: identifiers.CashInstanceAID,
+			Params:      []byte{},
+		})
+	}
+
+	if installNDEF {
+		ndef := PlannedInstall{
+			Name:        "NDEF",
+			PackageAID:  identifiers.PackageAID,
+			AppletAID:   identifiers.NdefAID,
+			InstanceAID: identifiers.NdefInstanceAID,
+			Params:      []byte{},
+		}
+
+		if ndefSpec != nil {
+			// the cash applet key is generated at install time, so the record can't be computed in advance
+			ndef.ParamsNote = fmt.Sprintf("installed without params to read the NDEF file size, then deleted and installed with the NDEF record built from %s with the new cash applet data", ndefSpec)
+		}
+
+		plan.Installs = append(plan.Installs, ndef)
+	}
+
+	return plan, nil
+}
+
+// PlanDelete reads the card registry and returns what Delete would remove from the card.
+func (i *Installer) PlanDelete() (*InstallPlan, error) {
+	registry, err := i.Registry()
+	if err != nil {
+		return nil, err
+	}
+
+	return &InstallPlan{
+		Registry:  registry,
+		Deletions: planPackageDeletion(registry),
+	}, nil
+}
+
+// PlanDeleteInstance reads the card registry and returns what DeleteInstance would remove from the card.
+func (i *Installer) PlanDeleteInstance(name string, aid []byte) (*InstallPlan, error) {
+	registry, err := i.Registry()
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &InstallPlan{Registry: registry}
+	if registry.FindApplication(aid) != nil {
+		plan.Deletions = append(plan.Deletions, planInstanceDeletion(name, aid))
+	}
+
+	return plan, nil
+}
+
+func planPackageDeletion(registry *GPRegistry) []PlannedDeletion {
+	if registry.FindLoadFile(identifiers.PackageAID) == nil {
+		return nil
+	}
+
+	d := PlannedDeletion{
+		AID: identifiers.PackageAID,
+		P2:  globalplatform.P2DeleteObjectAndRelatedObject,
+	}
+
+	for _, app := range registry.ApplicationsOf(identifiers.PackageAID) {
+		d.Removes = append(d.Removes, PlannedObject{Kind: "instance", AID: app.AID})
+	}
+	d.Removes = append(d.Removes, PlannedObject{Kind: "package", AID: identifiers.PackageAID})
+
+	return []PlannedDeletion{d}
+}
+
+func planInstanceDeletion(name string, aid []byte) PlannedDeletion {
+	return PlannedDeletion{
+		AID:     aid,
+		P2:      globalplatform.P2DeleteObject,
+		Removes: []PlannedObject{{Kind: name + " instance", AID: aid}},
+	}
+}
+
+// Registry opens the ISD secure channel and reads the GP registry.
+func (i *Installer) Registry() (*GPRegistry, error) {
+	cmdSet := NewGPCommandSet(i.c, i.gpKeys)
+
+	logger.Info("select ISD")
+	err := cmdSet.Select()
+	if err != nil {
+		logger.Error("select failed", "error", err)
+		return nil, err
+	}
+
+	logger.Info("opening secure channel")
+	if err = cmdSet.OpenSecureChannel(); err != nil {
+		logger.Error("open secure channel failed", "error", err)
+		return nil, err
+	}
+
+	logger.Info("reading GP registry")
+	registry, err := readGPRegistry(cmdSet.SecureChannel())
+	if err != nil {
+		logger.Error("reading GP registry failed", "error", err)
+		return nil, err
+	}
+
+	return registry, nil
+}
+
+func serializeCommand(cmd *apdu.Command) string {
+	data, err := cmd.Serialize()
+	if err != nil {
+		return err.Error()
+	}
+
+	return fmt.Sprintf("%X", data)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"os"
@@ -17,49 +18,158 @@ import (
 
 var (
 	ErrAppletAlreadyInstalled = errors.New("keycard applet already installed")
+	ErrInvalidCapFile         = errors.New("invalid cap file")
+	ErrVerificationFailed     = errors.New("post-install verification failed")
+	ErrPackageVersionMismatch = errors.New("the loaded keycard package doesn't match the cap file")
+	ErrKeycardInstancesWiped  = errors.New("reinstalling the package deletes Keycard instances, pass -f to overwrite them")
+
+	errUnknownInstance      = errors.New("unknown instance")
+	errInstanceNotInstalled = errors.New("instance not installed")
 )
 
+// InstallCheck is the result of a single post-install verification check.
+type InstallCheck struct {
+	Name    string
+	Passed  bool
+	Details string
+}
+
+// InstallReport holds the results of the post-install verification.
+type InstallReport struct {
+	Checks []InstallCheck
+}
+
+func (r *InstallReport) add(name string, passed bool, details string) {
+	r.Checks = append(r.Checks, InstallCheck{Name: name, Passed: passed, Details: details})
+	if passed {
+		logger.Info("verification check passed", "check", name, "details", details)
+	} else {
+		logger.Error("verification check failed", "check", name, "details", details)
+	}
+}
+
+// Passed returns true if all the checks passed.
+func (r *InstallReport) Passed() bool {
+	for _, c := range r.Checks {
+		if !c.Passed {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (r *InstallReport) String() string {
+	var buf bytes.Buffer
+	for _, c := range r.Checks {
+		result := "PASS"
+		if !c.Passed {
+			result = "FAIL"
+		}
+		fmt.Fprintf(&buf, "[%s] %s: %s\n", result, c.Name, c.Details)
+	}
+
+	return buf.String()
+}
+
 // Installer defines a struct with methods to install applets in a card.
 type Installer struct {
-	c types.Channel
+	c             types.Channel
+	gpKeys        *GPKeyConfig
+	instanceIndex int
 }
 
 // NewInstaller returns a new Installer that communicates to Transmitter t.
-func NewInstaller(t keycardio.Transmitter) *Installer {
+// The ISD secure channel is opened with gpKeys, or with the default keys if gpKeys is nil.
+// instanceIndex is the index of the Keycard instance to install.
+func NewInstaller(t keycardio.Transmitter, gpKeys *GPKeyConfig, instanceIndex int) *Installer {
 	return &Installer{
-		c: keycardio.NewNormalChannel(t),
+		c:             keycardio.NewNormalChannel(t),
+		gpKeys:        gpKeys,
+		instanceIndex: instanceIndex,
 	}
 }
 
-// Install installs the applet from the specified capFile.
-func (i *Installer) Install(capFile *os.File, overwriteApplet bool, installKeycard bool, installCash bool, installNDEF bool, ndefRecordTemplate string) error {
+// Install installs the applet from the specified capFile and verifies the installed instances.
+// If the Keycard package is already loaded and the instance index is not the default one,
+// only the Keycard instance is installed, keeping the other instances.
+// Otherwise the package is deleted with its instances, which requires overwriteApplet if a Keycard instance exists.
+// The returned report is nil if the installation failed before the verification phase.
+func (i *Installer) Install(capFile *os.File, overwriteApplet bool, installKeycard bool, installCash bool, installNDEF bool, ndefSpec *NDEFSpec) (*InstallReport, error) {
 	logger.Info("installation started")
 	startTime := time.Now()
-	cmdSet := globalplatform.NewCommandSet(i.c)
+	cmdSet := NewGPCommandSet(i.c, i.gpKeys)
+
+	keycardInstanceAID, err := identifiers.KeycardInstanceAID(i.instanceIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("validating cap file")
+	capInfo, err := ParseCapFile(capFile)
+	if err != nil {
+		logger.Error("parsing cap file failed", "error", err)
+		return nil, err
+	}
+
+	if err = validateKeycardCap(capInfo, installKeycard, installCash, installNDEF); err != nil {
+		logger.Error("cap file validation failed", "error", err)
+		return nil, err
+	}
+
+	if installNDEF && ndefSpec != nil {
+		// the hmac covers the instance UID, only known after init
+		if len(ndefSpec.HMACSecret) > 0 {
+			return nil, errNDEFHMACBeforeInit
+		}
+
+		// checked again with the size of the installed applet capability container
+		logger.Info("checking NDEF record size")
+		if _, err = ndefSpec.Build(placeholderNDEFTemplateVars(), keycardNDEFFileSize); err != nil {
+			logger.Error("NDEF record check failed", "error", err)
+			return nil, err
+		}
+	}
 
 	logger.Info("check if keycard is already installed")
 	if err := i.checkAppletAlreadyInstalled(cmdSet, overwriteApplet); err != nil {
 		logger.Error("check if keycard is already installed failed", "error", err)
-		return err
+		return nil, err
 	}
 
 	logger.Info("select ISD")
-	err := cmdSet.Select()
+	err = cmdSet.Select()
 	if err != nil {
 		logger.Error("select failed", "error", err)
-		return err
+		return nil, err
 	}
 
 	logger.Info("opening secure channel")
 	if err = cmdSet.OpenSecureChannel(); err != nil {
 		logger.Error("open secure channel failed", "error", err)
-		return err
+		return nil, err
+	}
+
+	logger.Info("reading GP registry")
+	registry, err := readGPRegistry(cmdSet.SecureChannel())
+	if err != nil {
+		logger.Error("reading GP registry failed", "error", err)
+		return nil, err
+	}
+
+	if installKeycard && i.instanceIndex != identifiers.KeycardDefaultInstanceIndex && registry.FindLoadFile(identifiers.PackageAID) != nil {
+		return i.addKeycardInstance(cmdSet, registry, capInfo, installCash, installNDEF)
+	}
+
+	if err = checkKeycardInstancesWiped(registry, overwriteApplet); err != nil {
+		logger.Error("check if keycard instances are deleted failed", "error", err)
+		return nil, err
 	}
 
 	logger.Info("delete old version (if present)")
 	if err = cmdSet.DeleteKeycardInstancesAndPackage(); err != nil {
 		logger.Error("delete keycard instances and package failed", "error", err)
-		return err
+		return nil, err
 	}
 
 	logger.Info("loading package")
@@ -68,14 +178,14 @@ func (i *Installer) Install(capFile *os.File, overwriteApplet bool, installKeyca
 	}
 	if err = cmdSet.LoadKeycardPackage(capFile, callback); err != nil {
 		logger.Error("load failed", "error", err)
-		return err
+		return nil, err
 	}
 
 	if installKeycard {
-		logger.Info("installing Keycard applet")
-		if err = cmdSet.InstallKeycardApplet(); err != nil {
+		logger.Info("installing Keycard applet", "instance", fmt.Sprintf("%x", keycardInstanceAID))
+		if err = cmdSet.InstallForInstall(identifiers.PackageAID, identifiers.KeycardAID, keycardInstanceAID, []byte{}); err != nil {
 			logger.Error("installing Keycard applet failed", "error", err)
-			return err
+			return nil, err
 		}
 	}
 
@@ -83,52 +193,228 @@ func (i *Installer) Install(capFile *os.File, overwriteApplet bool, installKeyca
 		logger.Info("installing Cash applet")
 		if err = cmdSet.InstallCashApplet(); err != nil {
 			logger.Error("installing Cash applet failed", "error", err)
-			return err
+			return nil, err
 		}
 	}
 
+	var ndefRecord []byte
 	if installNDEF {
-		var (
-			ndefURL    string
-			ndefRecord []byte
-		)
+		if ndefSpec != nil {
+			// the record is set at install time, so the NDEF applet is installed a first time to read the NDEF file size
+			logger.Info("installing NDEF applet to read its capability container")
+			if err = cmdSet.InstallNDEFApplet([]byte{}); err != nil {
+				logger.Error("installing NDEF applet failed", "error", err)
+				return nil, err
+			}
 
-		if ndefRecordTemplate != "" {
-			ndefURL, ndefRecord, err = i.buildNDEFRecordWithCashAppletData(ndefRecordTemplate)
+			ndefRecord, err = buildNDEFRecordWithAppletData(i.c, i.instanceIndex, ndefSpec, ndefFileSize(i.c))
 			if err != nil {
-				return err
+				return nil, err
 			}
+
+			logger.Info("setting NDEF record", "records", ndefSpec.String())
 		}
 
-		logger.Info("setting NDEF url", "url", ndefURL)
 		logger.Info("re-select ISD")
 		err = cmdSet.Select()
 		if err != nil {
 			logger.Error("re-select failed", "error", err)
-			return err
+			return nil, err
 		}
 
 		logger.Info("re-opening secure channel")
 		if err = cmdSet.OpenSecureChannel(); err != nil {
 			logger.Error("open secure channel failed", "error", err)
-			return err
+			return nil, err
+		}
+
+		if ndefSpec != nil {
+			logger.Info("deleting NDEF applet to install it with the record")
+			if err = cmdSet.DeleteObject(identifiers.NdefInstanceAID); err != nil {
+				logger.Error("deleting NDEF applet failed", "error", err)
+				return nil, err
+			}
 		}
 
 		logger.Info("installing NDEF applet")
 		if err = cmdSet.InstallNDEFApplet(ndefRecord); err != nil {
 			logger.Error("installing NDEF applet failed", "error", err)
-			return err
+			return nil, err
 		}
 	}
 
 	elapsed := time.Now().Sub(startTime)
 	logger.Info(fmt.Sprintf("installation completed in %f seconds", elapsed.Seconds()))
-	return err
+
+	logger.Info("verifying installation")
+	report := i.Verify(capInfo, installKeycard, installCash, installNDEF, ndefRecord)
+	if !report.Passed() {
+		return report, ErrVerificationFailed
+	}
+
+	return report, nil
+}
+
+// Verify re-selects the installed instances and checks that they match the cap file and the NDEF record.
+func (i *Installer) Verify(capInfo *CapFile, installKeycard bool, installCash bool, installNDEF bool, ndefRecord []byte) *InstallReport {
+	report := &InstallReport{}
+
+	if installKeycard {
+		kc, err := newInstanceChannel(i.c, i.instanceIndex)
+		if err != nil {
+			report.add("keycard applet selected", false, err.Error())
+			return report
+		}
+
+		cmdSet := keycard.NewCommandSet(kc)
+		err = cmdSet.Select()
+		switch {
+		case err != nil:
+			report.add("keycard applet selected", false, err.Error())
+		case !cmdSet.ApplicationInfo.Installed:
+			report.add("keycard applet selected", false, "applet reports it's not installed")
+		case !cmdSet.ApplicationInfo.Initialized:
+			// a pre-initialized applet only returns its secure channel public key, the version is read from the registry
+			report.add("keycard applet selected", true, fmt.Sprintf("secure channel public key 0x%x", cmdSet.ApplicationInfo.SecureChannelPublicKey))
+			i.addLoadFileVersionCheck(report, "keycard applet version", capInfo.PackageVersion)
+		default:
+			report.add("keycard applet selected", true, fmt.Sprintf("instance UID 0x%x", cmdSet.ApplicationInfo.InstanceUID))
+			report.addVersionCheck("keycard applet version", cmdSet.ApplicationInfo.Version, capInfo.PackageVersion)
+		}
+	}
+
+	if installCash {
+		cashCmdSet := keycard.NewCashCommandSet(i.c)
+		err := cashCmdSet.Select()
+		if err != nil {
+			report.add("cash applet selected", false, err.Error())
+		} else {
+			info := cashCmdSet.CashApplicationInfo
+			report.add("cash applet selected", info.Installed, fmt.Sprintf("installed: %v", info.Installed))
+			report.addVersionCheck("cash applet version", info.Version, capInfo.PackageVersion)
+
+			if ecdsaPubKey, err := crypto.UnmarshalPubkey(info.PublicKey); err != nil {
+				report.add("cash applet public key", false, err.Error())
+			} else {
+				report.add("cash applet public key", true, crypto.PubkeyToAddress(*ecdsaPubKey).String())
+			}
+		}
+	}
+
+	if installNDEF {
+		data, err := readNDEFFile(i.c)
+		switch {
+		case err != nil:
+			report.add("NDEF record", false, err.Error())
+		case len(ndefRecord) > 0 && !bytes.Equal(data, ndefRecord):
+			report.add("NDEF record", false, fmt.Sprintf("read 0x%x, expected 0x%x", data, ndefRecord))
+		default:
+			report.add("NDEF record", true, fmt.Sprintf("0x%x", data))
+		}
+	}
+
+	return report
+}
+
+func (r *InstallReport) addVersionCheck(name string, version []byte, expected CapVersion) {
+	if len(version) != 2 {
+		r.add(name, false, fmt.Sprintf("invalid version 0x%x", version))
+		return
+	}
+
+	got := CapVersion{Major: version[0], Minor: version[1]}
+	r.add(name, got == expected, fmt.Sprintf("got %s, cap %s", got, expected))
+}
+
+// addLoadFileVersionCheck compares the version of the loaded Keycard package in the GP registry to expected.
+func (i *Installer) addLoadFileVersionCheck(report *InstallReport, name string, expected CapVersion) {
+	registry, err := i.Registry()
+	if err != nil {
+		report.add(name, false, fmt.Sprintf("reading the GP registry: %v", err))
+		return
+	}
+
+	loadFile := registry.FindLoadFile(identifiers.PackageAID)
+	if loadFile == nil {
+		report.add(name, false, "package not found in the GP registry")
+		return
+	}
+
+	report.addVersionCheck(name, loadFile.Version, expected)
+}
+
+// addKeycardInstance installs the Keycard instance from the package already loaded, keeping the other instances.
+// The requested cash and NDEF instances are shared by all the Keycard instances, so they are only reported:
+// the check fails if they are missing from the card.
+func (i *Installer) addKeycardInstance(cmdSet *GPCommandSet, registry *GPRegistry, capInfo *CapFile, installCash bool, installNDEF bool) (*InstallReport, error) {
+	loadFile := registry.FindLoadFile(identifiers.PackageAID)
+	if len(loadFile.Version) == 2 && (CapVersion{Major: loadFile.Version[0], Minor: loadFile.Version[1]}) != capInfo.PackageVersion {
+		err := fmt.Errorf("%w: loaded package version %d.%d, cap %s", ErrPackageVersionMismatch, loadFile.Version[0], loadFile.Version[1], capInfo.PackageVersion)
+		logger.Error("adding keycard instance failed", "error", err)
+		return nil, err
+	}
+
+	instanceAID, err := identifiers.KeycardInstanceAID(i.instanceIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	if registry.FindApplication(instanceAID) != nil {
+		logger.Info("delete keycard instance", "instance", fmt.Sprintf("%x", instanceAID))
+		if err = cmdSet.DeleteObject(instanceAID); err != nil {
+			logger.Error("delete keycard instance failed", "error", err)
+			return nil, err
+		}
+	}
+
+	logger.Info("installing Keycard applet in the loaded package", "instance", fmt.Sprintf("%x", instanceAID))
+	if err = cmdSet.InstallForInstall(identifiers.PackageAID, identifiers.KeycardAID, instanceAID, []byte{}); err != nil {
+		logger.Error("installing Keycard applet failed", "error", err)
+		return nil, err
+	}
+
+	logger.Info("verifying installation")
+	report := i.Verify(capInfo, true, false, false, nil)
+	for _, si := range sharedInstances(registry, installCash, installNDEF) {
+		report.add(si.name+" applet", si.installed, si.String())
+	}
+
+	if !report.Passed() {
+		return report, ErrVerificationFailed
+	}
+
+	return report, nil
+}
+
+// DeleteInstance deletes the applet instance with the specified AID, keeping the package and the other instances.
+func (i *Installer) DeleteInstance(aid []byte) error {
+	cmdSet := NewGPCommandSet(i.c, i.gpKeys)
+
+	logger.Info("select ISD")
+	err := cmdSet.Select()
+	if err != nil {
+		logger.Error("select failed", "error", err)
+		return err
+	}
+
+	logger.Info("opening secure channel")
+	if err = cmdSet.OpenSecureChannel(); err != nil {
+		logger.Error("open secure channel failed", "error", err)
+		return err
+	}
+
+	logger.Info("delete instance", "aid", fmt.Sprintf("%x", aid))
+	if err = cmdSet.DeleteObject(aid); err != nil {
+		logger.Error("delete instance failed", "error", err)
+		return err
+	}
+
+	return nil
 }
 
 // Delete deletes the applet from the card.
 func (i *Installer) Delete() error {
-	cmdSet := globalplatform.NewCommandSet(i.c)
+	cmdSet := NewGPCommandSet(i.c, i.gpKeys)
 
 	logger.Info("select ISD")
 	err := cmdSet.Select()
@@ -152,34 +438,113 @@ func (i *Installer) Delete() error {
 	return nil
 }
 
-func (i *Installer) buildNDEFRecordWithCashAppletData(ndefRecordTemplate string) (string, []byte, error) {
-	cashCmdSet := keycard.NewCashCommandSet(i.c)
-	logger.Info("selecting cash applet")
-	err := cashCmdSet.Select()
+// KeyInfo selects the Keycard instances with the specified indexes and returns the info of the installed ones.
+// credentials is used to open a session on the instances with a key, to read their first address. It can be nil.
+func (i *Installer) KeyInfo(indexes []int, credentials func() *SessionCredentials) ([]*CardKeyInfo, error) {
+	var keys []*CardKeyInfo
+	for _, index := range indexes {
+		info, err := readCardKeyInfo(i.c, index, credentials)
+		if err != nil {
+			logger.Error("select keycard instance failed", "index", index, "error", err)
+			return nil, err
+		}
+
+		if info != nil {
+			keys = append(keys, info)
+		}
+	}
+
+	return keys, nil
+}
+
+// KeyRotation is the result of RotateKeys.
+type KeyRotation struct {
+	CardSerial  []byte
+	InstanceUID []byte
+	SCP         byte
+	OldVersion  byte
+	NewVersion  byte
+	// Verified is true once the secure channel opened with the new keys.
+	Verified bool
+}
+
+// RotateKeys uploads the ISD keys of newKeys with PUT KEY and checks that the secure channel opens with them.
+// If replace is true, the current key set is replaced, otherwise the new key set is added.
+// If PUT KEY succeeded but the secure channel doesn't open with the new keys, it returns both
+// the unverified rotation and the error, since the card keys have changed anyway.
+func (i *Installer) RotateKeys(newKeys *GPKeyConfig, replace bool) (*KeyRotation, error) {
+	if !newKeys.HasKeys() {
+		return nil, errMissingNewKeys
+	}
+
+	newSets, err := newKeys.keySets()
 	if err != nil {
-		logger.Error("error selecting cash applet", "error", err)
-		return "", nil, err
+		return nil, err
+	}
+
+	cmdSet := NewGPCommandSet(i.c, i.gpKeys)
+
+	logger.Info("select ISD")
+	if err = cmdSet.Select(); err != nil {
+		logger.Error("select failed", "error", err)
+		return nil, err
+	}
+
+	rotation := &KeyRotation{NewVersion: byte(newKeys.KeyVersion)}
+	if rotation.CardSerial, err = cmdSet.CardSerial(); err != nil {
+		logger.Warn("reading card serial failed", "error", err)
+	}
+
+	logger.Info("opening secure channel")
+	if err = cmdSet.OpenSecureChannel(); err != nil {
+		logger.Error("open secure channel failed", "error", err)
+		return nil, err
 	}
 
-	info := cashCmdSet.CashApplicationInfo
-	logger.Info("parsing cash applet public key", "public key", fmt.Sprintf("0x%x", info.PublicKey))
-	ecdsaPubKey, err := crypto.UnmarshalPubkey(info.PublicKey)
+	sc := cmdSet.SecureChannel()
+	rotation.SCP = sc.SCP
+	rotation.OldVersion = sc.KeyVersion
+
+	keys, err := newSets[0].diversify(newKeys.Diversification, sc.divData, sc.SCP)
 	if err != nil {
-		logger.Error("error parsing cash applet public key", "error", err)
-		return "", nil, err
+		return nil, err
 	}
 
-	address := crypto.PubkeyToAddress(*ecdsaPubKey)
-	logger.Info("deriving cash applet address", "address", address.String())
-	vars := map[string]string{
-		"cashAddress": address.String(),
+	var replaceVersion byte
+	if replace {
+		replaceVersion = sc.KeyVersion
 	}
 
-	return buildNdefDataWithURL(ndefRecordTemplate, vars)
+	logger.Info("put key", "version", rotation.NewVersion, "replace", replaceVersion)
+	if err = cmdSet.PutKeys(keys, rotation.NewVersion, replaceVersion); err != nil {
+		logger.Error("put key failed", "error", err)
+		return nil, err
+	}
+
+	logger.Info("opening secure channel with the new keys")
+	newCmdSet := NewGPCommandSet(i.c, newKeys)
+	if err = newCmdSet.Select(); err != nil {
+		logger.Error("select failed", "error", err)
+		return rotation, err
+	}
+
+	if err = newCmdSet.OpenSecureChannel(); err != nil {
+		logger.Error("open secure channel with the new keys failed", "error", err)
+		return rotation, err
+	}
+
+	rotation.Verified = true
+
+	kCmdSet := keycard.NewCommandSet(i.c)
+	if err = kCmdSet.Select(); err == nil {
+		rotation.InstanceUID = kCmdSet.ApplicationInfo.InstanceUID
+	}
+
+	return rotation, nil
 }
 
-func (i *Installer) checkAppletAlreadyInstalled(cmdSet *globalplatform.CommandSet, overwriteApplet bool) error {
-	keycardInstanceAID, err := identifiers.KeycardInstanceAID(identifiers.KeycardDefaultInstanceIndex)
+func (i *Installer) checkAppletAlreadyInstalled(cmdSet *GPCommandSet, overwriteApplet bool) error {
+	keycardInstanceAID, err := identifiers.KeycardInstanceAID(i.instanceIndex)
 	if err != nil {
 		return err
 	}
@@ -201,3 +566,44 @@ func (i *Installer) checkAppletAlreadyInstalled(cmdSet *globalplatform.CommandSe
 		return err
 	}
 }
+
+// checkKeycardInstancesWiped fails if deleting the package removes Keycard instances and overwriteApplet is false.
+// The instance being installed is checked by checkAppletAlreadyInstalled, but the other ones are deleted too.
+func checkKeycardInstancesWiped(registry *GPRegistry, overwriteApplet bool) error {
+	if overwriteApplet {
+		return nil
+	}
+
+	plan := &InstallPlan{Deletions: planPackageDeletion(registry)}
+	if indexes := plan.KeycardInstances(); len(indexes) > 0 {
+		return fmt.Errorf("%w: instances %v", ErrKeycardInstancesWiped, indexes)
+	}
+
+	return nil
+}
+
+// validateKeycardCap checks that the cap file contains the package and the applets
+// that InstallKeycardApplet, InstallCashApplet and InstallNDEFApplet expect.
+func validateKeycardCap(capInfo *CapFile, installKeycard bool, installCash bool, installNDEF bool) error {
+	if !bytes.Equal(capInfo.PackageAID, identifiers.PackageAID) {
+		return fmt.Errorf("%w: package AID is %x, expected %x", ErrInvalidCapFile, capInfo.PackageAID, identifiers.PackageAID)
+	}
+
+	expectedApplets := []struct {
+		name    string
+		install bool
+		aid     []byte
+	}{
+		{"keycard", installKeycard, identifiers.KeycardAID},
+		{"cash", installCash, identifiers.CashAID},
+		{"NDEF", installNDEF, identifiers.NdefAID},
+	}
+
+	for _, applet := range expectedApplets {
+		if applet.install && !capInfo.HasApplet(applet.aid) {
+			return fmt.Errorf("%w: %s applet %x not found", ErrInvalidCapFile, applet.name, applet.aid)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+
+	"github.com/status-im/keycard-go/apdu"
+	"github.com/status-im/keycard-go/globalplatform"
+	"github.com/status-im/keycard-go/identifiers"
+	"github.com/status-im/keycard-go/types"
+)
+
+// instanceChannel redirects the SELECT commands of the default Keycard instance to another instance,
+// so that keycard.CommandSet can be used with any instance.
+type instanceChannel struct {
+	c           types.Channel
+	defaultAID  []byte
+	instanceAID []byte
+}
+
+// newInstanceChannel returns a channel selecting the Keycard instance with the specified index.
+func newInstanceChannel(c types.Channel, index int) (types.Channel, error) {
+	if index == identifiers.KeycardDefaultInstanceIndex {
+		return c, nil
+	}
+
+	defaultAID, err := identifiers.KeycardInstanceAID(identifiers.KeycardDefaultInstanceIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	instanceAID, err := identifiers.KeycardInstanceAID(index)
+	if err != nil {
+		return nil, err
+	}
+
+	return &instanceChannel{
+		c:           c,
+		defaultAID:  defaultAID,
+		instanceAID: instanceAID,
+	}, nil
+}
+
+// Send sends cmd to the inner channel, replacing the default instance AID in SELECT commands.
+func (ic *instanceChannel) Send(cmd *apdu.Command) (*apdu.Response, error) {
+	if cmd.Ins == globalplatform.InsSelect && bytes.Equal(cmd.Data, ic.defaultAID) {
+		selectCmd := apdu.NewCommand(cmd.Cla, cmd.Ins, cmd.P1, cmd.P2, ic.instanceAID)
+		if ok, le := cmd.Le(); ok {
+			selectCmd.SetLe(le)
+		}
+		cmd = selectCmd
+	}
+
+	return ic.c.Send(cmd)
+}
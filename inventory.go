@@ -0,0 +1,490 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/hsanjuan/go-ndef"
+	keycard "github.com/status-im/keycard-go"
+	keycardio "github.com/status-im/keycard-go/io"
+	"github.com/status-im/keycard-go/types"
+)
+
+const (
+	inventoryFileName = "inventory.jsonl"
+
+	InventoryOperationInstall     = "install"
+	InventoryOperationInit        = "init"
+	InventoryOperationPair        = "pair"
+	InventoryOperationGenerateKey = "generate-key"
+	InventoryOperationDelete      = "delete"
+	InventoryOperationProvision   = "provision"
+
+	// serialCardIDPrefix prefixes the ID of the cards known only by their serial, before being initialized.
+	serialCardIDPrefix = "serial:"
+)
+
+var (
+	errInventoryCardNotFound  = errors.New("card not found in the inventory")
+	errAmbiguousInventoryCard = errors.New("ambiguous card ID")
+	errInvalidInventoryFilter = errors.New("invalid inventory filter, expected FIELD=VALUE")
+	errUnidentifiedCard       = errors.New("neither the instance UID nor the card serial could be read")
+)
+
+// InventoryRecord is an operation performed on a card, appended to the inventory.
+type InventoryRecord struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	// InstanceUID identifies the Keycard applet instance. It's empty before the applet is initialized.
+	InstanceUID string `json:"instanceUID,omitempty"`
+	// CardSerial is the IC fabricator and serial number read from the card CPLC data.
+	CardSerial     string `json:"cardSerial,omitempty"`
+	KeyUID         string `json:"keyUID,omitempty"`
+	KeycardVersion string `json:"keycardVersion,omitempty"`
+	CashVersion    string `json:"cashVersion,omitempty"`
+	CashAddress    string `json:"cashAddress,omitempty"`
+	NDEFURL        string `json:"ndefURL,omitempty"`
+	// CapFile is the name of the installed cap file.
+	CapFile       string `json:"capFile,omitempty"`
+	ISDKeyVersion *int   `json:"isdKeyVersion,omitempty"`
+	SCP           *int   `json:"scp,omitempty"`
+	// Unverified is set when the ISD keys were changed but the secure channel didn't open with the new ones.
+	Unverified bool   `json:"unverified,omitempty"`
+	Operator   string `json:"operator,omitempty"`
+}
+
+// Inventory is a JSON lines file recording the operations performed on cards.
+type Inventory struct {
+	path string
+	// Operator is recorded in the appended records that don't specify one.
+	Operator string
+
+	mu sync.Mutex
+}
+
+// NewInventory returns an Inventory stored at path.
+func NewInventory(path string) *Inventory {
+	return &Inventory{path: path}
+}
+
+// defaultInventoryOperator returns the name of the current user.
+func defaultInventoryOperator() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+
+	return os.Getenv("USER")
+}
+
+// defaultInventoryPath returns the inventory path in the user config directory.
+func defaultInventoryPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return inventoryFileName
+	}
+
+	return filepath.Join(dir, "keycard", inventoryFileName)
+}
+
+// Append appends rec to the inventory file.
+// A record without InstanceUID and CardSerial can't be matched to a card, so it's refused.
+func (inv *Inventory) Append(rec *InventoryRecord) error {
+	if rec.InstanceUID == "" && rec.CardSerial == "" {
+		return errUnidentifiedCard
+	}
+
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	if rec.Time.IsZero() {
+		rec.Time = time.Now().UTC()
+	}
+
+	if rec.Operator == "" {
+		rec.Operator = inv.Operator
+	}
+
+	if err := os.MkdirAll(filepath.Dir(inv.path), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(inv.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// Records returns all the records of the inventory, oldest first. A missing inventory file has no records.
+func (inv *Inventory) Records() ([]*InventoryRecord, error) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	f, err := os.Open(inv.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []*InventoryRecord
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+
+		rec := &InventoryRecord{}
+		if err = json.Unmarshal(scanner.Bytes(), rec); err != nil {
+			return nil, fmt.Errorf("error parsing inventory %s line %d: %v", inv.path, line, err)
+		}
+		records = append(records, rec)
+	}
+
+	return records, scanner.Err()
+}
+
+// InventoryCard is the current state of a card, aggregated from its inventory records.
+type InventoryCard struct {
+	// ID is the instance UID, or the card serial prefixed by "serial:" for the cards never initialized.
+	ID             string    `json:"id"`
+	InstanceUID    string    `json:"instanceUID,omitempty"`
+	CardSerial     string    `json:"cardSerial,omitempty"`
+	KeyUID         string    `json:"keyUID,omitempty"`
+	KeycardVersion string    `json:"keycardVersion,omitempty"`
+	CashVersion    string    `json:"cashVersion,omitempty"`
+	CashAddress    string    `json:"cashAddress,omitempty"`
+	NDEFURL        string    `json:"ndefURL,omitempty"`
+	CapFile        string    `json:"capFile,omitempty"`
+	Operator       string    `json:"operator,omitempty"`
+	FirstSeen      time.Time `json:"firstSeen"`
+	LastSeen       time.Time `json:"lastSeen"`
+	// InitializedAt is the time of the last init or provision operation.
+	InitializedAt *time.Time `json:"initializedAt,omitempty"`
+	// Deleted is true if the last operation deleted the applets.
+	Deleted bool `json:"deleted"`
+
+	History []*InventoryRecord `json:"history,omitempty"`
+}
+
+func (c *InventoryCard) apply(rec *InventoryRecord) {
+	if c.FirstSeen.IsZero() {
+		c.FirstSeen = rec.Time
+	}
+	c.LastSeen = rec.Time
+
+	for _, f := range []struct {
+		dst *string
+		src string
+	}{
+		{&c.InstanceUID, rec.InstanceUID},
+		{&c.CardSerial, rec.CardSerial},
+		{&c.KeyUID, rec.KeyUID},
+		{&c.KeycardVersion, rec.KeycardVersion},
+		{&c.CashVersion, rec.CashVersion},
+		{&c.CashAddress, rec.CashAddress},
+		{&c.NDEFURL, rec.NDEFURL},
+		{&c.CapFile, rec.CapFile},
+		{&c.Operator, rec.Operator},
+	} {
+		if f.src != "" {
+			*f.dst = f.src
+		}
+	}
+
+	switch rec.Operation {
+	case InventoryOperationInit, InventoryOperationProvision:
+		t := rec.Time
+		c.InitializedAt = &t
+		c.Deleted = false
+	case InventoryOperationInstall:
+		c.Deleted = false
+	case InventoryOperationDelete:
+		c.Deleted = true
+	}
+
+	c.History = append(c.History, rec)
+}
+
+// Cards aggregates the records by instance UID, ordered by last operation.
+// The records without instance UID, like the install before the card is initialized,
+// belong to the card with the same serial, or to the next card initialized with that serial.
+func (inv *Inventory) Cards() ([]*InventoryCard, error) {
+	records, err := inv.Records()
+	if err != nil {
+		return nil, err
+	}
+
+	cards := make(map[string]*InventoryCard)
+	// bySerial is the last card seen with each serial.
+	bySerial := make(map[string]*InventoryCard)
+
+	for _, rec := range records {
+		var card *InventoryCard
+		switch {
+		case rec.InstanceUID != "":
+			card = cards[rec.InstanceUID]
+			if card == nil {
+				// adopt the records of the card known only by its serial.
+				if pending := cards[serialCardIDPrefix+rec.CardSerial]; rec.CardSerial != "" && pending != nil {
+					delete(cards, pending.ID)
+					card = pending
+				} else {
+					card = &InventoryCard{}
+				}
+				card.ID = rec.InstanceUID
+				cards[card.ID] = card
+			}
+		case rec.CardSerial != "":
+			card = bySerial[rec.CardSerial]
+			// a deleted card is reinstalled and initialized with a new instance UID.
+			if card == nil || (card.Deleted && card.InstanceUID != "") {
+				card = &InventoryCard{ID: serialCardIDPrefix + rec.CardSerial}
+				cards[card.ID] = card
+			}
+		default:
+			continue
+		}
+
+		card.apply(rec)
+		if card.CardSerial != "" {
+			bySerial[card.CardSerial] = card
+		}
+	}
+
+	list := make([]*InventoryCard, 0, len(cards))
+	for _, card := range cards {
+		list = append(list, card)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].LastSeen.Before(list[j].LastSeen)
+	})
+
+	return list, nil
+}
+
+// FindCard returns the card with ID, instance UID, key UID or serial id, or the only card with an ID starting with id.
+func (inv *Inventory) FindCard(id string) (*InventoryCard, error) {
+	cards, err := inv.Cards()
+	if err != nil {
+		return nil, err
+	}
+
+	id = strings.TrimPrefix(strings.ToLower(id), "0x")
+
+	var matches []*InventoryCard
+	for _, card := range cards {
+		if card.ID == id || card.InstanceUID == id || card.KeyUID == id || card.CardSerial == id {
+			return card, nil
+		}
+
+		if strings.HasPrefix(card.ID, id) {
+			matches = append(matches, card)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("%w: %s", errInventoryCardNotFound, id)
+	case 1:
+		return matches[0], nil
+	default:
+		return nil, fmt.Errorf("%w: %s matches %d cards", errAmbiguousInventoryCard, id, len(matches))
+	}
+}
+
+// Matches returns true if the card has the values of filters, like "keycardVersion=3.0".
+// The fields are the columns of the CSV export.
+func (c *InventoryCard) Matches(filters []string) (bool, error) {
+	row := c.csvRecord()
+	for _, f := range filters {
+		parts := strings.SplitN(f, "=", 2)
+		if len(parts) != 2 {
+			return false, fmt.Errorf("%w: %q", errInvalidInventoryFilter, f)
+		}
+
+		col := -1
+		for i, name := range inventoryCSVHeader {
+			if strings.EqualFold(name, parts[0]) {
+				col = i
+			}
+		}
+
+		if col < 0 {
+			return false, fmt.Errorf("%w: unknown field %q", errInvalidInventoryFilter, parts[0])
+		}
+
+		if !strings.EqualFold(row[col], parts[1]) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func (c *InventoryCard) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Card %s:\n", c.ID)
+	fmt.Fprintf(&buf, "  InstanceUID: %s\n", c.InstanceUID)
+	fmt.Fprintf(&buf, "  Card serial: %s\n", c.CardSerial)
+	fmt.Fprintf(&buf, "  KeyUID: %s\n", c.KeyUID)
+	fmt.Fprintf(&buf, "  Keycard version: %s\n", c.KeycardVersion)
+	fmt.Fprintf(&buf, "  Cash version: %s\n", c.CashVersion)
+	fmt.Fprintf(&buf, "  Cash address: %s\n", c.CashAddress)
+	fmt.Fprintf(&buf, "  NDEF URL: %s\n", c.NDEFURL)
+	fmt.Fprintf(&buf, "  Cap file: %s\n", c.CapFile)
+	fmt.Fprintf(&buf, "  First seen: %s\n", c.FirstSeen.Format(time.RFC3339))
+	fmt.Fprintf(&buf, "  Last seen: %s\n", c.LastSeen.Format(time.RFC3339))
+	if c.InitializedAt != nil {
+		fmt.Fprintf(&buf, "  Initialized: %s\n", c.InitializedAt.Format(time.RFC3339))
+	}
+	fmt.Fprintf(&buf, "  Deleted: %v\n", c.Deleted)
+	fmt.Fprintf(&buf, "History:\n")
+	for _, rec := range c.History {
+		fmt.Fprintf(&buf, "  %s %-12s %s\n", rec.Time.Format(time.RFC3339), rec.Operation, rec.Operator)
+	}
+
+	return buf.String()
+}
+
+var inventoryCSVHeader = []string{"id", "instanceUID", "cardSerial", "keyUID", "keycardVersion", "cashVersion",
+	"cashAddress", "ndefURL", "capFile", "operator", "firstSeen", "lastSeen", "initializedAt", "deleted"}
+
+// WriteInventoryCSV writes the cards as CSV with a header, without their history.
+func WriteInventoryCSV(w io.Writer, cards []*InventoryCard) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(inventoryCSVHeader); err != nil {
+		return err
+	}
+
+	for _, c := range cards {
+		if err := cw.Write(c.csvRecord()); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// csvRecord returns the card fields in the order of inventoryCSVHeader.
+func (c *InventoryCard) csvRecord() []string {
+	var initializedAt string
+	if c.InitializedAt != nil {
+		initializedAt = c.InitializedAt.Format(time.RFC3339)
+	}
+
+	return []string{
+		c.ID,
+		c.InstanceUID,
+		c.CardSerial,
+		c.KeyUID,
+		c.KeycardVersion,
+		c.CashVersion,
+		c.CashAddress,
+		c.NDEFURL,
+		c.CapFile,
+		c.Operator,
+		c.FirstSeen.Format(time.RFC3339),
+		c.LastSeen.Format(time.RFC3339),
+		initializedAt,
+		fmt.Sprint(c.Deleted),
+	}
+}
+
+// readInventoryRecord reads the card serial, the Keycard and cash applets info and the NDEF URL.
+// The data that can't be read is left empty.
+func readInventoryRecord(t keycardio.Transmitter, gpKeys *GPKeyConfig, instanceIndex int, operation string) *InventoryRecord {
+	c := keycardio.NewNormalChannel(t)
+	rec := &InventoryRecord{Operation: operation}
+
+	gpCmdSet := NewGPCommandSet(c, gpKeys)
+	if err := gpCmdSet.Select(); err != nil {
+		logger.Debug("inventory: select ISD failed", "error", err)
+	} else if serial, err := gpCmdSet.CardSerial(); err != nil {
+		logger.Debug("inventory: reading card serial failed", "error", err)
+	} else {
+		rec.CardSerial = hex.EncodeToString(serial)
+	}
+
+	if kc, err := newInstanceChannel(c, instanceIndex); err == nil {
+		cmdSet := keycard.NewCommandSet(kc)
+		if err = cmdSet.Select(); err != nil {
+			logger.Debug("inventory: select keycard applet failed", "error", err)
+		} else {
+			rec.setApplicationInfo(cmdSet.ApplicationInfo)
+		}
+	}
+
+	cashCmdSet := keycard.NewCashCommandSet(c)
+	if err := cashCmdSet.Select(); err != nil {
+		logger.Debug("inventory: select cash applet failed", "error", err)
+	} else {
+		info := cashCmdSet.CashApplicationInfo
+		rec.CashVersion = appletVersion(info.Version)
+		if pubKey, err := crypto.UnmarshalPubkey(info.PublicKey); err == nil {
+			rec.CashAddress = crypto.PubkeyToAddress(*pubKey).String()
+		}
+	}
+
+	if content, err := readNDEFContent(c); err != nil {
+		logger.Debug("inventory: reading NDEF failed", "error", err)
+	} else {
+		for _, r := range content.Records {
+			if r.TNF == ndef.NFCForumWellKnownType && r.Type == "U" {
+				rec.NDEFURL = r.Payload
+				break
+			}
+		}
+	}
+
+	return rec
+}
+
+// setApplicationInfo sets the Keycard applet fields of rec.
+func (rec *InventoryRecord) setApplicationInfo(info *types.ApplicationInfo) {
+	if info == nil || !info.Installed {
+		return
+	}
+
+	rec.KeycardVersion = appletVersion(info.Version)
+	if info.Initialized {
+		rec.InstanceUID = hex.EncodeToString(info.InstanceUID)
+		rec.KeyUID = hex.EncodeToString(info.KeyUID)
+	}
+}
+
+// appletVersion formats the 2 bytes version of an applet, like 3.0.
+func appletVersion(v []byte) string {
+	if len(v) != 2 {
+		return ""
+	}
+
+	return fmt.Sprintf("%d.%d", v[0], v[1])
+}
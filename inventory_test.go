@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestInventoryAppend(t *testing.T) {
+	inv := NewInventory(filepath.Join(t.TempDir(), inventoryFileName))
+	inv.Operator = "tester"
+
+	tests := []struct {
+		name string
+		rec  *InventoryRecord
+		err  error
+	}{
+		{name: "instance UID", rec: &InventoryRecord{Operation: InventoryOperationInit, InstanceUID: "0102"}},
+		{name: "card serial", rec: &InventoryRecord{Operation: "gp-put-key", CardSerial: "0a0b"}},
+		{name: "unidentified card", rec: &InventoryRecord{Operation: "gp-put-key"}, err: errUnidentifiedCard},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := inv.Append(test.rec); !errors.Is(err, test.err) {
+				t.Fatalf("expected %v, got %v", test.err, err)
+			}
+		})
+	}
+
+	records, err := inv.Records()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 2 || records[0].Operator != "tester" || records[1].CardSerial != "0a0b" {
+		t.Fatalf("unexpected records %+v", records)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/google/uuid"
+)
+
+var (
+	errEmptyKeystorePassword = errors.New("keystore password cannot be empty")
+	errExportedKeyMismatch   = errors.New("exported private key does not match the exported public key")
+)
+
+// writeKeystoreFile encrypts privKey with password as a Web3 Secret Storage (keystore v3)
+// JSON document and writes it to path. The file must not exist yet.
+func writeKeystoreFile(path string, privKey []byte, pubKey []byte, password string) (common.Address, error) {
+	if password == "" {
+		return common.Address{}, errEmptyKeystorePassword
+	}
+
+	ecdsaPrivKey, err := crypto.ToECDSA(privKey)
+	if err != nil {
+		return common.Address{}, err
+	}
+
+	if len(pubKey) > 0 && !bytes.Equal(crypto.FromECDSAPub(&ecdsaPrivKey.PublicKey), pubKey) {
+		return common.Address{}, errExportedKeyMismatch
+	}
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return common.Address{}, err
+	}
+
+	key := &keystore.Key{
+		Id:         id,
+		Address:    crypto.PubkeyToAddress(ecdsaPrivKey.PublicKey),
+		PrivateKey: ecdsaPrivKey,
+	}
+
+	data, err := keystore.EncryptKey(key, password, keystore.StandardScryptN, keystore.StandardScryptP)
+	if err != nil {
+		return common.Address{}, err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return common.Address{}, err
+	}
+
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		os.Remove(path)
+		return common.Address{}, err
+	}
+
+	return key.Address, f.Close()
+}
@@ -2,18 +2,31 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/ed25519"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	stdlog "log"
+	"math/big"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
+	"github.com/btcsuite/btcd/btcutil/psbt"
 	"github.com/ebfe/scard"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/status-im/keycard-go/identifiers"
+	keycardio "github.com/status-im/keycard-go/io"
+	"golang.org/x/term"
 )
 
 var version string
@@ -23,16 +36,76 @@ type commandFunc func(*scard.Card) error
 var (
 	logger = log.New("package", "keycard-cli")
 
-	commands map[string]commandFunc
-	command  string
+	commands   map[string]commandFunc
+	command    string
+	subcommand string
 
-	flagCapFile       = flag.String("a", "", "applet cap file path")
-	flagKeycardApplet = flag.Bool("keycard-applet", true, "install keycard applet")
-	flagCashApplet    = flag.Bool("cash-applet", true, "install cash applet")
-	flagNDEFApplet    = flag.Bool("ndef-applet", true, "install NDEF applet")
-	flagOverwrite     = flag.Bool("f", false, "force applet installation if already installed")
-	flagLogLevel      = flag.String("l", "", `Log level, one of: "error", "warn", "info", "debug", and "trace"`)
-	flagNDEFTemplate  = flag.String("ndef", "", "Specify a URL to use in the NDEF record. Use the {{.cashAddress}} variable to get the cash address: http://example.com/{{.cashAddress}}.")
+	// subcommandCommands take a subcommand as first argument, like "ndef set".
+	subcommandCommands = map[string]bool{
+		"ndef":      true,
+		"inventory": true,
+		"audit":     true,
+	}
+
+	// cardlessCommands don't need a card to be inserted.
+	cardlessCommands = map[string]bool{
+		"version":   true,
+		"cap-info":  true,
+		"provision": true,
+		"watch":     true,
+		"inventory": true,
+		"audit":     true,
+	}
+
+	flagCapFile           = flag.String("a", "", "applet cap file path")
+	flagKeycardApplet     = flag.Bool("keycard-applet", true, "install keycard applet")
+	flagCashApplet        = flag.Bool("cash-applet", true, "install cash applet")
+	flagNDEFApplet        = flag.Bool("ndef-applet", true, "install NDEF applet")
+	flagOverwrite         = flag.Bool("f", false, "force applet installation if already installed")
+	flagManifest          = flag.String("manifest", "", "YAML or JSON provisioning manifest used by the provision command")
+	flagExec              = flag.String("exec", "", "command run with sh -c by the watch command for each inserted card")
+	flagParallel          = flag.Bool("parallel", false, "provision with a worker for each reader")
+	flagCapManifest       = flag.String("cap-manifest", "", "trusted manifest listing the SHA-256 of the cap files allowed for installation")
+	flagCapSignature      = flag.String("cap-signature", "", "ed25519 detached signature of the cap manifest")
+	flagCapPublicKey      = flag.String("cap-pubkey", "", "pinned ed25519 public key in hex used to verify the cap manifest signature")
+	flagAllowUntrustedCap = flag.Bool("allow-untrusted-cap", false, "install a cap file failing the manifest verification. Must be combined with -f")
+	flagGPKeyFile         = flag.String("gp-keys", "", "JSON file with the ISD keys used to open the GlobalPlatform secure channel")
+	flagGPKey             = flag.String("gp-key", "", "ISD master key in hex used for ENC, MAC and DEK")
+	flagGPEnc             = flag.String("gp-enc", "", "ISD ENC key in hex")
+	flagGPMac             = flag.String("gp-mac", "", "ISD MAC key in hex")
+	flagGPDek             = flag.String("gp-dek", "", "ISD DEK key in hex")
+	flagGPDiversification = flag.String("gp-diversification", "", `ISD key diversification scheme: "visa2" or "emv"`)
+	flagGPKeyVersion      = flag.Int("gp-key-version", -1, "ISD key set version. 0 selects the first available key set")
+	flagSCP               = flag.Int("scp", -1, "required secure channel protocol version, 2 or 3. 0 accepts the version offered by the card")
+	flagNewGPKeyFile      = flag.String("new-gp-keys", "", "JSON file with the new ISD keys uploaded by gp-put-key. keyVersion is the version of the new key set")
+	flagReplaceGPKeys     = flag.Bool("replace-gp-keys", false, "replace the current ISD key set with gp-put-key instead of adding a new one")
+	flagInventory         = flag.String("inventory", defaultInventoryPath(), "card inventory file path")
+	flagOperator          = flag.String("operator", defaultInventoryOperator(), "operator name recorded in the card inventory and the audit log")
+	flagAuditLog          = flag.String("audit-log", defaultAuditLogPath(), "audit log file path")
+	flagAuditKey          = flag.String("audit-key", "", "file with the operator ed25519 key in hex used to sign the audit log entries")
+	flagTrustedCAs        = flag.String("trusted-cas", "", "JSON file with the CA public keys trusted by verify-genuine, in addition to the bundled ones")
+	flagAuditPublicKey    = flag.String("audit-pubkey", "", "operator ed25519 public key in hex. audit verify requires every entry to be signed with it")
+	flagInstanceIndex     = flag.Int("instance-index", 0, "index of the Keycard instance to install, select or delete, between 1 and 255. The default instance is 1")
+	flagOnly              = flag.String("only", "", `delete a single instance: "keycard", "cash" or "ndef", keeping the package and the other instances`)
+	flagYes               = flag.Bool("yes", false, "don't ask to type the confirmation phrase before wiping keys")
+	flagKeyBackedUp       = flag.Bool("key-backed-up", false, "acknowledge that the keys wiped by delete, install -f or keycard-remove-key are backed up")
+	flagDryRun            = flag.Bool("dry-run", false, "read the card registry and print the install or delete plan without changing the card")
+	flagLogLevel          = flag.String("l", "", `Log level, one of: "error", "warn", "info", "debug", and "trace"`)
+	flagNDEFTemplate      = flag.String("ndef", "", "Specify a URL to use in the NDEF record. Use the {{.cashAddress}} variable to get the cash address: http://example.com/{{.cashAddress}}. See the README for the other variables.")
+	flagNDEFSpec          = flag.String("ndef-spec", "", "YAML or JSON file defining the records of the NDEF message")
+	flagNDEFHMACSecret    = flag.String("ndef-hmac-secret", "", "file with the local secret used to compute the {{.hmac}} NDEF template variable")
+	flagNDEFRecords       ndefRecordFlags
+	flagPairingKey        = flag.String("pairing-key", "", "pairing key in hex. If not specified, a temporary pairing is created with the pairing password")
+	flagPairingIndex      = flag.Int("pairing-index", 0, "pairing index to use with -pairing-key")
+	flagMnemonicFD        = flag.Int("mnemonic-fd", -1, "read the mnemonic from the specified file descriptor instead of asking for it")
+	flagPassphrase        = flag.Bool("passphrase", false, "ask for a BIP39 passphrase")
+	flagListen            = flag.String("listen", "127.0.0.1:8550", `signer listen address: a loopback "host:port" for HTTP or "unix:PATH" for a unix socket`)
+	flagPaths             = flag.String("paths", firstAccountPath, "comma separated derivation paths of the accounts exposed by the signer")
+	flagChainID           = flag.Int64("chain-id", 1, "chain ID used to sign transactions that don't specify one")
+	flagPolicy            = flag.String("policy", "", "signer policy file path. If not specified, every request is signed")
+	flagPSBTFile          = flag.String("psbt", "", "PSBT file path, binary or base64 encoded")
+	flagOutFile           = flag.String("o", "", "output file path. If not specified, the output is printed to stdout")
+	flagFormat            = flag.String("format", "text", `output format of ndef read: "text", "hex" or "json". verify-genuine accepts "text" or "json", inventory export "csv" or "json"`)
 )
 
 func initLogger() {
@@ -58,22 +131,47 @@ func init() {
 		"delete":  commandDelete,
 		"init":    commandInit,
 		"shell":   commandShell,
+
+		"load-mnemonic":  commandLoadMnemonic,
+		"serve":          commandServe,
+		"sign-psbt":      commandSignPSBT,
+		"cap-info":       commandCapInfo,
+		"gp-list":        commandGPList,
+		"gp-put-key":     commandGPPutKey,
+		"ndef":           commandNDEF,
+		"provision":      commandProvision,
+		"watch":          commandWatch,
+		"inventory":      commandInventory,
+		"audit":          commandAudit,
+		"verify-genuine": commandVerifyGenuine,
 	}
 
+	flag.Var(&flagNDEFRecords, "ndef-record", `NDEF record added to the message, can be repeated: "uri:URI", "text:LANG:TEXT", "aar:PACKAGE", "mime:TYPE:DATA" or "smartposter:LANG:TITLE:URI"`)
+}
+
+// parseArgs reads the command, the subcommand and the flags from the command line.
+// It's called by main rather than init so that the package tests don't parse the test flags.
+func parseArgs() {
 	if len(os.Args) < 2 {
 		usage()
 	}
 
 	command = os.Args[1]
-	if len(os.Args) > 2 {
-		flag.CommandLine.Parse(os.Args[2:])
+	args := os.Args[2:]
+	if subcommandCommands[command] && len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		subcommand = args[0]
+		args = args[1:]
+	}
+
+	if len(args) > 0 {
+		flag.CommandLine.Parse(args)
 	}
 
 	initLogger()
 }
 
 func usage() {
-	fmt.Printf("\nUsage:\n  keycard COMMAND [FLAGS]\n\nAvailable commands:\n")
+	fmt.Printf("\nUsage:\n  keycard COMMAND [SUBCOMMAND] [FLAGS] [ARGS]\n\nAvailable commands:\n")
 	for name := range commands {
 		fmt.Printf("  %s\n", name)
 	}
@@ -111,9 +209,34 @@ func waitForCard(ctx *scard.Context, readers []string) (int, error) {
 	}
 }
 
+// waitForCardRemoval blocks until the card is removed from reader.
+func waitForCardRemoval(ctx *scard.Context, reader string) error {
+	rs := []scard.ReaderState{{
+		Reader:       reader,
+		CurrentState: scard.StateUnaware,
+	}}
+
+	for {
+		if err := ctx.GetStatusChange(rs, -1); err != nil {
+			return err
+		}
+
+		if rs[0].EventState&scard.StatePresent == 0 {
+			return nil
+		}
+
+		rs[0].CurrentState = rs[0].EventState
+	}
+}
+
 func main() {
-	if command == "version" {
-		commandVersion(nil)
+	parseArgs()
+
+	if cardlessCommands[command] {
+		if err := commands[command](nil); err != nil {
+			logger.Error("error executing command", "command", command, "error", err)
+			os.Exit(1)
+		}
 		return
 	}
 
@@ -195,6 +318,17 @@ func ask(description string) string {
 	return strings.TrimSpace(text)
 }
 
+func askHidden(description string) string {
+	fmt.Printf("%s: ", description)
+	data, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	if err != nil {
+		stdlog.Fatal(err)
+	}
+
+	return strings.TrimSpace(string(data))
+}
+
 func askHex(description string) []byte {
 	s := ask(description)
 	if s[:2] == "0x" {
@@ -236,12 +370,88 @@ func commandInstall(card *scard.Card) error {
 	}
 	defer f.Close()
 
-	i := NewInstaller(card)
-	return i.Install(f, *flagOverwrite, *flagKeycardApplet, *flagCashApplet, *flagNDEFApplet, *flagNDEFTemplate)
+	if *flagCapManifest != "" {
+		if err = verifyTrustedCap(f); err != nil {
+			if !*flagOverwrite || !*flagAllowUntrustedCap {
+				return err
+			}
+			logger.Warn("installing untrusted cap file", "error", err)
+		}
+	}
+
+	spec, err := ndefSpec()
+	if err != nil {
+		return err
+	}
+
+	i := NewInstaller(card, gpKeyConfig(), keycardInstanceIndex())
+	if *flagDryRun {
+		plan, err := i.PlanInstall(f, *flagOverwrite, *flagKeycardApplet, *flagCashApplet, *flagNDEFApplet, spec)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Installation plan (dry run):\n%s", plan)
+		return plan.Abort
+	}
+
+	if *flagOverwrite {
+		plan, err := i.PlanInstall(f, *flagOverwrite, *flagKeycardApplet, *flagCashApplet, *flagNDEFApplet, spec)
+		if err != nil {
+			return err
+		}
+
+		if len(plan.Deletions) > 0 {
+			fmt.Printf("Installation plan:\n%s", plan)
+			if err = confirmWipe(i, "overwrite", plan); err != nil {
+				return err
+			}
+		}
+	}
+
+	report, err := i.Install(f, *flagOverwrite, *flagKeycardApplet, *flagCashApplet, *flagNDEFApplet, spec)
+	if report != nil {
+		fmt.Printf("Installation verification:\n%s", report)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	rec := readInventoryRecord(card, gpKeyConfig(), keycardInstanceIndex(), InventoryOperationInstall)
+	rec.CapFile = filepath.Base(*flagCapFile)
+
+	audit("install", rec.InstanceUID, "cardSerial", rec.CardSerial, "capFile", rec.CapFile, "overwrite", *flagOverwrite)
+	recordInventory(rec)
+
+	return nil
+}
+
+func verifyTrustedCap(f *os.File) error {
+	logger.Info("verifying cap file against the trusted manifest", "manifest", *flagCapManifest)
+	manifest, err := LoadCapManifest(*flagCapManifest, *flagCapSignature, *flagCapPublicKey)
+	if err != nil {
+		return err
+	}
+
+	capInfo, err := ParseCapFile(f)
+	if err != nil {
+		return err
+	}
+
+	entry, err := manifest.Verify(capInfo)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("trusted cap file", "file", entry.File, "version", entry.Version)
+	fmt.Printf("Trusted cap file: %s, version %s, package version %s\n", entry.File, entry.Version, capInfo.PackageVersion)
+
+	return nil
 }
 
 func commandInfo(card *scard.Card) error {
-	i := NewInitializer(card)
+	i := NewInitializer(card, keycardInstanceIndex())
 	info, cashInfo, err := i.Info()
 	if err != nil {
 		return err
@@ -253,6 +463,7 @@ func commandInfo(card *scard.Card) error {
 	}
 
 	fmt.Printf("Keycard Applet:\n")
+	fmt.Printf("  Instance index: %d\n", keycardInstanceIndex())
 	fmt.Printf("  Installed: %+v\n", info.Installed)
 	fmt.Printf("  Initialized: %+v\n", info.Initialized)
 	fmt.Printf("  Key Initialized: %+v\n", keyInitialized)
@@ -290,19 +501,166 @@ func commandInfo(card *scard.Card) error {
 }
 
 func commandDelete(card *scard.Card) error {
-	i := NewInstaller(card)
-	err := i.Delete()
+	i := NewInstaller(card, gpKeyConfig(), keycardInstanceIndex())
+	if *flagOnly != "" {
+		return deleteInstance(card, i, strings.ToLower(*flagOnly))
+	}
+
+	if *flagInstanceIndex != 0 {
+		return deleteInstance(card, i, "keycard")
+	}
+
+	plan, err := i.PlanDelete()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Delete plan:\n%s", plan)
+	if *flagDryRun {
+		return nil
+	}
+
+	if err = confirmWipe(i, "delete", plan); err != nil {
+		return err
+	}
+
+	// the applets can't be read anymore once deleted.
+	rec := readInventoryRecord(card, gpKeyConfig(), keycardInstanceIndex(), InventoryOperationDelete)
+
+	err = i.Delete()
 	if err != nil {
 		return err
 	}
 
 	fmt.Printf("applet deleted\n")
 
+	audit("delete", rec.InstanceUID, "cardSerial", rec.CardSerial)
+	recordInventory(rec)
+
+	return nil
+}
+
+// confirmWipe shows the keys of the Keycard instances deleted by plan and asks for confirmation.
+func confirmWipe(i *Installer, operation string, plan *InstallPlan) error {
+	sg := safeguard()
+	keys, err := i.KeyInfo(plan.KeycardInstances(), sg.Credentials)
+	if err != nil {
+		return err
+	}
+
+	return sg.Confirm(operation, keys)
+}
+
+// deleteInstance deletes the keycard, cash or NDEF instance after showing the plan and asking for confirmation.
+// Deleting a keycard instance is recorded in the inventory.
+func deleteInstance(card *scard.Card, i *Installer, name string) error {
+	var aid []byte
+	switch name {
+	case "keycard":
+		var err error
+		if aid, err = identifiers.KeycardInstanceAID(keycardInstanceIndex()); err != nil {
+			return err
+		}
+	case "cash":
+		aid = identifiers.CashInstanceAID
+	case "ndef":
+		aid = identifiers.NdefInstanceAID
+	default:
+		return fmt.Errorf("%w: %s", errUnknownInstance, name)
+	}
+
+	plan, err := i.PlanDeleteInstance(name, aid)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Delete plan:\n%s", plan)
+	if *flagDryRun {
+		return nil
+	}
+
+	if len(plan.Deletions) == 0 {
+		return fmt.Errorf("%w: %s instance 0x%x", errInstanceNotInstalled, name, aid)
+	}
+
+	if err = confirmWipe(i, "delete", plan); err != nil {
+		return err
+	}
+
+	rec := readInventoryRecord(card, gpKeyConfig(), keycardInstanceIndex(), InventoryOperationDelete)
+
+	if err = i.DeleteInstance(aid); err != nil {
+		return err
+	}
+
+	fmt.Printf("%s instance 0x%x deleted\n", name, aid)
+
+	audit("delete", rec.InstanceUID, "cardSerial", rec.CardSerial, "aid", fmt.Sprintf("%x", aid))
+	if name == "keycard" {
+		recordInventory(rec)
+	}
+
+	return nil
+}
+
+func commandGPList(card *scard.Card) error {
+	i := NewInstaller(card, gpKeyConfig(), keycardInstanceIndex())
+	registry, err := i.Registry()
+	if err != nil {
+		return err
+	}
+
+	fmt.Print(registry)
+
 	return nil
 }
 
+func commandGPPutKey(card *scard.Card) error {
+	if *flagNewGPKeyFile == "" {
+		logger.Error("you must specify the new keys with the -new-gp-keys flag\n")
+		usage()
+	}
+
+	newKeys, err := LoadGPKeyConfig(*flagNewGPKeyFile)
+	if err != nil {
+		return err
+	}
+
+	if err = newKeys.Validate(); err != nil {
+		return err
+	}
+
+	i := NewInstaller(card, gpKeyConfig(), keycardInstanceIndex())
+	rotation, rotateErr := i.RotateKeys(newKeys, *flagReplaceGPKeys)
+	if rotation == nil {
+		return rotateErr
+	}
+
+	if rotation.Verified {
+		fmt.Printf("ISD keys rotated: version 0x%02x -> 0x%02x (SCP%02d)\n", rotation.OldVersion, rotation.NewVersion, rotation.SCP)
+	} else {
+		fmt.Printf("ISD keys changed but NOT verified: version 0x%02x -> 0x%02x (SCP%02d)\n", rotation.OldVersion, rotation.NewVersion, rotation.SCP)
+	}
+
+	keyVersion := int(rotation.NewVersion)
+	scp := int(rotation.SCP)
+	rec := &InventoryRecord{
+		Operation:     "gp-put-key",
+		InstanceUID:   fmt.Sprintf("%x", rotation.InstanceUID),
+		CardSerial:    fmt.Sprintf("%x", rotation.CardSerial),
+		ISDKeyVersion: &keyVersion,
+		SCP:           &scp,
+		Unverified:    !rotation.Verified,
+	}
+
+	audit("gp-put-key", rec.InstanceUID, "cardSerial", rec.CardSerial, "oldKeyVersion", rotation.OldVersion, "newKeyVersion", rotation.NewVersion, "verified", rotation.Verified)
+	recordInventory(rec)
+
+	return rotateErr
+}
+
 func commandInit(card *scard.Card) error {
-	i := NewInitializer(card)
+	i := NewInitializer(card, keycardInstanceIndex())
 	secrets, err := i.Init()
 	if err != nil {
 		return err
@@ -312,15 +670,780 @@ func commandInit(card *scard.Card) error {
 	fmt.Printf("PUK %s\n", secrets.Puk())
 	fmt.Printf("Pairing password: %s\n", secrets.PairingPass())
 
+	rec := readInventoryRecord(card, gpKeyConfig(), keycardInstanceIndex(), InventoryOperationInit)
+	audit("init", rec.InstanceUID, "cardSerial", rec.CardSerial)
+	recordInventory(rec)
+
 	return nil
 }
 
 func commandShell(card *scard.Card) error {
 	fi, _ := os.Stdin.Stat()
 	if (fi.Mode() & os.ModeCharDevice) == 0 {
-		s := NewShell(card)
+		s, err := NewShell(card, gpKeyConfig(), keycardInstanceIndex(), safeguard(), inventory(), auditLog())
+		if err != nil {
+			return err
+		}
 		return s.Run()
 	} else {
 		return errors.New("non interactive shell. you must pipe commands")
 	}
 }
+
+// inventory returns the inventory of the -inventory flag, recording the -operator flag.
+func inventory() *Inventory {
+	inv := NewInventory(*flagInventory)
+	inv.Operator = *flagOperator
+	return inv
+}
+
+// recordInventory appends rec to the inventory.
+// It's called once the card operation succeeded, so an error is reported without failing the command.
+func recordInventory(rec *InventoryRecord) {
+	if err := inventory().Append(rec); err != nil {
+		logger.Error("error updating the inventory", "error", err)
+		fmt.Fprintf(os.Stderr, "%s succeeded, not recorded in the inventory: %v\n", rec.Operation, err)
+	}
+}
+
+// auditLog returns the audit log of the -audit-log flag, signed with the -audit-key file if specified.
+func auditLog() *AuditLog {
+	a, err := loadAuditLog()
+	if err != nil {
+		fail("error loading audit key", "error", err)
+	}
+
+	return a
+}
+
+func loadAuditLog() (*AuditLog, error) {
+	var key ed25519.PrivateKey
+	if *flagAuditKey != "" {
+		var err error
+		if key, err = LoadAuditKey(*flagAuditKey); err != nil {
+			return nil, err
+		}
+	}
+
+	a := NewAuditLog(*flagAuditLog, key)
+	a.Operator = *flagOperator
+	return a, nil
+}
+
+// audit appends operation on the card with the hex instanceUID to the audit log.
+// It's called once the card operation succeeded, so an error is reported without failing the command.
+func audit(operation string, instanceUID string, ctx ...interface{}) {
+	a, err := loadAuditLog()
+	if err == nil {
+		err = a.Append(operation, instanceUID, ctx...)
+	}
+
+	if err != nil {
+		logger.Error("error updating the audit log", "error", err)
+		fmt.Fprintf(os.Stderr, "%s succeeded, not recorded in the audit log: %v\n", operation, err)
+	}
+}
+
+func safeguard() *Safeguard {
+	sg := &Safeguard{
+		AssumeYes:   *flagYes,
+		KeyBackedUp: *flagKeyBackedUp,
+	}
+
+	// a temporary pairing would use a pairing slot of the card only to show the address
+	if *flagPairingKey != "" && !*flagYes {
+		sg.Credentials = sessionCredentials
+	}
+
+	return sg
+}
+
+// keycardInstanceIndex returns the -instance-index flag, or the default instance index if not specified.
+func keycardInstanceIndex() int {
+	if *flagInstanceIndex == 0 {
+		return identifiers.KeycardDefaultInstanceIndex
+	}
+
+	if _, err := identifiers.KeycardInstanceAID(*flagInstanceIndex); err != nil {
+		fail("invalid instance index", "error", err)
+	}
+
+	return *flagInstanceIndex
+}
+
+// gpKeyConfig returns the ISD keys from the -gp-keys file, overridden by the other GP key flags.
+func gpKeyConfig() *GPKeyConfig {
+	config := &GPKeyConfig{}
+	if *flagGPKeyFile != "" {
+		c, err := LoadGPKeyConfig(*flagGPKeyFile)
+		if err != nil {
+			fail("error loading GP keys", "error", err)
+		}
+		config = c
+	}
+
+	if *flagGPKey != "" {
+		config.Key = *flagGPKey
+	}
+
+	if *flagGPEnc != "" {
+		config.Enc = *flagGPEnc
+	}
+
+	if *flagGPMac != "" {
+		config.Mac = *flagGPMac
+	}
+
+	if *flagGPDek != "" {
+		config.Dek = *flagGPDek
+	}
+
+	if *flagGPDiversification != "" {
+		config.Diversification = *flagGPDiversification
+	}
+
+	if *flagGPKeyVersion >= 0 {
+		config.KeyVersion = *flagGPKeyVersion
+	}
+
+	if *flagSCP >= 0 {
+		config.SCP = *flagSCP
+	}
+
+	if err := config.Validate(); err != nil {
+		fail("invalid GP keys", "error", err)
+	}
+
+	return config
+}
+
+func sessionCredentials() *SessionCredentials {
+	creds := &SessionCredentials{
+		PairingIndex: *flagPairingIndex,
+	}
+
+	if *flagPairingKey != "" {
+		s := strings.TrimPrefix(*flagPairingKey, "0x")
+		key, err := hex.DecodeString(s)
+		if err != nil {
+			fail("error parsing pairing key", "error", err)
+		}
+		creds.PairingKey = key
+	} else {
+		creds.PairingPass = askHidden("Pairing password")
+	}
+
+	creds.PIN = askHidden("PIN")
+
+	return creds
+}
+
+func commandLoadMnemonic(card *scard.Card) error {
+	var (
+		mnemonic   string
+		passphrase string
+		err        error
+	)
+
+	if *flagMnemonicFD >= 0 {
+		mnemonic, err = readMnemonicFromFD(*flagMnemonicFD)
+		if err != nil {
+			return err
+		}
+	} else {
+		mnemonic = askHidden("Mnemonic")
+	}
+
+	if *flagPassphrase {
+		passphrase = askHidden("BIP39 passphrase")
+	}
+
+	// validate before touching the card
+	if _, err = mnemonicToSeed(mnemonic, passphrase); err != nil {
+		return err
+	}
+
+	s := NewSession(card)
+	if err = s.Open(sessionCredentials()); err != nil {
+		return err
+	}
+	defer s.Close()
+
+	keyUID, address, err := s.LoadMnemonic(mnemonic, passphrase)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("KEY UID: 0x%x\n", keyUID)
+	fmt.Printf("ADDRESS (%s): %s\n", firstAccountPath, address.String())
+
+	audit("load-seed", fmt.Sprintf("%x", s.CommandSet().ApplicationInfo.InstanceUID), "keyUID", fmt.Sprintf("%x", keyUID), "address", address.String())
+
+	return nil
+}
+
+func commandServe(card *scard.Card) error {
+	a := auditLog()
+
+	var policy *Policy
+	if *flagPolicy != "" {
+		var err error
+		policy, err = LoadPolicy(*flagPolicy, a)
+		if err != nil {
+			return err
+		}
+	} else {
+		logger.Warn("no policy specified, every request will be signed")
+	}
+
+	s := NewSession(card)
+	if err := s.Open(sessionCredentials()); err != nil {
+		return err
+	}
+	defer s.Close()
+
+	signer, err := NewSigner(s.CommandSet(), strings.Split(*flagPaths, ","), big.NewInt(*flagChainID), policy, a)
+	if err != nil {
+		return err
+	}
+
+	return serveSigner(signer, *flagListen)
+}
+
+func commandSignPSBT(card *scard.Card) error {
+	if *flagPSBTFile == "" {
+		logger.Error("you must specify a PSBT file path with the -psbt flag\n")
+		usage()
+	}
+
+	data, err := os.ReadFile(*flagPSBTFile)
+	if err != nil {
+		fail("error reading PSBT file", "error", err)
+	}
+
+	data = bytes.TrimSpace(data)
+	isBase64 := !bytes.HasPrefix(data, []byte("psbt\xff"))
+	packet, err := psbt.NewFromRawBytes(bytes.NewReader(data), isBase64)
+	if err != nil {
+		return err
+	}
+
+	s := NewSession(card)
+	if err = s.Open(sessionCredentials()); err != nil {
+		return err
+	}
+	defer s.Close()
+
+	signer, err := NewPSBTSigner(s.CommandSet(), auditLog())
+	if err != nil {
+		return err
+	}
+
+	signed, err := signer.Sign(packet)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("PSBT signed", "signatures", signed)
+
+	if *flagOutFile != "" && !isBase64 {
+		buf := new(bytes.Buffer)
+		if err = packet.Serialize(buf); err != nil {
+			return err
+		}
+
+		return os.WriteFile(*flagOutFile, buf.Bytes(), 0644)
+	}
+
+	encoded, err := packet.B64Encode()
+	if err != nil {
+		return err
+	}
+
+	if *flagOutFile != "" {
+		return os.WriteFile(*flagOutFile, []byte(encoded+"\n"), 0644)
+	}
+
+	fmt.Println(encoded)
+
+	return nil
+}
+
+func commandNDEF(card *scard.Card) error {
+	switch subcommand {
+	case "set":
+		return commandNDEFSet(card)
+	case "read":
+		return commandNDEFRead(card)
+	default:
+		logger.Error("unknown ndef subcommand", "subcommand", subcommand)
+		usage()
+	}
+
+	return nil
+}
+
+func commandNDEFSet(card *scard.Card) error {
+	spec, err := ndefSpec(flag.Args()...)
+	if err != nil {
+		return err
+	}
+
+	if spec == nil {
+		logger.Error("usage: keycard ndef set [FLAGS] [URL_TEMPLATE]. Records can also be specified with -ndef-spec and -ndef-record")
+		usage()
+	}
+
+	c := keycardio.NewNormalChannel(card)
+	ndefRecord, err := buildNDEFRecordWithAppletData(c, keycardInstanceIndex(), spec, ndefFileSize(c))
+	if err != nil {
+		return err
+	}
+
+	logger.Info("setting NDEF record", "records", spec.String())
+
+	kc, err := newInstanceChannel(c, keycardInstanceIndex())
+	if err != nil {
+		return err
+	}
+
+	s := newChannelSession(kc)
+	if err = s.Open(sessionCredentials()); err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if err = s.StoreNDEF(ndefRecord); err != nil {
+		return err
+	}
+
+	fmt.Printf("NDEF record set: %s\n", spec)
+
+	audit("ndef-set", fmt.Sprintf("%x", s.CommandSet().ApplicationInfo.InstanceUID), "records", spec.String())
+
+	return nil
+}
+
+// ndefSpec returns the NDEF records specified with -ndef-spec, -ndef, the additional URI templates
+// and -ndef-record, in this order. It returns nil if no record is specified.
+func ndefSpec(uriTemplates ...string) (*NDEFSpec, error) {
+	spec := &NDEFSpec{}
+	if *flagNDEFSpec != "" {
+		var err error
+		if spec, err = LoadNDEFSpec(*flagNDEFSpec); err != nil {
+			return nil, err
+		}
+	}
+
+	if *flagNDEFTemplate != "" {
+		uriTemplates = append([]string{*flagNDEFTemplate}, uriTemplates...)
+	}
+
+	for _, tpl := range uriTemplates {
+		spec.Records = append(spec.Records, &NDEFRecordSpec{Type: NDEFRecordURI, URI: tpl})
+	}
+
+	spec.Records = append(spec.Records, flagNDEFRecords...)
+	if len(spec.Records) == 0 {
+		return nil, nil
+	}
+
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+
+	if *flagNDEFHMACSecret != "" {
+		secret, err := LoadNDEFHMACSecret(*flagNDEFHMACSecret)
+		if err != nil {
+			return nil, err
+		}
+		spec.HMACSecret = secret
+	}
+
+	return spec, nil
+}
+
+func commandNDEFRead(card *scard.Card) error {
+	content, err := readNDEFContent(keycardio.NewNormalChannel(card))
+	if err != nil {
+		logger.Error("read NDEF failed", "error", err)
+		return err
+	}
+
+	switch *flagFormat {
+	case "text":
+		fmt.Print(content)
+	case "hex":
+		fmt.Printf("%s\n", content.Message)
+	case "json":
+		data, err := json.MarshalIndent(content, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", data)
+	default:
+		return fmt.Errorf("unknown output format %q", *flagFormat)
+	}
+
+	return nil
+}
+
+func commandProvision(_ *scard.Card) error {
+	if *flagManifest == "" {
+		logger.Error("you must specify a provisioning manifest with the -manifest flag\n")
+		usage()
+	}
+
+	manifest, err := LoadProvisionManifest(*flagManifest)
+	if err != nil {
+		return err
+	}
+
+	gpKeys := gpKeyConfig()
+	if manifest.GPKeys != "" {
+		if gpKeys, err = LoadGPKeyConfig(manifest.GPKeys); err != nil {
+			return err
+		}
+
+		if err = gpKeys.Validate(); err != nil {
+			return err
+		}
+	}
+
+	spec, err := manifest.LoadNDEFSpec()
+	if err != nil {
+		return err
+	}
+
+	out, err := NewProvisionResultWriter(manifest.Output, manifest.Format)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	ctx, err := scard.EstablishContext()
+	if err != nil {
+		return err
+	}
+	defer ctx.Release()
+
+	readers, err := ctx.ListReaders()
+	if err != nil {
+		return err
+	}
+
+	if len(readers) == 0 {
+		return errors.New("no smartcard reader found")
+	}
+
+	p := NewProvisioner(manifest, gpKeys, spec, inventory(), auditLog())
+	if *flagParallel {
+		return provisionParallel(p, readers, manifest.Count, out)
+	}
+
+	for n := 1; manifest.Count == 0 || n <= manifest.Count; n++ {
+		fmt.Printf("Insert card %d\n", n)
+		index, err := waitForCard(ctx, readers)
+		if err != nil {
+			return err
+		}
+
+		reader := readers[index]
+		res := &ProvisionResult{Time: time.Now().UTC(), Reader: reader, Status: ProvisionStatusFailed}
+		card, err := ctx.Connect(reader, scard.ShareShared, scard.ProtocolAny)
+		if err != nil {
+			logger.Error("error connecting to card", "error", err)
+			res.Error = fmt.Sprintf("connect: %v", err)
+		} else {
+			res = p.Provision(card, reader)
+			card.Disconnect(scard.ResetCard)
+		}
+
+		if err = out.Write(res); err != nil {
+			return err
+		}
+
+		fmt.Printf("Card %d: %s %s %s\n", n, res.Status, res.InstanceUID, res.Error)
+		fmt.Printf("Remove the card\n")
+		if err = waitForCardRemoval(ctx, reader); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// provisionParallel runs a provisioning worker for each reader. The results are written by this goroutine only.
+// On a terminal a live status table is shown, otherwise each result is printed.
+func provisionParallel(p *Provisioner, readers []string, count int, out *ProvisionResultWriter) error {
+	status := NewProvisionStatusTable(readers)
+	results := make(chan *ProvisionResult)
+	go NewParallelProvisioner(p, status, count).Run(readers, results)
+
+	live := term.IsTerminal(int(os.Stdout.Fd()))
+	ticker := time.NewTicker(statusTableRefresh)
+	defer ticker.Stop()
+
+	var writeErr error
+	for {
+		select {
+		case res, ok := <-results:
+			if !ok {
+				status.Render(os.Stdout, live)
+				return writeErr
+			}
+
+			if err := out.Write(res); err != nil {
+				// keep provisioning the other readers, the result is still printed
+				logger.Error("error writing provisioning result", "error", err)
+				writeErr = err
+				live = false
+			}
+
+			if !live {
+				fmt.Printf("%s: %s %s %s\n", res.Reader, res.Status, res.InstanceUID, res.Error)
+			}
+		case <-ticker.C:
+			if live {
+				status.Render(os.Stdout, true)
+			}
+		}
+	}
+}
+
+func commandWatch(_ *scard.Card) error {
+	ctx, err := scard.EstablishContext()
+	if err != nil {
+		return err
+	}
+	defer ctx.Release()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupt
+		logger.Info("stopping watch")
+		ctx.Cancel()
+	}()
+
+	return NewWatcher(*flagExec, os.Stdout).Run(ctx)
+}
+
+func commandCapInfo(card *scard.Card) error {
+	path := flag.Arg(0)
+	if path == "" {
+		path = *flagCapFile
+	}
+
+	if path == "" {
+		logger.Error("you must specify a cap file path\n")
+		usage()
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		fail("error opening cap file", "error", err)
+	}
+	defer f.Close()
+
+	capInfo, err := ParseCapFile(f)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("CAP File: %s\n", path)
+	fmt.Printf("  Format Version: %s\n", capInfo.FormatVersion)
+	fmt.Printf("  Package Name: %s\n", capInfo.PackageName)
+	fmt.Printf("  Package AID: 0x%x\n", capInfo.PackageAID)
+	fmt.Printf("  Package Version: %s\n", capInfo.PackageVersion)
+	fmt.Printf("  Java Card API Version: %s\n", capInfo.JavacardAPIVersion)
+	fmt.Printf("  Applets:\n")
+	for _, aid := range capInfo.AppletAIDs {
+		fmt.Printf("    0x%x\n", aid)
+	}
+	fmt.Printf("  Imports:\n")
+	for _, imp := range capInfo.Imports {
+		fmt.Printf("    0x%x %s\n", imp.AID, imp.Version)
+	}
+	fmt.Printf("  Components:\n")
+	for _, c := range capInfo.Components {
+		fmt.Printf("    %s: %d bytes\n", c.Name, c.Size)
+	}
+	fmt.Printf("  Load File Size: %d bytes\n", capInfo.LoadFileSize)
+	fmt.Printf("  Load File SHA-1: 0x%x\n", capInfo.LoadFileSHA1)
+	fmt.Printf("  Load File SHA-256: 0x%x\n", capInfo.LoadFileSHA256)
+	fmt.Printf("  File SHA-256: 0x%x\n", capInfo.FileSHA256)
+	fmt.Printf("  Keycard Package: %v\n", validateKeycardCap(capInfo, true, true, true) == nil)
+
+	return nil
+}
+
+func commandInventory(card *scard.Card) error {
+	switch subcommand {
+	case "list":
+		return commandInventoryList()
+	case "show":
+		return commandInventoryShow()
+	case "export":
+		return commandInventoryExport()
+	default:
+		logger.Error("unknown inventory subcommand", "subcommand", subcommand)
+		usage()
+	}
+
+	return nil
+}
+
+// commandInventoryList prints the cards of the inventory matching the FIELD=VALUE arguments.
+func commandInventoryList() error {
+	cards, err := inventory().Cards()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tKEYCARD\tCASH\tKEY UID\tCASH ADDRESS\tINITIALIZED\tLAST OPERATION\tDELETED")
+	for _, card := range cards {
+		ok, err := card.Matches(flag.Args())
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			continue
+		}
+
+		initialized := "-"
+		if card.InitializedAt != nil {
+			initialized = card.InitializedAt.Format(time.RFC3339)
+		}
+
+		last := card.History[len(card.History)-1]
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s %s\t%v\n", card.ID, card.KeycardVersion, card.CashVersion,
+			card.KeyUID, card.CashAddress, initialized, last.Operation, last.Time.Format(time.RFC3339), card.Deleted)
+	}
+
+	return tw.Flush()
+}
+
+// commandInventoryShow prints a card of the inventory and its history.
+func commandInventoryShow() error {
+	if flag.NArg() != 1 {
+		logger.Error("you must specify the instance UID, key UID or serial of the card\n")
+		usage()
+	}
+
+	card, err := inventory().FindCard(flag.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if *flagFormat == "json" {
+		data, err := json.MarshalIndent(card, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", data)
+		return nil
+	}
+
+	fmt.Print(card)
+	return nil
+}
+
+// commandInventoryExport writes the cards of the inventory as CSV or JSON to the -o file or stdout.
+func commandInventoryExport() error {
+	cards, err := inventory().Cards()
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	switch *flagFormat {
+	case "text", "csv":
+		err = WriteInventoryCSV(&buf, cards)
+	case "json":
+		var data []byte
+		data, err = json.MarshalIndent(cards, "", "  ")
+		buf.Write(append(data, '\n'))
+	default:
+		return fmt.Errorf("unknown export format %q", *flagFormat)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if *flagOutFile != "" {
+		return os.WriteFile(*flagOutFile, buf.Bytes(), 0600)
+	}
+
+	_, err = os.Stdout.Write(buf.Bytes())
+	return err
+}
+
+func commandAudit(card *scard.Card) error {
+	switch subcommand {
+	case "verify":
+		return commandAuditVerify()
+	default:
+		logger.Error("unknown audit subcommand", "subcommand", subcommand)
+		usage()
+	}
+
+	return nil
+}
+
+// commandAuditVerify checks the audit log chain and signatures, and that it's not truncated.
+func commandAuditVerify() error {
+	var pubKey ed25519.PublicKey
+	if *flagAuditPublicKey != "" {
+		var err error
+		if pubKey, err = ParseAuditPublicKey(*flagAuditPublicKey); err != nil {
+			return err
+		}
+	}
+
+	v, err := NewAuditLog(*flagAuditLog, nil).Verify(pubKey)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Audit log %s verified\n%s", *flagAuditLog, v)
+
+	return nil
+}
+
+// commandVerifyGenuine checks the card identity certificate against the trusted CAs.
+// It fails for cards without a valid certificate of a trusted CA.
+func commandVerifyGenuine(card *scard.Card) error {
+	cas, err := LoadTrustedCAs(*flagTrustedCAs)
+	if err != nil {
+		return err
+	}
+
+	if len(cas) == 0 {
+		logger.Error("no CA public key is bundled, you must specify the trusted CAs with the -trusted-cas flag\n")
+		usage()
+	}
+
+	report, verifyErr := VerifyGenuine(keycardio.NewNormalChannel(card), keycardInstanceIndex(), cas)
+	if report != nil {
+		switch *flagFormat {
+		case "json":
+			data, err := json.MarshalIndent(report, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s\n", data)
+		default:
+			fmt.Print(report)
+		}
+	}
+
+	if errors.Is(verifyErr, ErrCardNotGenuine) {
+		fmt.Fprintf(os.Stderr, "\n!!! WARNING: %v !!!\n\n", verifyErr)
+	}
+
+	return verifyErr
+}
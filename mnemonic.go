@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/tyler-smith/go-bip39"
+)
+
+// firstAccountPath is the derivation path of the first Ethereum account.
+const firstAccountPath = "m/44'/60'/0'/0/0"
+
+// normalizeMnemonic lowercases the mnemonic and collapses the whitespace between words.
+func normalizeMnemonic(mnemonic string) string {
+	return strings.Join(strings.Fields(strings.ToLower(mnemonic)), " ")
+}
+
+// mnemonicToSeed validates the mnemonic words and checksum against the
+// english wordlist and returns the BIP39 seed derived with PBKDF2.
+func mnemonicToSeed(mnemonic string, passphrase string) ([]byte, error) {
+	mnemonic = normalizeMnemonic(mnemonic)
+	if _, err := bip39.EntropyFromMnemonic(mnemonic); err != nil {
+		return nil, fmt.Errorf("invalid mnemonic: %v", err)
+	}
+
+	return bip39.NewSeed(mnemonic, passphrase), nil
+}
+
+// readMnemonicFromFD reads the mnemonic from the first line of the file descriptor fd.
+func readMnemonicFromFD(fd int) (string, error) {
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("fd%d", fd))
+	if f == nil {
+		return "", fmt.Errorf("invalid file descriptor %d", fd)
+	}
+	defer f.Close()
+
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	return strings.TrimSpace(line), nil
+}
+
+// LoadMnemonic loads the seed derived from mnemonic and passphrase on the card.
+// It returns the key UID and the address of the first account.
+func (s *Session) LoadMnemonic(mnemonic string, passphrase string) ([]byte, common.Address, error) {
+	seed, err := mnemonicToSeed(mnemonic, passphrase)
+	if err != nil {
+		return nil, common.Address{}, err
+	}
+
+	logger.Info("loading seed")
+	keyUID, err := s.cmdSet.LoadSeed(seed)
+	if err != nil {
+		logger.Error("load seed failed", "error", err)
+		return nil, common.Address{}, err
+	}
+
+	logger.Info(fmt.Sprintf("export public key %s", firstAccountPath))
+	_, pubKey, err := s.cmdSet.ExportKey(true, false, true, firstAccountPath)
+	if err != nil {
+		logger.Error("export key failed", "error", err)
+		return nil, common.Address{}, err
+	}
+
+	ecdsaPubKey, err := crypto.UnmarshalPubkey(pubKey)
+	if err != nil {
+		return nil, common.Address{}, err
+	}
+
+	return keyUID, crypto.PubkeyToAddress(*ecdsaPubKey), nil
+}
@@ -3,13 +3,51 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"html/template"
+	texttemplate "text/template"
 
-	"github.com/hsanjuan/go-ndef"
+	keycard "github.com/status-im/keycard-go"
+	"github.com/status-im/keycard-go/apdu"
+	"github.com/status-im/keycard-go/globalplatform"
+	"github.com/status-im/keycard-go/identifiers"
+	"github.com/status-im/keycard-go/types"
 )
 
+const (
+	insReadBinary = 0xB0
+
+	// ndefReadChunkSize is the maximum number of bytes requested with each READ BINARY.
+	ndefReadChunkSize = 0x80
+)
+
+var (
+	ndefFileID = []byte{0xE1, 0x04}
+
+	errInvalidNDEFLength  = errors.New("invalid NDEF file length")
+	errEmptyReadBinary    = errors.New("empty READ BINARY response")
+	errNoNDEFCapability   = errors.New("the Keycard applet doesn't have the NDEF capability")
+	errNDEFRecordMismatch = errors.New("the stored NDEF record doesn't match")
+)
+
+// buildText expands a template that isn't a URL, like the text of Text records, without HTML escaping.
+func buildText(textTemplate string, vars interface{}) (string, error) {
+	tpl, err := texttemplate.New("").Option("missingkey=error").Parse(textTemplate)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err = tpl.Execute(&buf, vars); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
 func buildURL(urlTemplate string, vars interface{}) (string, error) {
-	tpl, err := template.New("").Parse(urlTemplate)
+	tpl, err := template.New("").Option("missingkey=error").Parse(urlTemplate)
 	if err != nil {
 		return "", err
 	}
@@ -23,21 +61,103 @@ func buildURL(urlTemplate string, vars interface{}) (string, error) {
 	return urlBuf.String(), nil
 }
 
-func buildNdefDataWithURL(urlTemplate string, vars interface{}) (string, []byte, error) {
-	url, err := buildURL(urlTemplate, vars)
+// selectNDEFFile selects the NDEF Type 4 tag application and the file with the specified ID.
+func selectNDEFFile(c types.Channel, fileID []byte) error {
+	cmd := globalplatform.NewCommandSelect(identifiers.NdefInstanceAID)
+	resp, err := c.Send(cmd)
+	if err = checkOK(resp, err); err != nil {
+		return err
+	}
+
+	cmd = apdu.NewCommand(globalplatform.ClaISO7816, globalplatform.InsSelect, 0x00, 0x0C, fileID)
+	resp, err = c.Send(cmd)
+
+	return checkOK(resp, err)
+}
+
+// readBinary reads length bytes at offset from the currently selected file.
+func readBinary(c types.Channel, offset uint16, length uint8) ([]byte, error) {
+	cmd := apdu.NewCommand(globalplatform.ClaISO7816, insReadBinary, uint8(offset>>8), uint8(offset), nil)
+	cmd.SetLe(length)
+	resp, err := c.Send(cmd)
+	if err = checkOK(resp, err); err != nil {
+		return nil, err
+	}
+
+	return resp.Data, nil
+}
+
+// readNDEFFile returns the content of the NDEF file: the 2 bytes length followed by the NDEF message.
+func readNDEFFile(c types.Channel) ([]byte, error) {
+	if err := selectNDEFFile(c, ndefFileID); err != nil {
+		return nil, err
+	}
+
+	return readSizedFile(c, 2)
+}
+
+// readSizedFile reads the currently selected file, starting with its 2 bytes length.
+// headerSize is added to the length to get the file size: 2 for the NDEF file NLEN, 0 for the capability container CCLEN.
+func readSizedFile(c types.Channel, headerSize int) ([]byte, error) {
+	nlen, err := readBinary(c, 0, 2)
 	if err != nil {
-		return "", nil, err
+		return nil, err
+	}
+
+	if len(nlen) != 2 {
+		return nil, errInvalidNDEFLength
+	}
+
+	length := int(binary.BigEndian.Uint16(nlen)) + headerSize
+	if length < 2 {
+		return nil, errInvalidNDEFLength
+	}
+
+	data := append([]byte{}, nlen...)
+	for len(data) < length {
+		n := length - len(data)
+		if n > ndefReadChunkSize {
+			n = ndefReadChunkSize
+		}
+
+		chunk, err := readBinary(c, uint16(len(data)), uint8(n))
+		if err != nil {
+			return nil, err
+		}
+
+		if len(chunk) == 0 {
+			return nil, errEmptyReadBinary
+		}
+
+		data = append(data, chunk...)
 	}
 
-	msg := ndef.NewMessageFromRecords(ndef.NewURIRecord(url))
-	msgBuf, err := msg.Marshal()
+	return data, nil
+}
+
+// StoreNDEF stores the NDEF file content data with the Keycard applet NDEF capability
+// and reads it back to check the update.
+func (s *Session) StoreNDEF(data []byte) error {
+	if !s.cmdSet.ApplicationInfo.HasNDEFCapability() {
+		return errNoNDEFCapability
+	}
+
+	logger.Info("store NDEF record", "data", fmt.Sprintf("0x%x", data))
+	if err := s.cmdSet.StoreData(keycard.P1StoreDataNDEF, data); err != nil {
+		logger.Error("store NDEF record failed", "error", err)
+		return err
+	}
+
+	logger.Info("read back NDEF record")
+	stored, err := s.cmdSet.GetData(keycard.P1StoreDataNDEF)
 	if err != nil {
-		return "", nil, err
+		logger.Error("read back NDEF record failed", "error", err)
+		return err
 	}
 
-	buf := make([]byte, len(msgBuf)+2)
-	binary.BigEndian.PutUint16(buf[0:], uint16(len(msgBuf)))
-	copy(buf[2:], msgBuf)
+	if !bytes.Equal(stored, data) {
+		return fmt.Errorf("%w: read 0x%x, expected 0x%x", errNDEFRecordMismatch, stored, data)
+	}
 
-	return url, buf, nil
+	return nil
 }
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/hsanjuan/go-ndef"
+	"github.com/status-im/keycard-go/types"
+)
+
+const (
+	tagNDEFFileControl = 0x04
+
+	// ndefCCMinLength is the length of a capability container with a single NDEF file control TLV.
+	ndefCCMinLength = 15
+)
+
+var (
+	ndefCCFileID = []byte{0xE1, 0x03}
+
+	errInvalidNDEFCapabilityContainer = errors.New("invalid NDEF capability container")
+)
+
+var ndefTNFNames = map[byte]string{
+	ndef.Empty:                 "empty",
+	ndef.NFCForumWellKnownType: "well-known",
+	ndef.MediaType:             "media",
+	ndef.AbsoluteURI:           "absolute URI",
+	ndef.NFCForumExternalType:  "external",
+	ndef.Unknown:               "unknown",
+	ndef.Unchanged:             "unchanged",
+	ndef.Reserved:              "reserved",
+}
+
+// NDEFCapabilityContainer is the capability container file of the NDEF Type 4 tag application.
+type NDEFCapabilityContainer struct {
+	MappingVersion byte   `json:"mappingVersion"`
+	MaxReadSize    uint16 `json:"maxReadSize"`
+	MaxWriteSize   uint16 `json:"maxWriteSize"`
+	NDEFFileID     string `json:"ndefFileID"`
+	// MaxNDEFSize is the size of the NDEF file, including the 2 bytes NLEN.
+	MaxNDEFSize uint16 `json:"maxNDEFSize"`
+	ReadAccess  byte   `json:"readAccess"`
+	WriteAccess byte   `json:"writeAccess"`
+
+	fileID []byte
+}
+
+// NDEFRecordInfo is a decoded NDEF record.
+type NDEFRecordInfo struct {
+	TNF     byte   `json:"tnf"`
+	TNFName string `json:"tnfName"`
+	Type    string `json:"type"`
+	ID      string `json:"id,omitempty"`
+	// Payload is the decoded payload. URI prefixes are expanded.
+	Payload    string `json:"payload"`
+	PayloadHex string `json:"payloadHex"`
+}
+
+// NDEFContent is the content of the NDEF Type 4 tag application.
+type NDEFContent struct {
+	CapabilityContainer *NDEFCapabilityContainer `json:"capabilityContainer"`
+	// Message is the NDEF message in hex, without the NLEN.
+	Message string            `json:"message"`
+	Records []*NDEFRecordInfo `json:"records"`
+
+	message []byte
+}
+
+// readNDEFCapabilityContainer selects the NDEF Type 4 tag application and reads the capability container.
+func readNDEFCapabilityContainer(c types.Channel) (*NDEFCapabilityContainer, error) {
+	if err := selectNDEFFile(c, ndefCCFileID); err != nil {
+		return nil, err
+	}
+
+	data, err := readSizedFile(c, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseNDEFCapabilityContainer(data)
+}
+
+// ndefFileSize returns the NDEF file size from the capability container, or the default Keycard size if it can't be read.
+func ndefFileSize(c types.Channel) int {
+	cc, err := readNDEFCapabilityContainer(c)
+	if err != nil {
+		logger.Warn("reading the NDEF capability container failed, using the default NDEF file size", "error", err)
+		return keycardNDEFFileSize
+	}
+
+	return int(cc.MaxNDEFSize)
+}
+
+func parseNDEFCapabilityContainer(data []byte) (*NDEFCapabilityContainer, error) {
+	if len(data) < ndefCCMinLength || data[7] != tagNDEFFileControl || data[8] < 6 {
+		return nil, fmt.Errorf("%w: 0x%x", errInvalidNDEFCapabilityContainer, data)
+	}
+
+	cc := &NDEFCapabilityContainer{
+		MappingVersion: data[2],
+		MaxReadSize:    binary.BigEndian.Uint16(data[3:5]),
+		MaxWriteSize:   binary.BigEndian.Uint16(data[5:7]),
+		MaxNDEFSize:    binary.BigEndian.Uint16(data[11:13]),
+		ReadAccess:     data[13],
+		WriteAccess:    data[14],
+		fileID:         append([]byte{}, data[9:11]...),
+	}
+	cc.NDEFFileID = fmt.Sprintf("%x", cc.fileID)
+
+	return cc, nil
+}
+
+// readNDEFContent reads the capability container and the NDEF file it references, and decodes the NDEF message.
+func readNDEFContent(c types.Channel) (*NDEFContent, error) {
+	cc, err := readNDEFCapabilityContainer(c)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = selectNDEFFile(c, cc.fileID); err != nil {
+		return nil, err
+	}
+
+	data, err := readSizedFile(c, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	content := &NDEFContent{
+		CapabilityContainer: cc,
+		Message:             hex.EncodeToString(data[2:]),
+		Records:             []*NDEFRecordInfo{},
+		message:             data[2:],
+	}
+
+	if len(content.message) == 0 {
+		return content, nil
+	}
+
+	content.Records, err = decodeNDEFMessage(content.message)
+	if err != nil {
+		return nil, err
+	}
+
+	return content, nil
+}
+
+// decodeNDEFMessage parses an NDEF message with go-ndef.
+func decodeNDEFMessage(data []byte) ([]*NDEFRecordInfo, error) {
+	msg := &ndef.Message{}
+	if _, err := msg.Unmarshal(data); err != nil {
+		return nil, fmt.Errorf("error parsing NDEF message: %v", err)
+	}
+
+	records := make([]*NDEFRecordInfo, 0, len(msg.Records))
+	for _, r := range msg.Records {
+		info := &NDEFRecordInfo{
+			TNF:     r.TNF(),
+			TNFName: ndefTNFNames[r.TNF()],
+			Type:    r.Type(),
+			ID:      r.ID(),
+		}
+
+		payload, err := r.Payload()
+		if err != nil {
+			return nil, err
+		}
+
+		if payload != nil {
+			info.Payload = payload.String()
+			info.PayloadHex = hex.EncodeToString(payload.Marshal())
+		}
+
+		records = append(records, info)
+	}
+
+	return records, nil
+}
+
+func (n *NDEFContent) String() string {
+	var buf bytes.Buffer
+	cc := n.CapabilityContainer
+	fmt.Fprintf(&buf, "Capability container:\n")
+	fmt.Fprintf(&buf, "  Mapping version: %d.%d\n", cc.MappingVersion>>4, cc.MappingVersion&0x0F)
+	fmt.Fprintf(&buf, "  NDEF file: 0x%s\n", cc.NDEFFileID)
+	fmt.Fprintf(&buf, "  Max NDEF size: %d\n", cc.MaxNDEFSize)
+	fmt.Fprintf(&buf, "  Read access: 0x%02x\n", cc.ReadAccess)
+	fmt.Fprintf(&buf, "  Write access: 0x%02x\n", cc.WriteAccess)
+
+	if len(n.Records) == 0 {
+		fmt.Fprintf(&buf, "NDEF message: empty\n")
+		return buf.String()
+	}
+
+	fmt.Fprintf(&buf, "NDEF message: 0x%s\n", n.Message)
+	for i, r := range n.Records {
+		fmt.Fprintf(&buf, "Record %d:\n", i)
+		fmt.Fprintf(&buf, "  TNF: %d (%s)\n", r.TNF, r.TNFName)
+		fmt.Fprintf(&buf, "  Type: %s\n", r.Type)
+		if r.ID != "" {
+			fmt.Fprintf(&buf, "  ID: %s\n", r.ID)
+		}
+		fmt.Fprintf(&buf, "  Payload: %s\n", r.Payload)
+		fmt.Fprintf(&buf, "  Payload (hex): 0x%s\n", r.PayloadHex)
+	}
+
+	return buf.String()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseNDEFCapabilityContainer(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		cc   *NDEFCapabilityContainer
+		err  error
+	}{
+		{
+			name: "keycard",
+			data: "000f20007f007f0406e1040400008f",
+			cc: &NDEFCapabilityContainer{
+				MappingVersion: 0x20,
+				MaxReadSize:    0x7f,
+				MaxWriteSize:   0x7f,
+				NDEFFileID:     "e104",
+				MaxNDEFSize:    0x400,
+				ReadAccess:     0x00,
+				WriteAccess:    0x8f,
+			},
+		},
+		{name: "too short", data: "000f20007f007f0406e104040000", err: errInvalidNDEFCapabilityContainer},
+		{name: "not a NDEF file control", data: "000f20007f007f0506e1040400008f", err: errInvalidNDEFCapabilityContainer},
+		{name: "short file control", data: "000f20007f007f0405e1040400008f", err: errInvalidNDEFCapabilityContainer},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cc, err := parseNDEFCapabilityContainer(mustHex(t, test.data))
+			if !errors.Is(err, test.err) {
+				t.Fatalf("expected %v, got %v", test.err, err)
+			}
+
+			if test.cc == nil {
+				return
+			}
+
+			if !bytes.Equal(cc.fileID, mustHex(t, cc.NDEFFileID)) {
+				t.Fatalf("unexpected file ID %x", cc.fileID)
+			}
+
+			cc.fileID = nil
+			if !reflect.DeepEqual(cc, test.cc) {
+				t.Fatalf("expected %+v, got %+v", test.cc, cc)
+			}
+		})
+	}
+}
+
+func TestDecodeNDEFMessage(t *testing.T) {
+	// a URI record with the https://www. prefix, followed by a text record
+	records, err := decodeNDEFMessage(mustHex(t, "91010c55026578616d706c652e636f6d"+"5101085402656e68656c6c6f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+
+	if r := records[0]; r.TNFName != "well-known" || r.Type != "U" || r.Payload != "https://www.example.com" {
+		t.Fatalf("unexpected URI record %+v", r)
+	}
+
+	if r := records[1]; r.Type != "T" || r.Payload != "hello" {
+		t.Fatalf("unexpected text record %+v", r)
+	}
+
+	if _, err = decodeNDEFMessage(mustHex(t, "d1010955")); err == nil {
+		t.Fatal("expected an error decoding a truncated message")
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hsanjuan/go-ndef"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	NDEFRecordURI         = "uri"
+	NDEFRecordText        = "text"
+	NDEFRecordAAR         = "aar"
+	NDEFRecordMIME        = "mime"
+	NDEFRecordSmartPoster = "smartposter"
+
+	// aarType is the external type of the Android Application Records.
+	aarType = "android.com:pkg"
+
+	// keycardNDEFFileSize is the size of the NDEF file shared by the Keycard and NDEF applets, including the NLEN.
+	keycardNDEFFileSize = 512
+
+	defaultNDEFTextLanguage = "en"
+)
+
+var (
+	errEmptyNDEFSpec      = errors.New("the NDEF spec has no records")
+	errUnknownNDEFRecord  = errors.New("unknown NDEF record type")
+	errInvalidNDEFRecord  = errors.New("invalid NDEF record")
+	errNDEFRecordTooLarge = errors.New("the NDEF message is too large")
+)
+
+// NDEFRecordSpec defines an NDEF record. The uri, text and title fields are templates
+// accepting the same variables as the -ndef flag. Only uri is HTML escaped, like -ndef.
+type NDEFRecordSpec struct {
+	// Type is one of "uri", "text", "aar", "mime" and "smartposter".
+	Type string `json:"type" yaml:"type"`
+	// URI is the URI of uri and smartposter records.
+	URI string `json:"uri,omitempty" yaml:"uri,omitempty"`
+	// Text is the text of text records.
+	Text string `json:"text,omitempty" yaml:"text,omitempty"`
+	// Title is the optional title of smartposter records.
+	Title string `json:"title,omitempty" yaml:"title,omitempty"`
+	// Lang is the language code of text records and smartposter titles. It defaults to "en".
+	Lang string `json:"lang,omitempty" yaml:"lang,omitempty"`
+	// Package is the Android package name of aar records.
+	Package string `json:"package,omitempty" yaml:"package,omitempty"`
+	// MIME is the media type of mime records, with the payload in Data or DataHex.
+	MIME    string `json:"mime,omitempty" yaml:"mime,omitempty"`
+	Data    string `json:"data,omitempty" yaml:"data,omitempty"`
+	DataHex string `json:"dataHex,omitempty" yaml:"dataHex,omitempty"`
+}
+
+// NDEFSpec defines the records of an NDEF message.
+type NDEFSpec struct {
+	Records []*NDEFRecordSpec `json:"records" yaml:"records"`
+	// HMACSecret is the local secret used to compute the hmac template variable.
+	HMACSecret []byte `json:"-" yaml:"-"`
+}
+
+// LoadNDEFSpec reads an NDEFSpec from the YAML or JSON file at path.
+func LoadNDEFSpec(path string) (*NDEFSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	spec := &NDEFSpec{}
+	// JSON is valid YAML
+	if err = yaml.Unmarshal(data, spec); err != nil {
+		return nil, fmt.Errorf("error parsing NDEF spec: %v", err)
+	}
+
+	return spec, nil
+}
+
+// ParseNDEFRecordFlag parses the -ndef-record flag value:
+//
+//	uri:URI
+//	text:LANG:TEXT
+//	aar:PACKAGE
+//	mime:TYPE:DATA
+//	smartposter:LANG:TITLE:URI
+func ParseNDEFRecordFlag(value string) (*NDEFRecordSpec, error) {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("%w: %s", errInvalidNDEFRecord, value)
+	}
+
+	r := &NDEFRecordSpec{Type: strings.ToLower(parts[0])}
+	switch r.Type {
+	case NDEFRecordURI:
+		r.URI = parts[1]
+	case NDEFRecordAAR:
+		r.Package = parts[1]
+	case NDEFRecordText, NDEFRecordMIME:
+		fields := strings.SplitN(parts[1], ":", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%w: %s", errInvalidNDEFRecord, value)
+		}
+
+		if r.Type == NDEFRecordText {
+			r.Lang, r.Text = fields[0], fields[1]
+		} else {
+			r.MIME, r.Data = fields[0], fields[1]
+		}
+	case NDEFRecordSmartPoster:
+		fields := strings.SplitN(parts[1], ":", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%w: %s", errInvalidNDEFRecord, value)
+		}
+
+		r.Lang, r.Title, r.URI = fields[0], fields[1], fields[2]
+	default:
+		return nil, fmt.Errorf("%w: %s", errUnknownNDEFRecord, parts[0])
+	}
+
+	return r, nil
+}
+
+// Validate checks the records without expanding the templates.
+func (s *NDEFSpec) Validate() error {
+	if len(s.Records) == 0 {
+		return errEmptyNDEFSpec
+	}
+
+	for i, r := range s.Records {
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("record %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+func (r *NDEFRecordSpec) validate() error {
+	var missing string
+
+	switch strings.ToLower(r.Type) {
+	case NDEFRecordURI, NDEFRecordSmartPoster:
+		if r.URI == "" {
+			missing = "uri"
+		}
+	case NDEFRecordText:
+		if r.Text == "" {
+			missing = "text"
+		}
+	case NDEFRecordAAR:
+		if r.Package == "" {
+			missing = "package"
+		}
+	case NDEFRecordMIME:
+		if r.MIME == "" {
+			missing = "mime"
+		}
+
+		if r.Data != "" && r.DataHex != "" {
+			return fmt.Errorf("%w: only one of data and dataHex can be specified", errInvalidNDEFRecord)
+		}
+
+		if _, err := hex.DecodeString(strings.TrimPrefix(r.DataHex, "0x")); err != nil {
+			return fmt.Errorf("%w: invalid dataHex: %v", errInvalidNDEFRecord, err)
+		}
+	default:
+		return fmt.Errorf("%w: %s", errUnknownNDEFRecord, r.Type)
+	}
+
+	if missing != "" {
+		return fmt.Errorf("%w: %s records need the %s field", errInvalidNDEFRecord, r.Type, missing)
+	}
+
+	return nil
+}
+
+// Build expands the templates with vars and returns the NDEF file content: the 2 bytes NLEN followed by the message.
+// It fails if the content is larger than maxSize.
+func (s *NDEFSpec) Build(vars interface{}, maxSize int) ([]byte, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+
+	records := make([]*ndef.Record, 0, len(s.Records))
+	for i, r := range s.Records {
+		record, err := r.build(vars)
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %w", i, err)
+		}
+
+		records = append(records, record)
+	}
+
+	msgBuf, err := ndef.NewMessageFromRecords(records...).Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, len(msgBuf)+2)
+	binary.BigEndian.PutUint16(buf[0:], uint16(len(msgBuf)))
+	copy(buf[2:], msgBuf)
+
+	if len(buf) > maxSize {
+		return nil, fmt.Errorf("%w: %d bytes, the NDEF file can hold %d bytes", errNDEFRecordTooLarge, len(buf), maxSize)
+	}
+
+	return buf, nil
+}
+
+func (r *NDEFRecordSpec) build(vars interface{}) (*ndef.Record, error) {
+	lang := r.Lang
+	if lang == "" {
+		lang = defaultNDEFTextLanguage
+	}
+
+	switch strings.ToLower(r.Type) {
+	case NDEFRecordURI:
+		uri, err := buildURL(r.URI, vars)
+		if err != nil {
+			return nil, err
+		}
+
+		return ndef.NewURIRecord(uri), nil
+	case NDEFRecordText:
+		text, err := buildText(r.Text, vars)
+		if err != nil {
+			return nil, err
+		}
+
+		return ndef.NewTextRecord(text, lang), nil
+	case NDEFRecordAAR:
+		return ndef.NewExternalRecord(aarType, []byte(r.Package)), nil
+	case NDEFRecordMIME:
+		payload := []byte(r.Data)
+		if r.DataHex != "" {
+			payload, _ = hex.DecodeString(strings.TrimPrefix(r.DataHex, "0x"))
+		}
+
+		return ndef.NewMediaRecord(r.MIME, payload), nil
+	case NDEFRecordSmartPoster:
+		uri, err := buildURL(r.URI, vars)
+		if err != nil {
+			return nil, err
+		}
+
+		records := []*ndef.Record{ndef.NewURIRecord(uri)}
+		if r.Title != "" {
+			title, err := buildText(r.Title, vars)
+			if err != nil {
+				return nil, err
+			}
+
+			records = append(records, ndef.NewTextRecord(title, lang))
+		}
+
+		return ndef.NewSmartPosterRecord(ndef.NewMessageFromRecords(records...)), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", errUnknownNDEFRecord, r.Type)
+	}
+}
+
+func (s *NDEFSpec) String() string {
+	descriptions := make([]string, 0, len(s.Records))
+	for _, r := range s.Records {
+		descriptions = append(descriptions, r.String())
+	}
+
+	return strings.Join(descriptions, ", ")
+}
+
+func (r *NDEFRecordSpec) String() string {
+	switch strings.ToLower(r.Type) {
+	case NDEFRecordURI:
+		return fmt.Sprintf("uri %q", r.URI)
+	case NDEFRecordText:
+		return fmt.Sprintf("text %q", r.Text)
+	case NDEFRecordAAR:
+		return fmt.Sprintf("aar %q", r.Package)
+	case NDEFRecordMIME:
+		return fmt.Sprintf("mime %q", r.MIME)
+	case NDEFRecordSmartPoster:
+		return fmt.Sprintf("smartposter %q", r.URI)
+	default:
+		return r.Type
+	}
+}
+
+// ndefRecordFlags collects the repeated -ndef-record flags.
+type ndefRecordFlags []*NDEFRecordSpec
+
+func (f *ndefRecordFlags) String() string {
+	return fmt.Sprintf("%d records", len(*f))
+}
+
+func (f *ndefRecordFlags) Set(value string) error {
+	r, err := ParseNDEFRecordFlag(value)
+	if err != nil {
+		return err
+	}
+
+	*f = append(*f, r)
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	keycard "github.com/status-im/keycard-go"
+	"github.com/status-im/keycard-go/types"
+)
+
+const (
+	// ndefHMACTagSize is the size of the HMAC-SHA256 truncated tag exposed by the hmac variable.
+	ndefHMACTagSize = 16
+
+	instanceUIDSize  = 16
+	publicKeySize    = 65
+	maxAppletVersion = "255.255"
+)
+
+var (
+	errNDEFHMACBeforeInit = errors.New("the hmac NDEF variable needs the instance UID, set the record with ndef set after init")
+)
+
+// LoadNDEFHMACSecret reads the secret used to compute the hmac NDEF template variable from the file at path.
+func LoadNDEFHMACSecret(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	secret := bytes.TrimSpace(data)
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("empty NDEF HMAC secret in %s", path)
+	}
+
+	return secret, nil
+}
+
+// buildNDEFRecordWithAppletData selects the Keycard and cash applets and builds the NDEF record from spec.
+func buildNDEFRecordWithAppletData(c types.Channel, instanceIndex int, spec *NDEFSpec, maxSize int) ([]byte, error) {
+	vars, err := ndefTemplateVars(c, instanceIndex, spec.HMACSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	return spec.Build(vars, maxSize)
+}
+
+// ndefTemplateVars returns the variables of the NDEF templates, read from the Keycard and cash applets:
+//
+//	cashAddress     the address of the cash applet key
+//	cashPublicKey   the cash applet public key in hex
+//	instanceUID     the Keycard instance UID in hex
+//	keycardVersion  the Keycard applet version, like 3.0
+//	keyUIDHash      the SHA-256 of the key UID in hex
+//	hmac            the HMAC-SHA256 of the instance UID and the cash public key, truncated to 16 bytes, in hex
+//
+// instanceUID, keycardVersion and keyUIDHash are empty until the Keycard applet is initialized,
+// and keyUIDHash until a key is loaded. hmac is only defined when a secret is specified and the applet is initialized.
+func ndefTemplateVars(c types.Channel, instanceIndex int, hmacSecret []byte) (map[string]string, error) {
+	vars := map[string]string{
+		"instanceUID":    "",
+		"keycardVersion": "",
+		"keyUIDHash":     "",
+	}
+
+	var instanceUID []byte
+	kc, err := newInstanceChannel(c, instanceIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	cmdSet := keycard.NewCommandSet(kc)
+	logger.Info("selecting keycard applet")
+	if err = cmdSet.Select(); err != nil {
+		logger.Warn("error selecting keycard applet, the keycard variables are empty", "error", err)
+	} else if info := cmdSet.ApplicationInfo; info.Initialized {
+		instanceUID = info.InstanceUID
+		vars["instanceUID"] = hex.EncodeToString(info.InstanceUID)
+		vars["keycardVersion"] = appletVersion(info.Version)
+
+		if len(info.KeyUID) > 0 {
+			keyUIDHash := sha256.Sum256(info.KeyUID)
+			vars["keyUIDHash"] = hex.EncodeToString(keyUIDHash[:])
+		}
+	}
+
+	cashCmdSet := keycard.NewCashCommandSet(c)
+	logger.Info("selecting cash applet")
+	err = cashCmdSet.Select()
+	if err != nil {
+		logger.Error("error selecting cash applet", "error", err)
+		return nil, err
+	}
+
+	info := cashCmdSet.CashApplicationInfo
+	logger.Info("parsing cash applet public key", "public key", fmt.Sprintf("0x%x", info.PublicKey))
+	ecdsaPubKey, err := crypto.UnmarshalPubkey(info.PublicKey)
+	if err != nil {
+		logger.Error("error parsing cash applet public key", "error", err)
+		return nil, err
+	}
+
+	address := crypto.PubkeyToAddress(*ecdsaPubKey)
+	logger.Info("deriving cash applet address", "address", address.String())
+	vars["cashAddress"] = address.String()
+	vars["cashPublicKey"] = hex.EncodeToString(info.PublicKey)
+
+	if len(hmacSecret) > 0 && len(instanceUID) > 0 {
+		vars["hmac"] = ndefHMACTag(hmacSecret, instanceUID, info.PublicKey)
+	}
+
+	return vars, nil
+}
+
+// ndefHMACTag returns the truncated HMAC-SHA256 of the instance UID followed by the cash public key.
+func ndefHMACTag(secret []byte, instanceUID []byte, cashPublicKey []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(instanceUID)
+	mac.Write(cashPublicKey)
+	return hex.EncodeToString(mac.Sum(nil)[:ndefHMACTagSize])
+}
+
+// placeholderNDEFTemplateVars returns values as long as the ones of ndefTemplateVars at install time,
+// to check the NDEF record size before touching the card. hmac is not defined since the applet is not initialized.
+func placeholderNDEFTemplateVars() map[string]string {
+	return map[string]string{
+		"cashAddress":    common.Address{}.String(),
+		"cashPublicKey":  strings.Repeat("0", publicKeySize*2),
+		"instanceUID":    strings.Repeat("0", instanceUIDSize*2),
+		"keycardVersion": maxAppletVersion,
+		"keyUIDHash":     strings.Repeat("0", sha256.Size*2),
+	}
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+)
+
+// auditOperationPolicy is the audit log operation of the policy decisions.
+const auditOperationPolicy = "policy"
+
+var (
+	errRequestDenied = errors.New("request denied by policy")
+)
+
+var (
+	// selectorTransfer, selectorApprove and selectorTransferFrom are the ERC-20 methods whose amount
+	// is checked against maxTokenAmount.
+	selectorTransfer     = []byte{0xa9, 0x05, 0x9c, 0xbb}
+	selectorApprove      = []byte{0x09, 0x5e, 0xa7, 0xb3}
+	selectorTransferFrom = []byte{0x23, 0xb8, 0x72, 0xdd}
+)
+
+// PolicyChainID is a chain ID given as a JSON number or as a decimal or hex string.
+type PolicyChainID uint64
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (id *PolicyChainID) UnmarshalJSON(data []byte) error {
+	var v math.HexOrDecimal64
+	if len(data) > 0 && data[0] == '"' {
+		if err := json.Unmarshal(data, &v); err != nil {
+			return err
+		}
+	} else if err := v.UnmarshalText(data); err != nil {
+		return err
+	}
+
+	*id = PolicyChainID(v)
+	return nil
+}
+
+// PolicySelector is a 4 bytes method selector in hex, like "0xa9059cbb".
+type PolicySelector []byte
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (sel *PolicySelector) UnmarshalText(text []byte) error {
+	data, err := hex.DecodeString(strings.TrimPrefix(string(text), "0x"))
+	if err != nil || len(data) != 4 {
+		return fmt.Errorf("invalid method selector %q", text)
+	}
+
+	*sel = data
+	return nil
+}
+
+// PolicyRule matches signing requests. Empty fields match any request, except for the calldata,
+// the contract creations and the typed data that are only allowed by a rule explicitly listing them.
+type PolicyRule struct {
+	Methods    []string              `json:"methods"`
+	Paths      []string              `json:"paths"`
+	ChainIDs   []PolicyChainID       `json:"chainIds"`
+	To         []common.Address      `json:"to"`
+	MaxValue   *math.HexOrDecimal256 `json:"maxValue"`
+	DailyLimit *math.HexOrDecimal256 `json:"dailyLimit"`
+	// Selectors are the contract methods that transactions with calldata can call.
+	Selectors []PolicySelector `json:"selectors"`
+	// MaxTokenAmount limits the amount of the ERC-20 transfer, approve and transferFrom calls.
+	// TokenRecipients limits their recipient, or spender for approve.
+	MaxTokenAmount  *math.HexOrDecimal256 `json:"maxTokenAmount"`
+	TokenRecipients []common.Address      `json:"tokenRecipients"`
+	// Create allows contract creation transactions.
+	Create bool `json:"create"`
+	// VerifyingContracts and PrimaryTypes are the EIP-712 domain verifying contracts and primary types
+	// of the typed data that can be signed. Typed data is only signed by a rule with at least one of them.
+	VerifyingContracts []common.Address `json:"verifyingContracts"`
+	PrimaryTypes       []string         `json:"primaryTypes"`
+}
+
+// PolicyConfig is the content of the policy file.
+type PolicyConfig struct {
+	// Deny rules are checked first, a matching request is always refused.
+	Deny []PolicyRule `json:"deny"`
+	// Allow rules are checked next, a matching request within the rule limits is signed.
+	Allow []PolicyRule `json:"allow"`
+	// Interactive asks for a confirmation on the TTY for requests not matching any rule.
+	// Otherwise those requests are refused.
+	Interactive bool `json:"interactive"`
+}
+
+// SignRequest describes a signing request submitted to the policy.
+type SignRequest struct {
+	Method  string
+	Account common.Address
+	Path    string
+	Hash    []byte
+	ChainID *big.Int
+	To      *common.Address
+	Value   *big.Int
+	// Data is the transaction calldata. Create is true for contract creation transactions.
+	Data   []byte
+	Create bool
+	// TypedData is set for EIP-712 requests.
+	TypedData *TypedDataRequest
+}
+
+// TypedDataRequest describes the EIP-712 data of a signing request.
+type TypedDataRequest struct {
+	DomainName        string
+	VerifyingContract *common.Address
+	PrimaryType       string
+}
+
+func (r *SignRequest) String() string {
+	s := fmt.Sprintf("method: %s\naccount: %s (%s)\nhash: 0x%x\n", r.Method, r.Account.String(), r.Path, r.Hash)
+	if r.ChainID != nil {
+		s += fmt.Sprintf("chain ID: %s\n", r.ChainID)
+	}
+	if r.To != nil {
+		s += fmt.Sprintf("to: %s\n", r.To.String())
+	}
+	if r.Value != nil {
+		s += fmt.Sprintf("value: %s wei\n", r.Value)
+	}
+	if r.Create {
+		s += "contract creation\n"
+	}
+	if len(r.Data) > 0 {
+		s += fmt.Sprintf("data: 0x%x\n", r.Data)
+	}
+	if td := r.TypedData; td != nil {
+		s += fmt.Sprintf("typed data: %s (domain %q", td.PrimaryType, td.DomainName)
+		if td.VerifyingContract != nil {
+			s += fmt.Sprintf(", verifying contract %s", td.VerifyingContract.String())
+		}
+		s += ")\n"
+	}
+
+	return s
+}
+
+// Policy decides whether signing requests are allowed, keeping track of
+// the value signed by each account during the current day.
+type Policy struct {
+	mu sync.Mutex
+	// promptMu serializes the TTY confirmations, asked without holding mu.
+	promptMu    sync.Mutex
+	config      *PolicyConfig
+	auditLog    *AuditLog
+	day         string
+	dailyTotals map[common.Address]*big.Int
+}
+
+// LoadPolicy reads the policy from the JSON file at path.
+// Each decision is recorded in auditLog as a policy entry, and the daily totals are restored from its entries.
+// auditLog can be nil.
+func LoadPolicy(path string, auditLog *AuditLog) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &PolicyConfig{}
+	if err = json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("error parsing policy file: %v", err)
+	}
+
+	p := &Policy{
+		config:      config,
+		auditLog:    auditLog,
+		day:         today(),
+		dailyTotals: make(map[common.Address]*big.Int),
+	}
+
+	if err = p.restoreDailyTotals(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Check returns nil if the request can be signed.
+// The other requests are not blocked while a request waits for the TTY confirmation.
+func (p *Policy) Check(req *SignRequest) error {
+	p.mu.Lock()
+	p.resetDay()
+	allowed, reason := p.evaluate(req)
+	if allowed {
+		p.addToDailyTotal(req)
+	}
+	p.mu.Unlock()
+
+	if !allowed && p.config.Interactive {
+		p.promptMu.Lock()
+		confirmed, err := confirmOnTTY(fmt.Sprintf("%s\nsign request outside policy (%s)", req, reason))
+		p.promptMu.Unlock()
+		if err != nil {
+			logger.Error("interactive confirmation failed", "error", err)
+		}
+		if confirmed {
+			allowed, reason = true, "confirmed on TTY"
+			p.mu.Lock()
+			p.resetDay()
+			p.addToDailyTotal(req)
+			p.mu.Unlock()
+		} else {
+			reason = "rejected on TTY"
+		}
+	}
+
+	decision := "denied"
+	if allowed {
+		decision = "allowed"
+	}
+
+	logger.Info("policy decision", "method", req.Method, "account", req.Account.String(), "decision", decision, "reason", reason)
+	if err := p.audit(req, decision, reason); err != nil {
+		logger.Error("error updating the audit log", "error", err)
+		return err
+	}
+
+	if !allowed {
+		return fmt.Errorf("%w: %s", errRequestDenied, reason)
+	}
+
+	return nil
+}
+
+func (p *Policy) resetDay() {
+	if d := today(); d != p.day {
+		p.day = d
+		p.dailyTotals = make(map[common.Address]*big.Int)
+	}
+}
+
+func (p *Policy) addToDailyTotal(req *SignRequest) {
+	if req.Value != nil {
+		p.dailyTotal(req.Account).Add(p.dailyTotal(req.Account), req.Value)
+	}
+}
+
+func (p *Policy) evaluate(req *SignRequest) (bool, string) {
+	for i, rule := range p.config.Deny {
+		if rule.matches(req) {
+			return false, fmt.Sprintf("deny rule %d", i)
+		}
+	}
+
+	reason := "no allow rule matches"
+	for i, rule := range p.config.Allow {
+		if !rule.matches(req) {
+			continue
+		}
+
+		if denied := rule.checkContent(req); denied != "" {
+			reason = fmt.Sprintf("allow rule %d: %s", i, denied)
+			continue
+		}
+
+		value := req.Value
+		if value == nil {
+			value = new(big.Int)
+		}
+
+		if rule.MaxValue != nil && value.Cmp((*big.Int)(rule.MaxValue)) > 0 {
+			reason = fmt.Sprintf("allow rule %d: value above limit", i)
+			continue
+		}
+
+		if rule.DailyLimit != nil {
+			total := new(big.Int).Add(p.dailyTotal(req.Account), value)
+			if total.Cmp((*big.Int)(rule.DailyLimit)) > 0 {
+				reason = fmt.Sprintf("allow rule %d: daily limit exceeded", i)
+				continue
+			}
+		}
+
+		return true, fmt.Sprintf("allow rule %d", i)
+	}
+
+	return false, reason
+}
+
+// checkContent returns why the rule doesn't allow the calldata, contract creation or typed data of req,
+// or an empty string if it does.
+func (r *PolicyRule) checkContent(req *SignRequest) string {
+	if req.Create {
+		if !r.Create {
+			return "contract creation not allowed"
+		}
+		return ""
+	}
+
+	if td := req.TypedData; td != nil {
+		if len(r.VerifyingContracts) == 0 && len(r.PrimaryTypes) == 0 {
+			return "typed data not allowed"
+		}
+		return ""
+	}
+
+	if len(req.Data) == 0 {
+		return ""
+	}
+
+	if len(r.Selectors) == 0 {
+		return "calldata not allowed"
+	}
+
+	return r.checkTokenAmount(req.Data)
+}
+
+// checkTokenAmount checks the amount and recipient of the ERC-20 transfer, approve and transferFrom calls.
+func (r *PolicyRule) checkTokenAmount(data []byte) string {
+	if r.MaxTokenAmount == nil && len(r.TokenRecipients) == 0 {
+		return ""
+	}
+
+	var recipient, amount []byte
+	selector := data[:4]
+	args := data[4:]
+	switch {
+	case bytes.Equal(selector, selectorTransfer), bytes.Equal(selector, selectorApprove):
+		if len(args) != 64 {
+			return "malformed token call"
+		}
+		recipient, amount = args[12:32], args[32:64]
+	case bytes.Equal(selector, selectorTransferFrom):
+		if len(args) != 96 {
+			return "malformed token call"
+		}
+		recipient, amount = args[44:64], args[64:96]
+	default:
+		return ""
+	}
+
+	if r.MaxTokenAmount != nil && new(big.Int).SetBytes(amount).Cmp((*big.Int)(r.MaxTokenAmount)) > 0 {
+		return "token amount above limit"
+	}
+
+	if len(r.TokenRecipients) > 0 && !containsAddress(r.TokenRecipients, common.BytesToAddress(recipient)) {
+		return "token recipient not allowed"
+	}
+
+	return ""
+}
+
+func (r *PolicyRule) matches(req *SignRequest) bool {
+	if len(r.Methods) > 0 && !containsString(r.Methods, req.Method) {
+		return false
+	}
+
+	if len(r.Paths) > 0 && !containsString(r.Paths, req.Path) {
+		return false
+	}
+
+	if len(r.ChainIDs) > 0 {
+		if req.ChainID == nil {
+			return false
+		}
+
+		found := false
+		for _, id := range r.ChainIDs {
+			if req.ChainID.Cmp(new(big.Int).SetUint64(uint64(id))) == 0 {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(r.To) > 0 && (req.To == nil || !containsAddress(r.To, *req.To)) {
+		return false
+	}
+
+	if len(r.Selectors) > 0 {
+		if len(req.Data) < 4 {
+			return false
+		}
+
+		found := false
+		for _, sel := range r.Selectors {
+			if bytes.Equal(sel, req.Data[:4]) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if td := req.TypedData; td != nil {
+		if len(r.VerifyingContracts) > 0 && (td.VerifyingContract == nil || !containsAddress(r.VerifyingContracts, *td.VerifyingContract)) {
+			return false
+		}
+
+		if len(r.PrimaryTypes) > 0 && !containsString(r.PrimaryTypes, td.PrimaryType) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (p *Policy) dailyTotal(account common.Address) *big.Int {
+	total, ok := p.dailyTotals[account]
+	if !ok {
+		total = new(big.Int)
+		p.dailyTotals[account] = total
+	}
+
+	return total
+}
+
+// audit appends the decision to the audit log. The details are the ones read by restoreDailyTotals.
+func (p *Policy) audit(req *SignRequest, decision string, reason string) error {
+	ctx := []interface{}{"method", req.Method, "account", req.Account.String(), "path", req.Path, "hash", fmt.Sprintf("%x", req.Hash)}
+	if req.ChainID != nil {
+		ctx = append(ctx, "chainId", req.ChainID.String())
+	}
+	if req.To != nil {
+		ctx = append(ctx, "to", req.To.String())
+	}
+	if req.Value != nil {
+		ctx = append(ctx, "value", req.Value.String())
+	}
+	ctx = append(ctx, "decision", decision, "reason", reason)
+
+	return p.auditLog.Append(auditOperationPolicy, "", ctx...)
+}
+
+// restoreDailyTotals adds the values of the requests allowed today to the daily totals.
+func (p *Policy) restoreDailyTotals() error {
+	if p.auditLog == nil {
+		return nil
+	}
+
+	entries, err := p.auditLog.Entries()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.Operation != auditOperationPolicy || entry.Details["decision"] != "allowed" || entry.Time.UTC().Format("2006-01-02") != p.day {
+			continue
+		}
+
+		value, ok := new(big.Int).SetString(entry.Details["value"], 10)
+		if !ok {
+			continue
+		}
+
+		account := common.HexToAddress(entry.Details["account"])
+		p.dailyTotal(account).Add(p.dailyTotal(account), value)
+	}
+
+	return nil
+}
+
+// confirmOnTTY prints the description on the controlling terminal and waits for a yes/no answer.
+func confirmOnTTY(description string) (bool, error) {
+	answer, err := askOnTTY(description + "\nsign? [y/N]")
+	if err != nil {
+		return false, err
+	}
+
+	answer = strings.ToLower(answer)
+
+	return answer == "y" || answer == "yes", nil
+}
+
+func today() string {
+	return time.Now().UTC().Format("2006-01-02")
+}
+
+func containsAddress(list []common.Address, address common.Address) bool {
+	for _, item := range list {
+		if item == address {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
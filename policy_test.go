@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+var (
+	testAccount   = common.HexToAddress("0x1111111111111111111111111111111111111111")
+	testRecipient = common.HexToAddress("0x2222222222222222222222222222222222222222")
+	testBlocked   = common.HexToAddress("0x3333333333333333333333333333333333333333")
+	testToken     = common.HexToAddress("0x4444444444444444444444444444444444444444")
+)
+
+func newTestPolicy(t *testing.T, config string, auditLog *AuditLog) *Policy {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := LoadPolicy(path, auditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+// tokenCall returns the calldata of an ERC-20 call with an address and an amount argument.
+func tokenCall(selector []byte, to common.Address, amount int64) []byte {
+	data := append([]byte{}, selector...)
+	data = append(data, common.LeftPadBytes(to.Bytes(), 32)...)
+	return append(data, common.LeftPadBytes(big.NewInt(amount).Bytes(), 32)...)
+}
+
+func TestPolicyCheck(t *testing.T) {
+	config := `{
+		"deny": [{"to": ["0x3333333333333333333333333333333333333333"]}],
+		"allow": [
+			{"methods": ["eth_signTransaction"], "chainIds": [1, "0x5"], "maxValue": "1000"},
+			{"methods": ["eth_signTransaction"], "to": ["0x4444444444444444444444444444444444444444"], "selectors": ["0xa9059cbb"],
+			 "maxTokenAmount": "500", "tokenRecipients": ["0x2222222222222222222222222222222222222222"]},
+			{"methods": ["eth_signTransaction"], "chainIds": [10], "create": true},
+			{"methods": ["eth_signTypedData_v4"], "primaryTypes": ["Permit"]}
+		]
+	}`
+
+	tests := []struct {
+		name    string
+		req     *SignRequest
+		allowed bool
+	}{
+		{
+			name:    "value within limit",
+			req:     &SignRequest{Method: "eth_signTransaction", ChainID: big.NewInt(1), To: &testRecipient, Value: big.NewInt(1000)},
+			allowed: true,
+		},
+		{
+			name:    "chain ID given as hex string",
+			req:     &SignRequest{Method: "eth_signTransaction", ChainID: big.NewInt(5), To: &testRecipient, Value: big.NewInt(1)},
+			allowed: true,
+		},
+		{
+			name: "value above limit",
+			req:  &SignRequest{Method: "eth_signTransaction", ChainID: big.NewInt(1), To: &testRecipient, Value: big.NewInt(1001)},
+		},
+		{
+			name: "chain not allowed",
+			req:  &SignRequest{Method: "eth_signTransaction", ChainID: big.NewInt(137), To: &testRecipient, Value: big.NewInt(1)},
+		},
+		{
+			name: "deny rule",
+			req:  &SignRequest{Method: "eth_signTransaction", ChainID: big.NewInt(1), To: &testBlocked, Value: big.NewInt(1)},
+		},
+		{
+			name: "method not allowed",
+			req:  &SignRequest{Method: "eth_sign", ChainID: big.NewInt(1), To: &testRecipient},
+		},
+		{
+			name: "calldata without selector rule",
+			req:  &SignRequest{Method: "eth_signTransaction", ChainID: big.NewInt(1), To: &testRecipient, Data: []byte{0xde, 0xad, 0xbe, 0xef}},
+		},
+		{
+			name:    "token transfer within limit",
+			req:     &SignRequest{Method: "eth_signTransaction", To: &testToken, Data: tokenCall(selectorTransfer, testRecipient, 500)},
+			allowed: true,
+		},
+		{
+			name: "token amount above limit",
+			req:  &SignRequest{Method: "eth_signTransaction", To: &testToken, Data: tokenCall(selectorTransfer, testRecipient, 501)},
+		},
+		{
+			name: "token recipient not allowed",
+			req:  &SignRequest{Method: "eth_signTransaction", To: &testToken, Data: tokenCall(selectorTransfer, testAccount, 1)},
+		},
+		{
+			name: "selector not allowed",
+			req:  &SignRequest{Method: "eth_signTransaction", To: &testToken, Data: tokenCall(selectorApprove, testRecipient, 1)},
+		},
+		{
+			name: "malformed token call",
+			req:  &SignRequest{Method: "eth_signTransaction", To: &testToken, Data: selectorTransfer},
+		},
+		{
+			name: "contract creation not allowed",
+			req:  &SignRequest{Method: "eth_signTransaction", ChainID: big.NewInt(1), Create: true, Data: []byte{0x60, 0x80}},
+		},
+		{
+			name:    "contract creation allowed",
+			req:     &SignRequest{Method: "eth_signTransaction", ChainID: big.NewInt(10), Create: true, Data: []byte{0x60, 0x80}},
+			allowed: true,
+		},
+		{
+			name:    "typed data primary type allowed",
+			req:     &SignRequest{Method: "eth_signTypedData_v4", TypedData: &TypedDataRequest{PrimaryType: "Permit"}},
+			allowed: true,
+		},
+		{
+			name: "typed data primary type not allowed",
+			req:  &SignRequest{Method: "eth_signTypedData_v4", TypedData: &TypedDataRequest{PrimaryType: "Order"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTestPolicy(t, config, nil)
+			test.req.Account = testAccount
+
+			err := p.Check(test.req)
+			if test.allowed && err != nil {
+				t.Fatalf("expected allowed, got %v", err)
+			}
+			if !test.allowed && !errors.Is(err, errRequestDenied) {
+				t.Fatalf("expected %v, got %v", errRequestDenied, err)
+			}
+		})
+	}
+}
+
+func TestPolicyDailyLimit(t *testing.T) {
+	config := `{"allow": [{"dailyLimit": "1000"}]}`
+	auditLog := NewAuditLog(filepath.Join(t.TempDir(), auditLogFileName), nil)
+	other := common.HexToAddress("0x5555555555555555555555555555555555555555")
+
+	p := newTestPolicy(t, config, auditLog)
+	steps := []struct {
+		account common.Address
+		value   int64
+		allowed bool
+	}{
+		{testAccount, 600, true},
+		{testAccount, 500, false},
+		{testAccount, 400, true},
+		{testAccount, 1, false},
+		{other, 1000, true},
+	}
+
+	for i, step := range steps {
+		err := p.Check(&SignRequest{Method: "eth_signTransaction", Account: step.account, Value: big.NewInt(step.value)})
+		if (err == nil) != step.allowed {
+			t.Fatalf("step %d: expected allowed %v, got %v", i, step.allowed, err)
+		}
+	}
+
+	// a new policy restores the totals from the audit log
+	restored := newTestPolicy(t, config, auditLog)
+	for account, total := range map[common.Address]int64{testAccount: 1000, other: 1000} {
+		if got := restored.dailyTotal(account); got.Cmp(big.NewInt(total)) != 0 {
+			t.Fatalf("restored total of %s: expected %d, got %s", account, total, got)
+		}
+	}
+
+	if err := restored.Check(&SignRequest{Method: "eth_signTransaction", Account: testAccount, Value: big.NewInt(1)}); !errors.Is(err, errRequestDenied) {
+		t.Fatalf("expected the restored daily limit to deny, got %v", err)
+	}
+
+	if _, err := auditLog.Verify(nil); err != nil {
+		t.Fatal(err)
+	}
+}
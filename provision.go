@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ebfe/scard"
+	"github.com/ethereum/go-ethereum/crypto"
+	keycard "github.com/status-im/keycard-go"
+	"github.com/status-im/keycard-go/identifiers"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	ProvisionStatusOK     = "ok"
+	ProvisionStatusFailed = "failed"
+
+	// manifestSecretsRef is the secrets reference of the cards initialized with the manifest secrets.
+	manifestSecretsRef = "manifest"
+	defaultSecretsDir  = "secrets"
+)
+
+var (
+	errMissingManifestCap     = errors.New("the provisioning manifest must specify a cap file")
+	errIncompleteSecrets      = errors.New("the manifest secrets must specify the pin, the puk and the pairing password")
+	errKeyUIDMismatch         = errors.New("the card key UID doesn't match the generated key")
+	errUnknownProvisionFormat = errors.New("unknown provisioning output format")
+	errMissingProvisionOutput = errors.New("the provisioning manifest must specify an output file")
+	errOverwriteNotAcked      = errors.New("overwrite deletes the keys on the cards, set overwriteKeysBackedUp to acknowledge it")
+)
+
+// ProvisionSecrets are the secrets used to initialize every card of a batch.
+type ProvisionSecrets struct {
+	PIN             string `yaml:"pin"`
+	PUK             string `yaml:"puk"`
+	PairingPassword string `yaml:"pairingPassword"`
+}
+
+// ProvisionManifest defines how a batch of cards is provisioned.
+// Relative paths are relative to the manifest directory.
+type ProvisionManifest struct {
+	Cap string `yaml:"cap"`
+	// Overwrite deletes the installed applets and their keys. OverwriteKeysBackedUp must be set too,
+	// to acknowledge that the keys of the batch cards are backed up or can be lost.
+	Overwrite             bool `yaml:"overwrite"`
+	OverwriteKeysBackedUp bool `yaml:"overwriteKeysBackedUp"`
+	// NDEF is a URL template like the -ndef flag. NDEFSpec is a file like the -ndef-spec flag.
+	// The record is set at install time, so the hmac variable can't be used.
+	NDEF     string `yaml:"ndef"`
+	NDEFSpec string `yaml:"ndefSpec"`
+	// GPKeys is a JSON file like the -gp-keys flag. If not specified the GP key flags are used.
+	GPKeys string `yaml:"gpKeys"`
+	// Secrets are used for every card. If not specified, random secrets are generated for each card
+	// and written to SecretsDir.
+	Secrets     *ProvisionSecrets `yaml:"secrets"`
+	SecretsDir  string            `yaml:"secretsDir"`
+	GenerateKey bool              `yaml:"generateKey"`
+	// Output is the results file. Format is "csv" or "json", by default the output file extension.
+	Output string `yaml:"output"`
+	Format string `yaml:"format"`
+	// Count is the number of cards to provision. 0 provisions cards until interrupted.
+	Count int `yaml:"count"`
+}
+
+// LoadProvisionManifest reads a ProvisionManifest from the YAML or JSON file at path.
+func LoadProvisionManifest(path string) (*ProvisionManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &ProvisionManifest{}
+	if err = yaml.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("error parsing provisioning manifest: %v", err)
+	}
+
+	dir := filepath.Dir(path)
+	for _, p := range []*string{&m.Cap, &m.NDEFSpec, &m.GPKeys, &m.SecretsDir, &m.Output} {
+		if *p != "" && !filepath.IsAbs(*p) {
+			*p = filepath.Join(dir, *p)
+		}
+	}
+
+	if m.SecretsDir == "" {
+		m.SecretsDir = filepath.Join(dir, defaultSecretsDir)
+	}
+
+	if m.Format == "" {
+		m.Format = filepath.Ext(m.Output)
+		if len(m.Format) > 0 {
+			m.Format = m.Format[1:]
+		}
+	}
+
+	return m, m.Validate()
+}
+
+// Validate checks the manifest fields.
+func (m *ProvisionManifest) Validate() error {
+	if m.Cap == "" {
+		return errMissingManifestCap
+	}
+
+	if m.Output == "" {
+		return errMissingProvisionOutput
+	}
+
+	if m.Overwrite && !m.OverwriteKeysBackedUp {
+		return errOverwriteNotAcked
+	}
+
+	if m.Format != "csv" && m.Format != "json" {
+		return fmt.Errorf("%w: %q", errUnknownProvisionFormat, m.Format)
+	}
+
+	if m.Secrets != nil && (m.Secrets.PIN == "" || m.Secrets.PUK == "" || m.Secrets.PairingPassword == "") {
+		return errIncompleteSecrets
+	}
+
+	return nil
+}
+
+// LoadNDEFSpec returns the NDEF records defined by NDEFSpec and NDEF, or nil if none is defined.
+func (m *ProvisionManifest) LoadNDEFSpec() (*NDEFSpec, error) {
+	spec := &NDEFSpec{}
+	if m.NDEFSpec != "" {
+		var err error
+		if spec, err = LoadNDEFSpec(m.NDEFSpec); err != nil {
+			return nil, err
+		}
+	}
+
+	if m.NDEF != "" {
+		spec.Records = append([]*NDEFRecordSpec{{Type: NDEFRecordURI, URI: m.NDEF}}, spec.Records...)
+	}
+
+	if len(spec.Records) == 0 {
+		return nil, nil
+	}
+
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+
+	return spec, nil
+}
+
+// ProvisionResult is the result row written for each provisioned card.
+type ProvisionResult struct {
+	Time        time.Time `json:"time"`
+	Reader      string    `json:"reader"`
+	InstanceUID string    `json:"instanceUID"`
+	KeyUID      string    `json:"keyUID"`
+	CashAddress string    `json:"cashAddress"`
+	// SecretsRef is the file with the generated secrets, or "manifest" for the manifest secrets.
+	SecretsRef string `json:"secretsRef"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Provisioner installs, initializes and verifies the cards of a batch.
+type Provisioner struct {
+	manifest *ProvisionManifest
+	gpKeys   *GPKeyConfig
+	ndefSpec *NDEFSpec
+	inv      *Inventory
+	auditLog *AuditLog
+}
+
+// NewProvisioner returns a Provisioner for manifest. The NDEF spec, the inventory and the audit log can be nil.
+func NewProvisioner(manifest *ProvisionManifest, gpKeys *GPKeyConfig, ndefSpec *NDEFSpec, inv *Inventory, auditLog *AuditLog) *Provisioner {
+	return &Provisioner{
+		manifest: manifest,
+		gpKeys:   gpKeys,
+		ndefSpec: ndefSpec,
+		inv:      inv,
+		auditLog: auditLog,
+	}
+}
+
+// Provision installs, initializes and verifies the card in reader.
+// The returned result reports the failed step, if any.
+func (p *Provisioner) Provision(card *scard.Card, reader string) *ProvisionResult {
+	return p.ProvisionWithProgress(card, reader, func(string) {})
+}
+
+// ProvisionWithProgress is like Provision, calling progress before each step.
+func (p *Provisioner) ProvisionWithProgress(card *scard.Card, reader string, progress func(step string)) *ProvisionResult {
+	res := &ProvisionResult{
+		Time:   time.Now().UTC(),
+		Reader: reader,
+		Status: ProvisionStatusFailed,
+	}
+
+	step := func(name string) {
+		logger.Info("provisioning", "reader", reader, "step", name)
+		progress(name)
+	}
+
+	fail := func(failedStep string, err error) *ProvisionResult {
+		logger.Error("provisioning failed", "reader", reader, "step", failedStep, "error", err)
+		res.Error = fmt.Sprintf("%s: %v", failedStep, err)
+		return res
+	}
+
+	step("install")
+	if err := p.install(card, reader); err != nil {
+		return fail("install", err)
+	}
+
+	step("init")
+	secrets, err := p.secrets()
+	if err != nil {
+		return fail("init", err)
+	}
+
+	// the secrets are stored before init, so they are not lost if the card is initialized and a later step fails
+	if res.SecretsRef, err = p.storePendingSecrets(secrets); err != nil {
+		return fail("store secrets", err)
+	}
+
+	initializer := NewInitializer(card, identifiers.KeycardDefaultInstanceIndex)
+	if err = initializer.InitWithSecrets(secrets); err != nil {
+		return fail("init", err)
+	}
+
+	info, _, err := initializer.Info()
+	if err != nil {
+		return fail("init", err)
+	}
+	res.InstanceUID = hex.EncodeToString(info.InstanceUID)
+
+	if res.SecretsRef, err = p.storeSecrets(res.SecretsRef, info.InstanceUID, secrets); err != nil {
+		return fail("store secrets", err)
+	}
+
+	var keyUID []byte
+	if p.manifest.GenerateKey {
+		step("generate key")
+		if keyUID, err = generateKey(card, secrets); err != nil {
+			return fail("generate key", err)
+		}
+
+		// the temporary pairing is removed once the key is generated, so it's only recorded here
+		err = p.auditLog.Append("generate-key", res.InstanceUID, "reader", reader, "keyUID", hex.EncodeToString(keyUID), "temporaryPairing", true)
+		if err != nil {
+			notRecorded(res, "audit log", err)
+		}
+	}
+
+	step("verify")
+	if err = p.verify(initializer, keyUID, res); err != nil {
+		return fail("verify", err)
+	}
+
+	res.Status = ProvisionStatusOK
+
+	err = p.auditLog.Append("provision", res.InstanceUID, "reader", reader, "keyUID", res.KeyUID, "cashAddress", res.CashAddress,
+		"capFile", filepath.Base(p.manifest.Cap), "generateKey", p.manifest.GenerateKey)
+	if err != nil {
+		notRecorded(res, "audit log", err)
+	}
+
+	if p.inv != nil {
+		rec := readInventoryRecord(card, p.gpKeys, identifiers.KeycardDefaultInstanceIndex, InventoryOperationProvision)
+		rec.CapFile = filepath.Base(p.manifest.Cap)
+		if err = p.inv.Append(rec); err != nil {
+			notRecorded(res, "inventory", err)
+		}
+	}
+
+	return res
+}
+
+// notRecorded reports a record-keeping error in res without failing the provisioning, since the card is provisioned.
+func notRecorded(res *ProvisionResult, log string, err error) {
+	logger.Error("provisioning succeeded, not recorded", "reader", res.Reader, "log", log, "error", err)
+	res.Error = fmt.Sprintf("succeeded, not recorded in the %s: %v", log, err)
+}
+
+func (p *Provisioner) install(card *scard.Card, reader string) error {
+	f, err := os.Open(p.manifest.Cap)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	i := NewInstaller(card, p.gpKeys, identifiers.KeycardDefaultInstanceIndex)
+	if p.manifest.Overwrite {
+		if err = p.recordWipedKeys(i, f, reader); err != nil {
+			return err
+		}
+	}
+
+	_, err = i.Install(f, p.manifest.Overwrite, true, true, true, p.ndefSpec)
+	return err
+}
+
+// recordWipedKeys logs and audits the keys of the Keycard instances deleted by the overwrite, before deleting them.
+func (p *Provisioner) recordWipedKeys(i *Installer, capFile *os.File, reader string) error {
+	plan, err := i.PlanInstall(capFile, true, true, true, true, p.ndefSpec)
+	if err != nil {
+		return err
+	}
+
+	keys, err := i.KeyInfo(plan.KeycardInstances(), nil)
+	if err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		instanceUID := hex.EncodeToString(k.InstanceUID)
+		keyUID := hex.EncodeToString(k.KeyUID)
+		logger.Warn("overwriting keycard instance", "reader", reader, "instance", fmt.Sprintf("%x", k.InstanceAID), "instanceUID", instanceUID, "keyUID", keyUID)
+		if err = p.auditLog.Append("provision-overwrite", instanceUID, "reader", reader, "keyUID", keyUID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *Provisioner) secrets() (*keycard.Secrets, error) {
+	if s := p.manifest.Secrets; s != nil {
+		return keycard.NewSecrets(s.PIN, s.PUK, s.PairingPassword), nil
+	}
+
+	return keycard.GenerateSecrets()
+}
+
+// storePendingSecrets writes the generated secrets to a temporary file of the secrets directory and returns its path,
+// or manifestSecretsRef if the manifest secrets are used.
+func (p *Provisioner) storePendingSecrets(secrets *keycard.Secrets) (string, error) {
+	if p.manifest.Secrets != nil {
+		return manifestSecretsRef, nil
+	}
+
+	if err := os.MkdirAll(p.manifest.SecretsDir, 0700); err != nil {
+		return "", err
+	}
+
+	f, err := os.CreateTemp(p.manifest.SecretsDir, "pending-*.json")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if err = writeSecrets(f, nil, secrets); err != nil {
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+// storeSecrets adds the instance UID to the pending secrets file and renames it INSTANCE_UID.json.
+// It returns the new path, or the pending one if it fails.
+func (p *Provisioner) storeSecrets(pending string, instanceUID []byte, secrets *keycard.Secrets) (string, error) {
+	if pending == manifestSecretsRef {
+		return pending, nil
+	}
+
+	f, err := os.OpenFile(pending, os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return pending, err
+	}
+	defer f.Close()
+
+	if err = writeSecrets(f, instanceUID, secrets); err != nil {
+		return pending, err
+	}
+
+	path := filepath.Join(p.manifest.SecretsDir, fmt.Sprintf("%x.json", instanceUID))
+	if err = os.Rename(pending, path); err != nil {
+		return pending, err
+	}
+
+	return path, nil
+}
+
+// writeSecrets writes the secrets as JSON to f and syncs it. instanceUID is omitted if empty.
+func writeSecrets(f *os.File, instanceUID []byte, secrets *keycard.Secrets) error {
+	content := map[string]string{
+		"pin":             secrets.Pin(),
+		"puk":             secrets.Puk(),
+		"pairingPassword": secrets.PairingPass(),
+	}
+
+	if len(instanceUID) > 0 {
+		content["instanceUID"] = hex.EncodeToString(instanceUID)
+	}
+
+	data, err := json.MarshalIndent(content, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(data); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+// generateKey generates a key with a temporary pairing and returns its key UID.
+func generateKey(card *scard.Card, secrets *keycard.Secrets) ([]byte, error) {
+	s := NewSession(card)
+	err := s.Open(&SessionCredentials{
+		PIN:         secrets.Pin(),
+		PairingPass: secrets.PairingPass(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	logger.Info("generate key")
+	return s.CommandSet().GenerateKey()
+}
+
+// verify re-selects the Keycard and Cash applets and fills the result.
+func (p *Provisioner) verify(initializer *Initializer, keyUID []byte, res *ProvisionResult) error {
+	info, cashInfo, err := initializer.Info()
+	if err != nil {
+		return err
+	}
+
+	if !info.Initialized {
+		return errCardNotInitialized
+	}
+
+	if p.manifest.GenerateKey && !bytes.Equal(info.KeyUID, keyUID) {
+		return fmt.Errorf("%w: 0x%x, generated 0x%x", errKeyUIDMismatch, info.KeyUID, keyUID)
+	}
+	res.KeyUID = hex.EncodeToString(info.KeyUID)
+
+	if !cashInfo.Installed {
+		return ErrCashNotInstalled
+	}
+
+	ecdsaPubKey, err := crypto.UnmarshalPubkey(cashInfo.PublicKey)
+	if err != nil {
+		return err
+	}
+	res.CashAddress = crypto.PubkeyToAddress(*ecdsaPubKey).String()
+
+	return nil
+}
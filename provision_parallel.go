@@ -0,0 +1,284 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ebfe/scard"
+)
+
+const (
+	// statusTableRefresh is the interval between two redraws of the live status table.
+	statusTableRefresh = 500 * time.Millisecond
+
+	// cardPollTimeout is how long a worker waits for a card before checking if the count is reached.
+	cardPollTimeout = time.Second
+)
+
+// readerStatus is the row of a reader in the live status table.
+type readerStatus struct {
+	card       int
+	step       string
+	lastResult string
+	ok         int
+	failed     int
+}
+
+// ProvisionStatusTable tracks the current step of each reader.
+type ProvisionStatusTable struct {
+	mu      sync.Mutex
+	readers map[string]*readerStatus
+	dirty   bool
+}
+
+// NewProvisionStatusTable returns a status table with a row for each reader.
+func NewProvisionStatusTable(readers []string) *ProvisionStatusTable {
+	t := &ProvisionStatusTable{
+		readers: make(map[string]*readerStatus),
+		dirty:   true,
+	}
+
+	for _, r := range readers {
+		t.readers[r] = &readerStatus{step: "waiting for card"}
+	}
+
+	return t
+}
+
+func (t *ProvisionStatusTable) update(reader string, fn func(s *readerStatus)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	fn(t.readers[reader])
+	t.dirty = true
+}
+
+// SetStep sets the current step of reader.
+func (t *ProvisionStatusTable) SetStep(reader string, step string) {
+	t.update(reader, func(s *readerStatus) {
+		s.step = step
+	})
+}
+
+// SetResult records the result of the last card provisioned in reader.
+func (t *ProvisionStatusTable) SetResult(reader string, res *ProvisionResult) {
+	t.update(reader, func(s *readerStatus) {
+		if res.Status == ProvisionStatusOK {
+			s.ok++
+			s.lastResult = fmt.Sprintf("ok %s", res.InstanceUID)
+		} else {
+			s.failed++
+			s.lastResult = fmt.Sprintf("failed: %s", res.Error)
+		}
+	})
+}
+
+// Render writes the table to w if it changed since the last call. clear clears the terminal before.
+func (t *ProvisionStatusTable) Render(w io.Writer, clear bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.dirty {
+		return
+	}
+	t.dirty = false
+
+	readers := make([]string, 0, len(t.readers))
+	for r := range t.readers {
+		readers = append(readers, r)
+	}
+	sort.Strings(readers)
+
+	if clear {
+		fmt.Fprint(w, "\033[H\033[2J")
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "READER\tCARD\tSTEP\tOK\tFAILED\tLAST RESULT")
+	for _, r := range readers {
+		s := t.readers[r]
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%d\t%d\t%s\n", r, s.card, s.step, s.ok, s.failed, s.lastResult)
+	}
+	tw.Flush()
+}
+
+// ParallelProvisioner runs a provisioning worker for each reader.
+type ParallelProvisioner struct {
+	p      *Provisioner
+	status *ProvisionStatusTable
+
+	mu       sync.Mutex
+	cards    int
+	maxCards int
+}
+
+// NewParallelProvisioner returns a ParallelProvisioner provisioning up to count cards, or until interrupted if count is 0.
+func NewParallelProvisioner(p *Provisioner, status *ProvisionStatusTable, count int) *ParallelProvisioner {
+	return &ParallelProvisioner{
+		p:        p,
+		status:   status,
+		maxCards: count,
+	}
+}
+
+// nextCard returns the number of the next card, or 0 if the count is reached.
+func (pp *ParallelProvisioner) nextCard() int {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	if pp.maxCards > 0 && pp.cards >= pp.maxCards {
+		return 0
+	}
+
+	pp.cards++
+	return pp.cards
+}
+
+// finished returns true when all the cards have been started.
+func (pp *ParallelProvisioner) finished() bool {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	return pp.maxCards > 0 && pp.cards >= pp.maxCards
+}
+
+// Run starts a worker for each reader and sends the results to results, then closes it when all the workers are done.
+// An error in a worker only stops that worker.
+func (pp *ParallelProvisioner) Run(readers []string, results chan<- *ProvisionResult) {
+	var wg sync.WaitGroup
+	for _, reader := range readers {
+		wg.Add(1)
+		go func(reader string) {
+			defer wg.Done()
+			if err := pp.runWorker(reader, results); err != nil {
+				logger.Error("provisioning worker stopped", "reader", reader, "error", err)
+				pp.status.SetStep(reader, fmt.Sprintf("stopped: %v", err))
+				return
+			}
+			pp.status.SetStep(reader, "done")
+		}(reader)
+	}
+
+	wg.Wait()
+	close(results)
+}
+
+// runWorker provisions the cards inserted in reader. Each worker uses its own PC/SC context.
+func (pp *ParallelProvisioner) runWorker(reader string, results chan<- *ProvisionResult) error {
+	ctx, err := scard.EstablishContext()
+	if err != nil {
+		return err
+	}
+	defer ctx.Release()
+
+	for {
+		pp.status.SetStep(reader, "waiting for card")
+		present, err := pp.waitForCard(ctx, reader)
+		if err != nil || !present {
+			return err
+		}
+
+		n := pp.nextCard()
+		if n == 0 {
+			return nil
+		}
+
+		pp.status.update(reader, func(s *readerStatus) {
+			s.card = n
+		})
+
+		results <- pp.provisionCard(ctx, reader)
+		if pp.finished() {
+			return nil
+		}
+
+		pp.status.SetStep(reader, "remove card")
+		removed, err := pp.waitForCardRemoval(ctx, reader)
+		if err != nil || !removed {
+			return err
+		}
+	}
+}
+
+// waitForCard waits for a card in reader. It returns false if all the cards have been started meanwhile.
+func (pp *ParallelProvisioner) waitForCard(ctx *scard.Context, reader string) (bool, error) {
+	rs := []scard.ReaderState{{
+		Reader:       reader,
+		CurrentState: scard.StateUnaware,
+	}}
+
+	for !pp.finished() {
+		err := ctx.GetStatusChange(rs, cardPollTimeout)
+		if err == scard.ErrTimeout {
+			continue
+		}
+
+		if err != nil {
+			return false, err
+		}
+
+		if rs[0].EventState&scard.StatePresent != 0 {
+			return true, nil
+		}
+
+		rs[0].CurrentState = rs[0].EventState
+	}
+
+	return false, nil
+}
+
+// waitForCardRemoval waits until the card is removed from reader.
+// It returns false if all the cards have been started meanwhile, so a card left in the reader doesn't block the worker.
+func (pp *ParallelProvisioner) waitForCardRemoval(ctx *scard.Context, reader string) (bool, error) {
+	rs := []scard.ReaderState{{
+		Reader:       reader,
+		CurrentState: scard.StateUnaware,
+	}}
+
+	for !pp.finished() {
+		err := ctx.GetStatusChange(rs, cardPollTimeout)
+		if err == scard.ErrTimeout {
+			continue
+		}
+
+		if err != nil {
+			return false, err
+		}
+
+		if rs[0].EventState&scard.StatePresent == 0 {
+			return true, nil
+		}
+
+		rs[0].CurrentState = rs[0].EventState
+	}
+
+	return false, nil
+}
+
+// provisionCard connects to the card in reader and provisions it. Panics are reported as failures.
+func (pp *ParallelProvisioner) provisionCard(ctx *scard.Context, reader string) (res *ProvisionResult) {
+	res = &ProvisionResult{Time: time.Now().UTC(), Reader: reader, Status: ProvisionStatusFailed}
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("provisioning panic", "reader", reader, "error", r)
+			res = &ProvisionResult{Time: time.Now().UTC(), Reader: reader, Status: ProvisionStatusFailed, Error: fmt.Sprintf("panic: %v", r)}
+		}
+		pp.status.SetResult(reader, res)
+	}()
+
+	pp.status.SetStep(reader, "connect")
+	card, err := ctx.Connect(reader, scard.ShareShared, scard.ProtocolAny)
+	if err != nil {
+		res.Error = fmt.Sprintf("connect: %v", err)
+		return res
+	}
+	defer card.Disconnect(scard.ResetCard)
+
+	return pp.p.ProvisionWithProgress(card, reader, func(step string) {
+		pp.status.SetStep(reader, step)
+	})
+}
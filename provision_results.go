@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"time"
+)
+
+var provisionCSVHeader = []string{"time", "reader", "instanceUID", "keyUID", "cashAddress", "secretsRef", "status", "error"}
+
+// ProvisionResultWriter appends the provisioning results to a CSV or JSON lines file.
+// Each result is flushed to disk before the next card is provisioned.
+type ProvisionResultWriter struct {
+	f      *os.File
+	format string
+	csv    *csv.Writer
+}
+
+// NewProvisionResultWriter opens the results file at path in append mode.
+// The CSV header is written if the file is empty.
+func NewProvisionResultWriter(path string, format string) (*ProvisionResultWriter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &ProvisionResultWriter{
+		f:      f,
+		format: format,
+	}
+
+	if format != "csv" {
+		return w, nil
+	}
+
+	w.csv = csv.NewWriter(f)
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if fi.Size() == 0 {
+		if err = w.writeCSV(provisionCSVHeader); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	return w, nil
+}
+
+// Write appends res to the results file.
+func (w *ProvisionResultWriter) Write(res *ProvisionResult) error {
+	if w.csv != nil {
+		return w.writeCSV([]string{
+			res.Time.Format(time.RFC3339),
+			res.Reader,
+			res.InstanceUID,
+			res.KeyUID,
+			res.CashAddress,
+			res.SecretsRef,
+			res.Status,
+			res.Error,
+		})
+	}
+
+	line, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+
+	if _, err = w.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	return w.f.Sync()
+}
+
+func (w *ProvisionResultWriter) writeCSV(record []string) error {
+	if err := w.csv.Write(record); err != nil {
+		return err
+	}
+
+	w.csv.Flush()
+	if err := w.csv.Error(); err != nil {
+		return err
+	}
+
+	return w.f.Sync()
+}
+
+// Close closes the results file.
+func (w *ProvisionResultWriter) Close() error {
+	return w.f.Close()
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/psbt"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	keycard "github.com/status-im/keycard-go"
+)
+
+const hardenedKeyStart = 0x80000000
+
+var (
+	errMissingUtxo             = errors.New("input has no utxo information")
+	errPSBTKeyMismatch         = errors.New("card public key does not match the PSBT derivation")
+	errUnsupportedTaproot      = errors.New("taproot inputs are not supported")
+	errUnexpectedWitnessScript = errors.New("input has a witness script but spends a non witness output")
+)
+
+// PSBTSigner defines a struct with methods to sign PSBT inputs with the keys of an open Keycard session.
+type PSBTSigner struct {
+	cmdSet      *keycard.CommandSet
+	fingerprint uint32
+	auditLog    *AuditLog
+}
+
+// NewPSBTSigner returns a new PSBTSigner. It exports the master public key to
+// compute the master fingerprint matched against the inputs BIP32 derivations.
+// Each signature is recorded in auditLog, that can be nil.
+func NewPSBTSigner(cmdSet *keycard.CommandSet, auditLog *AuditLog) (*PSBTSigner, error) {
+	logger.Info("export master public key")
+	_, pubKey, err := cmdSet.ExportKey(true, false, true, "m")
+	if err != nil {
+		logger.Error("export key failed", "error", err)
+		return nil, err
+	}
+
+	compressed, err := compressPubKey(pubKey)
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprint := binary.LittleEndian.Uint32(btcutil.Hash160(compressed)[:4])
+	logger.Info("master key fingerprint", "fingerprint", fmt.Sprintf("%08x", bip32Fingerprint(fingerprint)))
+
+	return &PSBTSigner{
+		cmdSet:      cmdSet,
+		fingerprint: fingerprint,
+		auditLog:    auditLog,
+	}, nil
+}
+
+// Sign adds a partial signature to every input of packet with a BIP32 derivation
+// matching the card master fingerprint. It returns the number of signatures added.
+func (s *PSBTSigner) Sign(packet *psbt.Packet) (int, error) {
+	updater, err := psbt.NewUpdater(packet)
+	if err != nil {
+		return 0, err
+	}
+
+	prevOuts, err := prevOutputs(packet)
+	if err != nil {
+		return 0, err
+	}
+
+	tx := packet.UnsignedTx
+	sigHashes := txscript.NewTxSigHashes(tx, txscript.NewMultiPrevOutFetcher(prevOuts))
+
+	signed := 0
+	for i := range packet.Inputs {
+		input := &packet.Inputs[i]
+		if len(input.FinalScriptSig) > 0 || len(input.FinalScriptWitness) > 0 {
+			logger.Debug("skipping finalized input", "index", i)
+			continue
+		}
+
+		for _, derivation := range input.Bip32Derivation {
+			if derivation.MasterKeyFingerprint != s.fingerprint {
+				continue
+			}
+
+			path := formatBip32Path(derivation.Bip32Path)
+			hash, err := inputSigHash(packet, i, sigHashes, prevOuts[tx.TxIn[i].PreviousOutPoint])
+			if err != nil {
+				return signed, fmt.Errorf("input %d: %v", i, err)
+			}
+
+			logger.Info("sign input", "index", i, "path", path, "hash", fmt.Sprintf("%x", hash))
+			sig, err := s.cmdSet.SignWithPath(hash, path)
+			if err != nil {
+				logger.Error("sign with path failed", "error", err)
+				return signed, err
+			}
+
+			// the derivation key is in the encoding of the input script, uncompressed for some legacy outputs
+			pubKey, err := encodePubKeyAs(sig.PubKey(), derivation.PubKey)
+			if err != nil {
+				return signed, err
+			}
+
+			if !bytes.Equal(pubKey, derivation.PubKey) {
+				return signed, fmt.Errorf("input %d: %w", i, errPSBTKeyMismatch)
+			}
+
+			instanceUID := fmt.Sprintf("%x", s.cmdSet.ApplicationInfo.InstanceUID)
+			err = s.auditLog.Append("sign", instanceUID, "method", "psbt", "input", i, "path", path, "hash", fmt.Sprintf("%x", hash))
+			if err != nil {
+				logger.Error("error updating the audit log", "error", err)
+				return signed, err
+			}
+
+			der, err := derSignature(sig.R(), sig.S())
+			if err != nil {
+				return signed, err
+			}
+
+			der = append(der, byte(inputSigHashType(input)))
+			if _, err = updater.Sign(i, der, pubKey, nil, nil); err != nil {
+				return signed, fmt.Errorf("input %d: %v", i, err)
+			}
+
+			signed++
+		}
+	}
+
+	return signed, nil
+}
+
+func inputSigHashType(input *psbt.PInput) txscript.SigHashType {
+	if input.SighashType == 0 {
+		return txscript.SigHashAll
+	}
+
+	return input.SighashType
+}
+
+// inputSigHash computes the legacy or segwit v0 sighash of the input at index i.
+func inputSigHash(packet *psbt.Packet, i int, sigHashes *txscript.TxSigHashes, prevOut *wire.TxOut) ([]byte, error) {
+	input := &packet.Inputs[i]
+	hashType := inputSigHashType(input)
+
+	if prevOut == nil {
+		return nil, errMissingUtxo
+	}
+
+	if txscript.IsPayToTaproot(prevOut.PkScript) {
+		return nil, errUnsupportedTaproot
+	}
+
+	// the presence of a witness utxo doesn't tell the input type: some PSBTs have one for legacy outputs
+	isWitness := txscript.IsWitnessProgram(prevOut.PkScript) || txscript.IsWitnessProgram(input.RedeemScript)
+	if !isWitness {
+		if len(input.WitnessScript) > 0 {
+			return nil, errUnexpectedWitnessScript
+		}
+
+		script := prevOut.PkScript
+		if len(input.RedeemScript) > 0 {
+			script = input.RedeemScript
+		}
+
+		return txscript.CalcSignatureHash(script, hashType, packet.UnsignedTx, i)
+	}
+
+	// for P2WPKH (native or nested in P2SH) CalcWitnessSigHash builds the script code from the witness program
+	script := prevOut.PkScript
+	switch {
+	case len(input.WitnessScript) > 0:
+		script = input.WitnessScript
+	case len(input.RedeemScript) > 0:
+		script = input.RedeemScript
+	}
+
+	return txscript.CalcWitnessSigHash(script, sigHashes, hashType, packet.UnsignedTx, i, prevOut.Value)
+}
+
+// prevOutputs returns the outputs spent by the packet inputs. It fails if an input has no utxo.
+func prevOutputs(packet *psbt.Packet) (map[wire.OutPoint]*wire.TxOut, error) {
+	prevOuts := make(map[wire.OutPoint]*wire.TxOut)
+	for i, txIn := range packet.UnsignedTx.TxIn {
+		input := &packet.Inputs[i]
+		outPoint := txIn.PreviousOutPoint
+
+		// the non witness utxo is checked against the outpoint, so it's preferred to the witness utxo
+		switch {
+		case input.NonWitnessUtxo != nil:
+			if input.NonWitnessUtxo.TxHash() != outPoint.Hash {
+				return nil, fmt.Errorf("input %d: non witness utxo does not match the previous outpoint", i)
+			}
+			if int(outPoint.Index) >= len(input.NonWitnessUtxo.TxOut) {
+				return nil, fmt.Errorf("input %d: previous outpoint index out of range", i)
+			}
+			prevOuts[outPoint] = input.NonWitnessUtxo.TxOut[outPoint.Index]
+		case input.WitnessUtxo != nil:
+			prevOuts[outPoint] = input.WitnessUtxo
+		default:
+			// every previous output is needed to compute the sighashes, even of the inputs not signed by the card
+			return nil, fmt.Errorf("input %d: %w", i, errMissingUtxo)
+		}
+	}
+
+	return prevOuts, nil
+}
+
+func compressPubKey(pubKey []byte) ([]byte, error) {
+	key, err := btcec.ParsePubKey(pubKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return key.SerializeCompressed(), nil
+}
+
+// encodePubKeyAs returns pubKey compressed or uncompressed like the key like.
+func encodePubKeyAs(pubKey []byte, like []byte) ([]byte, error) {
+	key, err := btcec.ParsePubKey(pubKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(like) == btcec.PubKeyBytesLenCompressed {
+		return key.SerializeCompressed(), nil
+	}
+
+	return key.SerializeUncompressed(), nil
+}
+
+// derSignature returns the DER encoding of the signature, normalized to a low S value.
+func derSignature(r, s []byte) ([]byte, error) {
+	var rScalar, sScalar btcec.ModNScalar
+	if overflow := rScalar.SetByteSlice(r); overflow {
+		return nil, errors.New("invalid signature R value")
+	}
+
+	if overflow := sScalar.SetByteSlice(s); overflow {
+		return nil, errors.New("invalid signature S value")
+	}
+
+	return ecdsa.NewSignature(&rScalar, &sScalar).Serialize(), nil
+}
+
+func formatBip32Path(path []uint32) string {
+	parts := []string{"m"}
+	for _, index := range path {
+		if index >= hardenedKeyStart {
+			parts = append(parts, fmt.Sprintf("%d'", index-hardenedKeyStart))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d", index))
+		}
+	}
+
+	return strings.Join(parts, "/")
+}
+
+// bip32Fingerprint returns the fingerprint in the big endian order used to display it.
+func bip32Fingerprint(fingerprint uint32) uint32 {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], fingerprint)
+	return binary.BigEndian.Uint32(buf[:])
+}
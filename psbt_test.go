@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcutil/psbt"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func testPacket(t *testing.T, txHex string) *psbt.Packet {
+	t.Helper()
+
+	tx := wire.NewMsgTx(wire.TxVersion)
+	if err := tx.Deserialize(bytes.NewReader(mustHex(t, txHex))); err != nil {
+		t.Fatal(err)
+	}
+
+	packet, err := psbt.NewFromUnsignedTx(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return packet
+}
+
+func TestInputSigHash(t *testing.T) {
+	// the native P2WPKH and P2SH-P2WPKH examples of BIP143
+	nativeTx := "0100000002fff7f7881a8099afa6940d42d1e7f6362bec38171ea3edf433541db4e4ad969f0000000000eeffffffef51e1b804cc89d182d279655c3aa89e815b1b309fe287d9b2b55d57b90ec68a0100000000ffffffff02202cb206000000001976a9148280b37df378db99f66f85c95a783a76ac7a6d5988ac9093510d000000001976a9143bde42dbee7e4dbe6a21b2d50ce2f0167faa815988ac11000000"
+	nestedTx := "0100000001db6b1b20aa0fd7b23880be2ecbd4a98130974cf4748fb66092ac4d3ceb1a54770100000000feffffff02b8b4eb0b000000001976a914a457b684d7f0d539a46a45bbc043f35b59d0d96388ac0008af2f000000001976a914fd270b1ee6abcaea97fea7ad0402e8bd8ad6d77c88ac92040000"
+	p2pkScript := "2103c9f4836b9a4f77fc0d81f7bcb01b7f1b35916864b9476c241ce9fc198bd25432ac"
+	p2pkhScript := "76a9141d0f172a0ecb48aee1be1f2687d2963ae33f71a188ac"
+
+	tests := []struct {
+		name          string
+		txHex         string
+		prevOuts      []*wire.TxOut
+		index         int
+		redeemScript  string
+		witnessScript string
+		witnessUtxo   bool
+		// expected is the sighash, or empty for the legacy sighash of the previous output script.
+		expected string
+		err      error
+	}{
+		{
+			name:     "BIP143 native P2WPKH",
+			txHex:    nativeTx,
+			prevOuts: []*wire.TxOut{{Value: 625000000, PkScript: mustHex(t, p2pkScript)}, {Value: 600000000, PkScript: mustHex(t, "00141d0f172a0ecb48aee1be1f2687d2963ae33f71a1")}},
+			index:    1,
+			expected: "c37af31116d1b27caf68aae9e3ac82f1477929014d5b917657d0eb49478cb670",
+		},
+		{
+			name:         "BIP143 P2SH-P2WPKH",
+			txHex:        nestedTx,
+			prevOuts:     []*wire.TxOut{{Value: 1000000000, PkScript: mustHex(t, "a9144733f37cf4db86fbc2efed2500b4f4e49f31202387")}},
+			redeemScript: "001479091972186c449eb1ded22b78e40d009bdf0089",
+			expected:     "64f3b0f4dd2bb3aa1ce8566d220cc74dda9df97d8490cc81d89d735c92e59fb6",
+		},
+		{
+			name:     "legacy P2PK",
+			txHex:    nativeTx,
+			prevOuts: []*wire.TxOut{{Value: 625000000, PkScript: mustHex(t, p2pkScript)}, {Value: 600000000, PkScript: mustHex(t, p2pkhScript)}},
+		},
+		{
+			name:        "legacy P2PKH with a witness utxo",
+			txHex:       nativeTx,
+			prevOuts:    []*wire.TxOut{{Value: 625000000, PkScript: mustHex(t, p2pkScript)}, {Value: 600000000, PkScript: mustHex(t, p2pkhScript)}},
+			index:       1,
+			witnessUtxo: true,
+		},
+		{
+			name:          "witness script on a legacy output",
+			txHex:         nativeTx,
+			prevOuts:      []*wire.TxOut{{Value: 625000000, PkScript: mustHex(t, p2pkScript)}, {Value: 600000000, PkScript: mustHex(t, p2pkhScript)}},
+			index:         1,
+			witnessScript: p2pkScript,
+			err:           errUnexpectedWitnessScript,
+		},
+		{
+			name:     "taproot",
+			txHex:    nativeTx,
+			prevOuts: []*wire.TxOut{{Value: 625000000, PkScript: mustHex(t, p2pkScript)}, {Value: 600000000, PkScript: mustHex(t, "5120"+p2pkScript[2:66])}},
+			index:    1,
+			err:      errUnsupportedTaproot,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			packet := testPacket(t, test.txHex)
+			tx := packet.UnsignedTx
+
+			prevOuts := make(map[wire.OutPoint]*wire.TxOut)
+			for i, prevOut := range test.prevOuts {
+				prevOuts[tx.TxIn[i].PreviousOutPoint] = prevOut
+			}
+
+			input := &packet.Inputs[test.index]
+			prevOut := test.prevOuts[test.index]
+			if test.witnessUtxo {
+				input.WitnessUtxo = prevOut
+			}
+			if test.redeemScript != "" {
+				input.RedeemScript = mustHex(t, test.redeemScript)
+			}
+			if test.witnessScript != "" {
+				input.WitnessScript = mustHex(t, test.witnessScript)
+			}
+
+			sigHashes := txscript.NewTxSigHashes(tx, txscript.NewMultiPrevOutFetcher(prevOuts))
+			hash, err := inputSigHash(packet, test.index, sigHashes, prevOut)
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("expected %v, got %v", test.err, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expected := mustHex(t, test.expected)
+			if test.expected == "" {
+				if expected, err = txscript.CalcSignatureHash(prevOut.PkScript, txscript.SigHashAll, tx, test.index); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if !bytes.Equal(hash, expected) {
+				t.Fatalf("expected sighash %x, got %x", expected, hash)
+			}
+		})
+	}
+}
+
+func TestPrevOutputs(t *testing.T) {
+	packet := testPacket(t, "0100000001db6b1b20aa0fd7b23880be2ecbd4a98130974cf4748fb66092ac4d3ceb1a54770100000000feffffff02b8b4eb0b000000001976a914a457b684d7f0d539a46a45bbc043f35b59d0d96388ac0008af2f000000001976a914fd270b1ee6abcaea97fea7ad0402e8bd8ad6d77c88ac92040000")
+	if _, err := prevOutputs(packet); !errors.Is(err, errMissingUtxo) {
+		t.Fatalf("expected %v, got %v", errMissingUtxo, err)
+	}
+
+	prevTx := wire.NewMsgTx(wire.TxVersion)
+	prevTx.AddTxOut(&wire.TxOut{Value: 1, PkScript: []byte{txscript.OP_TRUE}})
+	packet.Inputs[0].NonWitnessUtxo = prevTx
+	if _, err := prevOutputs(packet); err == nil {
+		t.Fatal("expected the non witness utxo not matching the outpoint to fail")
+	}
+}
+
+func TestEncodePubKeyAs(t *testing.T) {
+	key, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compressed := key.PubKey().SerializeCompressed()
+	uncompressed := key.PubKey().SerializeUncompressed()
+	for _, like := range [][]byte{compressed, uncompressed} {
+		for _, pubKey := range [][]byte{compressed, uncompressed} {
+			encoded, err := encodePubKeyAs(pubKey, like)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(encoded, like) {
+				t.Fatalf("expected %x, got %x", like, encoded)
+			}
+		}
+	}
+}
+
+func TestFormatBip32Path(t *testing.T) {
+	path := []uint32{hardenedKeyStart + 84, hardenedKeyStart, hardenedKeyStart, 0, 5}
+	if s := formatBip32Path(path); s != "m/84'/0'/0'/0/5" {
+		t.Fatalf("unexpected path %s", s)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	keycard "github.com/status-im/keycard-go"
+	"github.com/status-im/keycard-go/apdu"
+	"github.com/status-im/keycard-go/globalplatform"
+	"github.com/status-im/keycard-go/identifiers"
+	"github.com/status-im/keycard-go/types"
+)
+
+var (
+	errKeyNotBackedUp       = errors.New("the card has a key. Pass -key-backed-up to confirm it's backed up")
+	errConfirmationMismatch = errors.New("confirmation phrase does not match")
+)
+
+// CardKeyInfo describes the key of a Keycard instance shown before it's wiped.
+type CardKeyInfo struct {
+	InstanceAID []byte
+	InstanceUID []byte
+	KeyUID      []byte
+	// Address is the address of the first account. It's only known with an open session,
+	// otherwise AddressNote explains why it's missing.
+	Address     string
+	AddressNote string
+}
+
+// HasKey returns true if the instance has a key.
+func (k *CardKeyInfo) HasKey() bool {
+	return len(k.KeyUID) > 0
+}
+
+func (k *CardKeyInfo) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Keycard instance 0x%x:\n", k.InstanceAID)
+	fmt.Fprintf(&buf, "  InstanceUID: 0x%x\n", k.InstanceUID)
+	if k.HasKey() {
+		fmt.Fprintf(&buf, "  KeyUID: 0x%x\n", k.KeyUID)
+	} else {
+		fmt.Fprintf(&buf, "  KeyUID: no key\n")
+	}
+
+	if k.Address != "" {
+		fmt.Fprintf(&buf, "  First address (%s): %s\n", firstAccountPath, k.Address)
+	} else if k.HasKey() {
+		fmt.Fprintf(&buf, "  First address (%s): not shown, %s\n", firstAccountPath, k.AddressNote)
+	}
+
+	return buf.String()
+}
+
+// readCardKeyInfo selects the Keycard instance with the specified index. It returns nil if the instance is not installed.
+// If the instance has a key and credentials is not nil, a session is opened with the returned credentials to read the first address.
+func readCardKeyInfo(c types.Channel, index int, credentials func() *SessionCredentials) (*CardKeyInfo, error) {
+	kc, err := newInstanceChannel(c, index)
+	if err != nil {
+		return nil, err
+	}
+
+	instanceAID, err := identifiers.KeycardInstanceAID(index)
+	if err != nil {
+		return nil, err
+	}
+
+	cmdSet := keycard.NewCommandSet(kc)
+	err = cmdSet.Select()
+	if e, ok := err.(*apdu.ErrBadResponse); ok && e.Sw == globalplatform.SwFileNotFound {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	info := &CardKeyInfo{
+		InstanceAID: instanceAID,
+		InstanceUID: cmdSet.ApplicationInfo.InstanceUID,
+		KeyUID:      cmdSet.ApplicationInfo.KeyUID,
+	}
+
+	if !info.HasKey() {
+		return info, nil
+	}
+
+	if credentials == nil {
+		info.AddressNote = "pass -pairing-key without -yes to verify the PIN and show it"
+		return info, nil
+	}
+
+	fmt.Printf("Verify the PIN of Keycard instance 0x%x to show its first address\n", instanceAID)
+	s := newChannelSession(kc)
+	if err = s.Open(credentials()); err != nil {
+		info.AddressNote = fmt.Sprintf("opening a session failed: %v", err)
+		return info, nil
+	}
+	defer s.Close()
+
+	return sessionCardKeyInfo(s.CommandSet(), instanceAID), nil
+}
+
+// sessionCardKeyInfo returns the key info of the Keycard instance of an open session, with the first account address.
+func sessionCardKeyInfo(cmdSet *keycard.CommandSet, instanceAID []byte) *CardKeyInfo {
+	info := &CardKeyInfo{
+		InstanceAID: instanceAID,
+		InstanceUID: cmdSet.ApplicationInfo.InstanceUID,
+		KeyUID:      cmdSet.ApplicationInfo.KeyUID,
+	}
+
+	if !info.HasKey() {
+		return info
+	}
+
+	_, pubKey, err := cmdSet.ExportKey(true, false, true, firstAccountPath)
+	if err != nil {
+		logger.Warn("exporting the first account public key failed", "error", err)
+		info.AddressNote = fmt.Sprintf("exporting the public key failed: %v", err)
+		return info
+	}
+
+	if ecdsaPubKey, err := crypto.UnmarshalPubkey(pubKey); err == nil {
+		info.Address = crypto.PubkeyToAddress(*ecdsaPubKey).String()
+	}
+
+	return info
+}
+
+// Safeguard asks for confirmation before an operation wiping keys.
+type Safeguard struct {
+	// AssumeYes skips the confirmation phrase.
+	AssumeYes bool
+	// KeyBackedUp acknowledges that the keys to wipe are backed up.
+	KeyBackedUp bool
+	// Credentials returns the credentials of the sessions opened to show the first address of the keys to wipe.
+	// If nil, the addresses are not shown.
+	Credentials func() *SessionCredentials
+}
+
+// Confirm shows the keys wiped by operation and asks to type the operation name in upper case.
+// It fails if a key is present and KeyBackedUp is not set.
+func (sg *Safeguard) Confirm(operation string, keys []*CardKeyInfo) error {
+	hasKey := false
+	for _, k := range keys {
+		fmt.Print(k)
+		hasKey = hasKey || k.HasKey()
+	}
+
+	if hasKey && !sg.KeyBackedUp {
+		return errKeyNotBackedUp
+	}
+
+	if sg.AssumeYes {
+		return nil
+	}
+
+	phrase := strings.ToUpper(operation)
+	answer, err := askOnTTY(fmt.Sprintf("Type %s to confirm", phrase))
+	if err != nil {
+		return err
+	}
+
+	if answer != phrase {
+		return errConfirmationMismatch
+	}
+
+	return nil
+}
+
+// askOnTTY asks on the terminal, since stdin may be used to pipe shell commands
+// and the signer daemon output may be redirected.
+func askOnTTY(description string) (string, error) {
+	tty, err := openTTY()
+	if err != nil {
+		return "", err
+	}
+	defer tty.Close()
+
+	fmt.Fprintf(tty, "%s: ", description)
+	answer, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(answer), nil
+}
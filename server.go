@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+const unixListenPrefix = "unix:"
+
+var errNonLocalListenAddress = errors.New("the signer can only listen on a unix socket or a loopback address")
+
+// localHostHandler only lets through the requests addressed to localhost or a loopback address without an Origin
+// header, so a web page can't reach the signer, even with DNS rebinding.
+func localHostHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); origin != "" {
+			logger.Warn("rejected browser request", "origin", origin)
+			http.Error(w, "browser requests are not allowed", http.StatusForbidden)
+			return
+		}
+
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		if !isLoopbackHost(strings.Trim(host, "[]")) {
+			logger.Warn("rejected request", "host", r.Host)
+			http.Error(w, "invalid host specified", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isLoopbackHost returns true for localhost and the loopback IP literals.
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// serveSigner exposes the JSON-RPC API of signer on listen until the process is interrupted.
+// listen is either a unix socket path prefixed by "unix:" or a loopback "host:port" served over HTTP.
+func serveSigner(signer *Signer, listen string) error {
+	srv := rpc.NewServer()
+	defer srv.Stop()
+
+	if err := srv.RegisterName("eth", &EthAPI{signer}); err != nil {
+		return err
+	}
+
+	if err := srv.RegisterName("personal", &PersonalAPI{signer}); err != nil {
+		return err
+	}
+
+	l, err := listenLocal(listen)
+	if err != nil {
+		return err
+	}
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigc)
+	go func() {
+		sig := <-sigc
+		logger.Info("shutting down", "signal", sig)
+		l.Close()
+	}()
+
+	logger.Info("signer listening", "address", listen)
+	if strings.HasPrefix(listen, unixListenPrefix) {
+		err = srv.ServeListener(l)
+	} else {
+		err = http.Serve(l, localHostHandler(srv))
+	}
+
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+
+	return err
+}
+
+func listenLocal(listen string) (net.Listener, error) {
+	if strings.HasPrefix(listen, unixListenPrefix) {
+		path := strings.TrimPrefix(listen, unixListenPrefix)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+
+		if err = os.Chmod(path, 0600); err != nil {
+			l.Close()
+			return nil, err
+		}
+
+		return l, nil
+	}
+
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address %s: %v", listen, err)
+	}
+
+	if !isLoopbackHost(host) {
+		return nil, errNonLocalListenAddress
+	}
+
+	return net.Listen("tcp", listen)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	keycard "github.com/status-im/keycard-go"
+	"github.com/status-im/keycard-go/apdu"
+	"github.com/status-im/keycard-go/globalplatform"
+	keycardio "github.com/status-im/keycard-go/io"
+	"github.com/status-im/keycard-go/types"
+)
+
+var (
+	errNoPairing         = errors.New("no pairing key or pairing password specified")
+	errTemporaryPairLeft = errors.New("temporary pairing left on the card")
+)
+
+// SessionCredentials holds what is needed to open an authenticated session.
+// If PairingKey is empty, a temporary pairing is created with PairingPass
+// and removed when the session is closed.
+type SessionCredentials struct {
+	PIN          string
+	PairingKey   []byte
+	PairingIndex int
+	PairingPass  string
+}
+
+// Session defines a struct with methods to open an authenticated session with the Keycard applet.
+type Session struct {
+	c             types.Channel
+	cmdSet        *keycard.CommandSet
+	temporaryPair bool
+	// authenticated is set once the secure channel is open and the PIN verified, as required by UNPAIR.
+	authenticated bool
+}
+
+// NewSession returns a new Session that communicates to Transmitter t.
+func NewSession(t keycardio.Transmitter) *Session {
+	c := keycardio.NewNormalChannel(t)
+
+	return &Session{
+		c:      c,
+		cmdSet: keycard.NewCommandSet(c),
+	}
+}
+
+// newChannelSession returns a new Session that communicates through c, like an instance channel.
+func newChannelSession(c types.Channel) *Session {
+	return &Session{
+		c:      c,
+		cmdSet: keycard.NewCommandSet(c),
+	}
+}
+
+// CommandSet returns the keycard.CommandSet used by the session.
+func (s *Session) CommandSet() *keycard.CommandSet {
+	return s.cmdSet
+}
+
+// Open selects the Keycard applet, pairs if needed, opens the secure channel and verifies the PIN.
+func (s *Session) Open(creds *SessionCredentials) error {
+	logger.Info("select keycard applet")
+	err := s.cmdSet.Select()
+	if err != nil {
+		if e, ok := err.(*apdu.ErrBadResponse); ok && e.Sw == globalplatform.SwFileNotFound {
+			err = errAppletNotInstalled
+		}
+		logger.Error("select failed", "error", err)
+		return err
+	}
+
+	if !s.cmdSet.ApplicationInfo.Initialized {
+		logger.Error("open session failed", "error", errCardNotInitialized)
+		return errCardNotInitialized
+	}
+
+	if len(creds.PairingKey) > 0 {
+		s.cmdSet.SetPairingInfo(creds.PairingKey, creds.PairingIndex)
+	} else if creds.PairingPass != "" {
+		logger.Info("pair")
+		if err = s.cmdSet.Pair(creds.PairingPass); err != nil {
+			logger.Error("pair failed", "error", err)
+			return err
+		}
+		s.temporaryPair = true
+	} else {
+		return errNoPairing
+	}
+
+	logger.Info("open keycard secure channel")
+	if err = s.cmdSet.OpenSecureChannel(); err != nil {
+		logger.Error("open keycard secure channel failed", "error", err)
+		s.Close()
+		return err
+	}
+
+	logger.Info("verify PIN")
+	if err = s.cmdSet.VerifyPIN(creds.PIN); err != nil {
+		logger.Error("verify PIN failed", "error", err)
+		s.Close()
+		return err
+	}
+	s.authenticated = true
+
+	return nil
+}
+
+// Close removes the temporary pairing created by Open, if any.
+// If the session was not authenticated the pairing can't be removed, and the error reports the slot left on the card.
+func (s *Session) Close() error {
+	if !s.temporaryPair {
+		return nil
+	}
+
+	s.temporaryPair = false
+	index := s.cmdSet.PairingInfo.Index
+	if !s.authenticated {
+		logger.Error("temporary pairing not removed, unpair it with the PIN", "index", index)
+		return fmt.Errorf("%w: pairing index %d", errTemporaryPairLeft, index)
+	}
+
+	logger.Info("unpair", "index", index)
+	if err := s.cmdSet.Unpair(uint8(index)); err != nil {
+		logger.Error("unpair failed", "error", err)
+		return err
+	}
+
+	return nil
+}
@@ -18,6 +18,7 @@ import (
 	keycard "github.com/status-im/keycard-go"
 	"github.com/status-im/keycard-go/apdu"
 	"github.com/status-im/keycard-go/globalplatform"
+	"github.com/status-im/keycard-go/identifiers"
 	keycardio "github.com/status-im/keycard-go/io"
 	"github.com/status-im/keycard-go/types"
 )
@@ -92,24 +93,39 @@ type Shell struct {
 	t          keycardio.Transmitter
 	c          types.Channel
 	Secrets    *keycard.Secrets
-	gpCmdSet   *globalplatform.CommandSet
+	gpCmdSet   *GPCommandSet
 	kCmdSet    *keycard.CommandSet
 	cashCmdSet *keycard.CashCommandSet
 	commands   map[string]shellCommand
 	out        *bytes.Buffer
 	tplFuncMap template.FuncMap
+	safeguard  *Safeguard
+	inventory  *Inventory
+	auditLog   *AuditLog
+	// instanceIndex is the index of the Keycard instance selected by the keycard commands.
+	instanceIndex int
 }
 
-func NewShell(t keycardio.Transmitter) *Shell {
+// NewShell returns a new Shell that communicates to Transmitter t. The keycard commands select the Keycard instance
+// with the specified index.
+func NewShell(t keycardio.Transmitter, gpKeys *GPKeyConfig, instanceIndex int, safeguard *Safeguard, inventory *Inventory, auditLog *AuditLog) (*Shell, error) {
 	c := keycardio.NewNormalChannel(t)
+	kc, err := newInstanceChannel(c, instanceIndex)
+	if err != nil {
+		return nil, err
+	}
 
 	s := &Shell{
-		t:          t,
-		c:          c,
-		kCmdSet:    keycard.NewCommandSet(c),
-		cashCmdSet: keycard.NewCashCommandSet(c),
-		gpCmdSet:   globalplatform.NewCommandSet(c),
-		out:        new(bytes.Buffer),
+		t:             t,
+		c:             c,
+		kCmdSet:       keycard.NewCommandSet(kc),
+		cashCmdSet:    keycard.NewCashCommandSet(c),
+		gpCmdSet:      NewGPCommandSet(c, gpKeys),
+		out:           new(bytes.Buffer),
+		safeguard:     safeguard,
+		inventory:     inventory,
+		auditLog:      auditLog,
+		instanceIndex: instanceIndex,
 	}
 
 	tplFuncs := &TemplateFuncs{s}
@@ -124,6 +140,7 @@ func NewShell(t keycardio.Transmitter) *Shell {
 		"gp-load":                       s.commandGPLoad,
 		"gp-install-for-install":        s.commandGPInstallForInstall,
 		"gp-get-status":                 s.commandGPGetStatus,
+		"gp-list":                       s.commandGPList,
 		"keycard-init":                  s.commandKeycardInit,
 		"keycard-select":                s.commandKeycardSelect,
 		"keycard-pair":                  s.commandKeycardPair,
@@ -142,6 +159,7 @@ func NewShell(t keycardio.Transmitter) *Shell {
 		"keycard-derive-key":            s.commandKeycardDeriveKey,
 		"keycard-export-key-private":    s.commandKeycardExportKeyPrivate,
 		"keycard-export-key-public":     s.commandKeycardExportKeyPublic,
+		"keycard-export-key-keystore":   s.commandKeycardExportKeyKeystore,
 		"keycard-sign":                  s.commandKeycardSign,
 		"keycard-sign-with-path":        s.commandKeycardSignWithPath,
 		"keycard-sign-message":          s.commandKeycardSignMessage,
@@ -155,7 +173,7 @@ func NewShell(t keycardio.Transmitter) *Shell {
 		"cash-sign":                     s.commandCashSign,
 	}
 
-	return s
+	return s, nil
 }
 
 func (s *Shell) write(str string) {
@@ -269,7 +287,13 @@ func (s *Shell) commandGPDelete(args ...string) error {
 
 	logger.Info(fmt.Sprintf("delete %x", aid))
 
-	return s.gpCmdSet.DeleteObject(aid)
+	if err = s.gpCmdSet.DeleteObject(aid); err != nil {
+		return err
+	}
+
+	s.audit("delete", "aid", fmt.Sprintf("%x", aid))
+
+	return nil
 }
 
 func (s *Shell) commandGPLoad(args ...string) error {
@@ -297,6 +321,8 @@ func (s *Shell) commandGPLoad(args ...string) error {
 		return err
 	}
 
+	s.audit("load", "package", fmt.Sprintf("%x", pkgAID), "file", args[0])
+
 	return nil
 }
 
@@ -331,7 +357,13 @@ func (s *Shell) commandGPInstallForInstall(args ...string) error {
 
 	logger.Info("install for install", "pkg", fmt.Sprintf("%x", pkgAID), "applet", fmt.Sprintf("%x", appletAID), "instance", fmt.Sprintf("%x", instanceAID), "params", fmt.Sprintf("%x", params))
 
-	return s.gpCmdSet.InstallForInstall(pkgAID, appletAID, instanceAID, params)
+	if err = s.gpCmdSet.InstallForInstall(pkgAID, appletAID, instanceAID, params); err != nil {
+		return err
+	}
+
+	s.audit("install", "applet", fmt.Sprintf("%x", appletAID), "instance", fmt.Sprintf("%x", instanceAID))
+
+	return nil
 }
 
 func (s *Shell) commandGPGetStatus(args ...string) error {
@@ -351,6 +383,28 @@ func (s *Shell) commandGPGetStatus(args ...string) error {
 	return nil
 }
 
+func (s *Shell) commandGPList(args ...string) error {
+	if err := s.requireArgs(args, 0); err != nil {
+		return err
+	}
+
+	sc := s.gpCmdSet.SecureChannel()
+	if sc == nil {
+		return globalplatform.ErrSecureChannelNotOpen
+	}
+
+	logger.Info("list registry")
+	registry, err := readGPRegistry(sc)
+	if err != nil {
+		logger.Error("list registry failed", "error", err)
+		return err
+	}
+
+	s.write(fmt.Sprintf("%s\n", registry))
+
+	return nil
+}
+
 func (s *Shell) commandKeycardInit(args ...string) error {
 	if err := s.requireArgs(args, 0); err != nil {
 		return err
@@ -389,6 +443,8 @@ func (s *Shell) commandKeycardInit(args ...string) error {
 	s.write(fmt.Sprintf("PUK: %s\n", s.Secrets.Puk()))
 	s.write(fmt.Sprintf("PAIRING PASSWORD: %s\n\n", s.Secrets.PairingPass()))
 
+	s.audit("init")
+
 	return nil
 }
 
@@ -457,6 +513,9 @@ func (s *Shell) commandKeycardPair(args ...string) error {
 	s.write(fmt.Sprintf("PAIRING KEY: %x\n", s.kCmdSet.PairingInfo.Key))
 	s.write(fmt.Sprintf("PAIRING INDEX: %v\n\n", s.kCmdSet.PairingInfo.Index))
 
+	s.audit("pair", "index", s.kCmdSet.PairingInfo.Index)
+	s.recordInventory(InventoryOperationPair, nil)
+
 	return nil
 }
 
@@ -485,6 +544,8 @@ func (s *Shell) commandKeycardUnpair(args ...string) error {
 
 	s.write("UNPAIRED\n\n")
 
+	s.audit("unpair", "index", index)
+
 	return nil
 }
 
@@ -578,6 +639,8 @@ func (s *Shell) commandKeycardChangePIN(args ...string) error {
 		return err
 	}
 
+	s.audit("change-pin")
+
 	return nil
 }
 
@@ -592,6 +655,8 @@ func (s *Shell) commandKeycardChangePUK(args ...string) error {
 		return err
 	}
 
+	s.audit("change-puk")
+
 	return nil
 }
 
@@ -606,6 +671,8 @@ func (s *Shell) commandKeycardUnblockPin(args ...string) error {
 		return err
 	}
 
+	s.audit("unblock-pin")
+
 	return nil
 }
 
@@ -620,6 +687,8 @@ func (s *Shell) commandKeycardChangePairingSecret(args ...string) error {
 		return err
 	}
 
+	s.audit("change-pairing-secret")
+
 	return nil
 }
 
@@ -649,22 +718,69 @@ func (s *Shell) commandKeycardGenerateKey(args ...string) error {
 
 	s.write(fmt.Sprintf("KEY UID %x\n\n", keyUID))
 
+	s.audit("generate-key", "keyUID", fmt.Sprintf("%x", keyUID))
+	s.recordInventory(InventoryOperationGenerateKey, keyUID)
+
 	return nil
 }
 
+// audit appends operation to the audit log, with the instance UID of the selected Keycard applet.
+// It's called once the card operation succeeded, so an error is reported without failing the command.
+func (s *Shell) audit(operation string, ctx ...interface{}) {
+	var instanceUID string
+	if info := s.kCmdSet.ApplicationInfo; info != nil && info.Initialized {
+		instanceUID = hex.EncodeToString(info.InstanceUID)
+	}
+
+	if err := s.auditLog.Append(operation, instanceUID, ctx...); err != nil {
+		logger.Error("error updating the audit log", "error", err)
+		fmt.Fprintf(os.Stderr, "%s succeeded, not recorded in the audit log: %v\n", operation, err)
+	}
+}
+
+// recordInventory appends the operation to the inventory with the info of the selected Keycard applet.
+// The other applets aren't selected to keep the secure channel open. Errors are reported like in audit.
+func (s *Shell) recordInventory(operation string, keyUID []byte) {
+	if s.inventory == nil {
+		return
+	}
+
+	rec := &InventoryRecord{Operation: operation}
+	rec.setApplicationInfo(s.kCmdSet.ApplicationInfo)
+	if keyUID != nil {
+		rec.KeyUID = fmt.Sprintf("%x", keyUID)
+	}
+
+	if err := s.inventory.Append(rec); err != nil {
+		logger.Error("error updating the inventory", "error", err)
+		fmt.Fprintf(os.Stderr, "%s succeeded, not recorded in the inventory: %v\n", operation, err)
+	}
+}
+
 func (s *Shell) commandKeycardRemoveKey(args ...string) error {
 	if err := s.requireArgs(args, 0); err != nil {
 		return err
 	}
 
+	instanceAID, err := identifiers.KeycardInstanceAID(s.instanceIndex)
+	if err != nil {
+		return err
+	}
+
+	if err = s.safeguard.Confirm("remove key", []*CardKeyInfo{sessionCardKeyInfo(s.kCmdSet, instanceAID)}); err != nil {
+		return err
+	}
+
 	logger.Info("remove key")
-	err := s.kCmdSet.RemoveKey()
+	err = s.kCmdSet.RemoveKey()
 	if err != nil {
 		return err
 	}
 
 	s.write(fmt.Sprintf("KEY REMOVED \n\n"))
 
+	s.audit("remove-key")
+
 	return nil
 }
 
@@ -697,6 +813,8 @@ func (s *Shell) commandKeycardExportKeyPrivate(args ...string) error {
 	s.write(fmt.Sprintf("EXPORTED PRIVATE KEY\n%x\n", privKey))
 	s.write(fmt.Sprintf("EXPORTED PUBLIC KEY\n%x\n\n", pubKey))
 
+	s.audit("export-key", "path", args[0], "private", true)
+
 	return nil
 }
 
@@ -715,6 +833,38 @@ func (s *Shell) commandKeycardExportKeyPublic(args ...string) error {
 	s.write(fmt.Sprintf("EXPORTED PRIVATE KEY\n%x\n", privKey))
 	s.write(fmt.Sprintf("EXPORTED PUBLIC KEY\n%x\n\n", pubKey))
 
+	s.audit("export-key", "path", args[0], "private", false)
+
+	return nil
+}
+
+func (s *Shell) commandKeycardExportKeyKeystore(args ...string) error {
+	if err := s.requireArgs(args, 3); err != nil {
+		return err
+	}
+
+	logger.Info(fmt.Sprintf("export key %s", args[0]))
+	privKey, pubKey, err := s.kCmdSet.ExportKey(true, false, false, args[0])
+	if err != nil {
+		logger.Error("export key failed", "error", err)
+		return err
+	}
+
+	logger.Info("writing keystore file", "file", args[1])
+	address, err := writeKeystoreFile(args[1], privKey, pubKey, args[2])
+	for i := range privKey {
+		privKey[i] = 0
+	}
+	if err != nil {
+		logger.Error("writing keystore file failed", "error", err)
+		return err
+	}
+
+	s.write(fmt.Sprintf("KEYSTORE FILE: %s\n", args[1]))
+	s.write(fmt.Sprintf("ADDRESS: %s\n\n", address.String()))
+
+	s.audit("export-key", "path", args[0], "private", true, "keystore", args[1])
+
 	return nil
 }
 
@@ -738,6 +888,8 @@ func (s *Shell) commandKeycardSign(args ...string) error {
 
 	s.writeSignatureInfo(sig)
 
+	s.audit("sign", "hash", fmt.Sprintf("%x", data), "publicKey", fmt.Sprintf("%x", sig.PubKey()))
+
 	return nil
 }
 
@@ -761,6 +913,8 @@ func (s *Shell) commandKeycardSignWithPath(args ...string) error {
 
 	s.writeSignatureInfo(sig)
 
+	s.audit("sign", "hash", fmt.Sprintf("%x", data), "path", args[1], "publicKey", fmt.Sprintf("%x", sig.PubKey()))
+
 	return nil
 }
 
@@ -781,6 +935,8 @@ func (s *Shell) commandKeycardSignMessage(args ...string) error {
 
 	s.writeSignatureInfo(sig)
 
+	s.audit("sign", "hash", fmt.Sprintf("%x", hash), "publicKey", fmt.Sprintf("%x", sig.PubKey()))
+
 	return nil
 }
 
@@ -804,6 +960,8 @@ func (s *Shell) commandKeycardSignPinless(args ...string) error {
 
 	s.writeSignatureInfo(sig)
 
+	s.audit("sign", "hash", fmt.Sprintf("%x", data), "pinless", true, "publicKey", fmt.Sprintf("%x", sig.PubKey()))
+
 	return nil
 }
 
@@ -824,6 +982,8 @@ func (s *Shell) commandKeycardSignMessagePinless(args ...string) error {
 
 	s.writeSignatureInfo(sig)
 
+	s.audit("sign", "hash", fmt.Sprintf("%x", hash), "pinless", true, "publicKey", fmt.Sprintf("%x", sig.PubKey()))
+
 	return nil
 }
 
@@ -875,7 +1035,7 @@ func (s *Shell) commandKeycardLoadSeed(args ...string) error {
 		return err
 	}
 
-	logger.Info("loading seed", "seed", fmt.Sprintf("%x", seed))
+	logger.Info("loading seed")
 	keyID, err := s.kCmdSet.LoadSeed(seed)
 	if err != nil {
 		logger.Error("load seed failed", "error", err)
@@ -884,36 +1044,50 @@ func (s *Shell) commandKeycardLoadSeed(args ...string) error {
 
 	logger.Info(fmt.Sprintf("key ID %x", keyID))
 
+	s.audit("load-seed", "keyUID", fmt.Sprintf("%x", keyID))
+
 	return nil
 }
 
 func (s *Shell) commandKeycardIdentify(args ...string) error {
-	pubkey, err := s.kCmdSet.Identify()
+	if err := s.requireArgs(args, 0, 1); err != nil {
+		return err
+	}
 
+	// IDENTIFY is sent in the current session, through the secure channel if it's open
+	caPubKey, err := s.kCmdSet.Identify()
 	if err != nil {
 		logger.Error("failed card identification", "error", err)
 		return err
 	}
 
-	logger.Info(fmt.Sprintf("identification public key: %x", pubkey))
+	logger.Info(fmt.Sprintf("identification public key: %x", caPubKey))
+	s.write(fmt.Sprintf("CA public key: 0x%x\n", caPubKey))
 
-	var compareKey []byte
+	cas, err := LoadTrustedCAs(*flagTrustedCAs)
+	if err != nil {
+		logger.Error("failed loading trusted CAs", "error", err)
+		return err
+	}
+
+	// the argument is the public key of a CA trusted in addition to the -trusted-cas ones
 	if len(args) == 1 {
-		compareKey, err = s.parseHex(args[0])
+		cas = append(cas, &TrustedCA{Name: "argument", PublicKey: args[0]})
+	}
 
-		if err != nil {
-			logger.Error("failed parsing public key", "error", err)
-			return err
-		}
-	} else {
-		compareKey = pubkey
+	// without a trusted CA, the certificate and the challenge signature are only parsed
+	if len(cas) == 0 {
+		return nil
 	}
 
-	if !bytes.Equal(compareKey, pubkey) {
-		logger.Error("the recovered key does not match the expected value", "error", err)
-		return errors.New("genuinity check failed")
+	ca, err := findTrustedCA(cas, caPubKey)
+	if err != nil {
+		logger.Error("failed card identification", "error", err)
+		return err
 	}
 
+	s.write(fmt.Sprintf("Genuine: yes, certified by %s\n", ca.Name))
+
 	return nil
 }
 
@@ -959,6 +1133,8 @@ func (s *Shell) commandCashSign(args ...string) error {
 
 	s.writeSignatureInfo(sig)
 
+	s.audit("sign", "hash", fmt.Sprintf("%x", data), "applet", "cash", "publicKey", fmt.Sprintf("%x", sig.PubKey()))
+
 	return nil
 }
 
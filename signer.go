@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	ethtypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+	keycard "github.com/status-im/keycard-go"
+)
+
+var (
+	errUnknownAccount    = errors.New("unknown account")
+	errSignerKeyMismatch = errors.New("signature public key does not match the account")
+)
+
+// Signer defines a struct with methods to sign Ethereum data with the keys of an open Keycard session.
+// Access to the card is serialized, so a Signer can be shared between concurrent requests.
+type Signer struct {
+	mu        sync.Mutex
+	cmdSet    *keycard.CommandSet
+	chainID   *big.Int
+	policy    *Policy
+	addresses []common.Address
+	paths     map[common.Address]string
+	auditLog  *AuditLog
+}
+
+// NewSigner returns a new Signer exposing the accounts at the specified derivation paths.
+// chainID is used for transactions that don't specify one.
+// If policy is nil every request is signed. Each signature is recorded in auditLog, that can be nil.
+func NewSigner(cmdSet *keycard.CommandSet, paths []string, chainID *big.Int, policy *Policy, auditLog *AuditLog) (*Signer, error) {
+	s := &Signer{
+		cmdSet:   cmdSet,
+		chainID:  chainID,
+		policy:   policy,
+		paths:    make(map[common.Address]string),
+		auditLog: auditLog,
+	}
+
+	for _, path := range paths {
+		logger.Info(fmt.Sprintf("export public key %s", path))
+		_, pubKey, err := cmdSet.ExportKey(true, false, true, path)
+		if err != nil {
+			logger.Error("export key failed", "error", err)
+			return nil, err
+		}
+
+		ecdsaPubKey, err := crypto.UnmarshalPubkey(pubKey)
+		if err != nil {
+			return nil, err
+		}
+
+		address := crypto.PubkeyToAddress(*ecdsaPubKey)
+		logger.Info("account", "path", path, "address", address.String())
+		s.addresses = append(s.addresses, address)
+		s.paths[address] = path
+	}
+
+	return s, nil
+}
+
+// Accounts returns the addresses of the accounts managed by the signer.
+func (s *Signer) Accounts() []common.Address {
+	return s.addresses
+}
+
+// sign signs req.Hash with the key of req.Account once the policy approves the request.
+// The returned signature is in the [R || S || V] format where V is 0 or 1.
+func (s *Signer) sign(req *SignRequest) ([]byte, error) {
+	path, ok := s.paths[req.Account]
+	if !ok {
+		return nil, errUnknownAccount
+	}
+
+	req.Path = path
+	if s.policy != nil {
+		if err := s.policy.Check(req); err != nil {
+			return nil, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	logger.Info("sign with path", "path", path, "hash", fmt.Sprintf("%x", req.Hash))
+	sig, err := s.cmdSet.SignWithPath(req.Hash, path)
+	if err != nil {
+		logger.Error("sign with path failed", "error", err)
+		return nil, err
+	}
+
+	ecdsaPubKey, err := crypto.UnmarshalPubkey(sig.PubKey())
+	if err != nil {
+		return nil, err
+	}
+
+	if crypto.PubkeyToAddress(*ecdsaPubKey) != req.Account {
+		return nil, errSignerKeyMismatch
+	}
+
+	instanceUID := fmt.Sprintf("%x", s.cmdSet.ApplicationInfo.InstanceUID)
+	err = s.auditLog.Append("sign", instanceUID, "method", req.Method, "path", path, "account", req.Account.String(), "hash", fmt.Sprintf("%x", req.Hash))
+	if err != nil {
+		logger.Error("error updating the audit log", "error", err)
+		return nil, err
+	}
+
+	ethSig := append(sig.R(), sig.S()...)
+	ethSig = append(ethSig, sig.V())
+
+	return ethSig, nil
+}
+
+// SignText signs data prefixed with the Ethereum signed message header.
+// The returned signature V is 27 or 28.
+func (s *Signer) SignText(method string, address common.Address, data []byte) ([]byte, error) {
+	sig, err := s.sign(&SignRequest{
+		Method:  method,
+		Account: address,
+		Hash:    accounts.TextHash(data),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sig[crypto.RecoveryIDOffset] += 27
+
+	return sig, nil
+}
+
+// SignTypedData signs the EIP-712 typed data.
+// The returned signature V is 27 or 28.
+func (s *Signer) SignTypedData(address common.Address, typedData apitypes.TypedData) ([]byte, error) {
+	hash, _, err := apitypes.TypedDataAndHash(typedData)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &SignRequest{
+		Method:  "eth_signTypedData_v4",
+		Account: address,
+		Hash:    hash,
+		ChainID: (*big.Int)(typedData.Domain.ChainId),
+		TypedData: &TypedDataRequest{
+			DomainName:  typedData.Domain.Name,
+			PrimaryType: typedData.PrimaryType,
+		},
+	}
+
+	if common.IsHexAddress(typedData.Domain.VerifyingContract) {
+		verifyingContract := common.HexToAddress(typedData.Domain.VerifyingContract)
+		req.TypedData.VerifyingContract = &verifyingContract
+	}
+
+	sig, err := s.sign(req)
+	if err != nil {
+		return nil, err
+	}
+
+	sig[crypto.RecoveryIDOffset] += 27
+
+	return sig, nil
+}
+
+// SignTransaction signs the transaction described by args.
+func (s *Signer) SignTransaction(args apitypes.SendTxArgs) (*ethtypes.Transaction, error) {
+	if args.ChainID == nil {
+		args.ChainID = (*hexutil.Big)(s.chainID)
+	}
+
+	tx := args.ToTransaction()
+	txSigner := ethtypes.LatestSignerForChainID((*big.Int)(args.ChainID))
+
+	sig, err := s.sign(&SignRequest{
+		Method:  "eth_signTransaction",
+		Account: args.From.Address(),
+		Hash:    txSigner.Hash(tx).Bytes(),
+		ChainID: tx.ChainId(),
+		To:      tx.To(),
+		Value:   tx.Value(),
+		Data:    tx.Data(),
+		Create:  tx.To() == nil,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return tx.WithSignature(txSigner, sig)
+}
+
+// SignTransactionResult is the result of eth_signTransaction.
+type SignTransactionResult struct {
+	Raw hexutil.Bytes         `json:"raw"`
+	Tx  *ethtypes.Transaction `json:"tx"`
+}
+
+// EthAPI implements the signing methods of the eth namespace.
+type EthAPI struct {
+	s *Signer
+}
+
+// Accounts implements eth_accounts.
+func (api *EthAPI) Accounts() []common.Address {
+	return api.s.Accounts()
+}
+
+// Sign implements eth_sign.
+func (api *EthAPI) Sign(address common.MixedcaseAddress, data hexutil.Bytes) (hexutil.Bytes, error) {
+	return api.s.SignText("eth_sign", address.Address(), data)
+}
+
+// SignTransaction implements eth_signTransaction.
+func (api *EthAPI) SignTransaction(args apitypes.SendTxArgs) (*SignTransactionResult, error) {
+	tx, err := api.s.SignTransaction(args)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := tx.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	return &SignTransactionResult{Raw: raw, Tx: tx}, nil
+}
+
+// SignTypedData_v4 implements eth_signTypedData_v4.
+func (api *EthAPI) SignTypedData_v4(address common.MixedcaseAddress, typedData apitypes.TypedData) (hexutil.Bytes, error) {
+	return api.s.SignTypedData(address.Address(), typedData)
+}
+
+// PersonalAPI implements the signing methods of the personal namespace.
+type PersonalAPI struct {
+	s *Signer
+}
+
+// Sign implements personal_sign. The password is ignored since the card PIN
+// has already been verified when the session was opened.
+func (api *PersonalAPI) Sign(data hexutil.Bytes, address common.MixedcaseAddress, password *string) (hexutil.Bytes, error) {
+	return api.s.SignText("personal_sign", address.Address(), data)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// console reads from the console input buffer and writes to the console screen buffer.
+type console struct {
+	in  *os.File
+	out *os.File
+}
+
+// openTTY opens the console, which on Windows has separate input and output devices.
+func openTTY() (io.ReadWriteCloser, error) {
+	in, err := os.OpenFile("CONIN$", os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := os.OpenFile("CONOUT$", os.O_RDWR, 0)
+	if err != nil {
+		in.Close()
+		return nil, err
+	}
+
+	return &console{in: in, out: out}, nil
+}
+
+func (c *console) Read(p []byte) (int, error) {
+	return c.in.Read(p)
+}
+
+func (c *console) Write(p []byte) (int, error) {
+	return c.out.Write(p)
+}
+
+func (c *console) Close() error {
+	inErr := c.in.Close()
+	if err := c.out.Close(); err != nil {
+		return err
+	}
+
+	return inErr
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/ebfe/scard"
+)
+
+const (
+	WatchEventInserted      = "inserted"
+	WatchEventRemoved       = "removed"
+	WatchEventReaderAdded   = "reader-added"
+	WatchEventReaderRemoved = "reader-removed"
+	WatchEventExec          = "exec"
+
+	// pnpNotificationReader is the special reader notifying when readers are attached or detached.
+	pnpNotificationReader = `\\?PnP?\Notification`
+)
+
+// WatchEvent is a card or reader event, written as a JSON line.
+type WatchEvent struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	Reader string    `json:"reader"`
+	ATR    string    `json:"atr,omitempty"`
+	// ExitCode and Error report the result of the -exec command for exec events.
+	ExitCode *int   `json:"exitCode,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Watcher reports the cards inserted and removed on all the readers and runs a command for each inserted card.
+type Watcher struct {
+	command string
+	out     io.Writer
+
+	mu sync.Mutex
+	wg sync.WaitGroup
+}
+
+// NewWatcher returns a Watcher writing the events to out. If command is not empty, it's run with "sh -c" for each
+// inserted card, with the KEYCARD_READER and KEYCARD_ATR environment variables.
+func NewWatcher(command string, out io.Writer) *Watcher {
+	return &Watcher{
+		command: command,
+		out:     out,
+	}
+}
+
+// Run watches the readers until ctx is cancelled, then waits for the running commands.
+func (w *Watcher) Run(ctx *scard.Context) error {
+	defer w.wg.Wait()
+
+	states := []scard.ReaderState{{
+		Reader:       pnpNotificationReader,
+		CurrentState: scard.StateUnaware,
+	}}
+
+	states, err := w.updateReaders(ctx, states)
+	if err != nil {
+		return err
+	}
+
+	for {
+		err := ctx.GetStatusChange(states, -1)
+		if err == scard.ErrCancelled {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		readersChanged := false
+		for i := range states {
+			rs := &states[i]
+			if rs.EventState&scard.StateChanged == 0 {
+				continue
+			}
+
+			if rs.Reader == pnpNotificationReader {
+				readersChanged = true
+			} else {
+				w.handleStateChange(rs)
+			}
+
+			rs.CurrentState = rs.EventState &^ scard.StateChanged
+		}
+
+		if readersChanged {
+			if states, err = w.updateReaders(ctx, states); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// updateReaders lists the readers and returns the states to watch, keeping the known states of the existing readers.
+func (w *Watcher) updateReaders(ctx *scard.Context, states []scard.ReaderState) ([]scard.ReaderState, error) {
+	readers, err := ctx.ListReaders()
+	if err != nil && err != scard.ErrNoReadersAvailable {
+		return nil, err
+	}
+
+	known := make(map[string]scard.ReaderState)
+	for _, rs := range states {
+		known[rs.Reader] = rs
+	}
+
+	updated := []scard.ReaderState{known[pnpNotificationReader]}
+	for _, reader := range readers {
+		rs, ok := known[reader]
+		if !ok {
+			w.emit(&WatchEvent{Event: WatchEventReaderAdded, Reader: reader})
+			rs = scard.ReaderState{Reader: reader, CurrentState: scard.StateUnaware}
+		}
+
+		delete(known, reader)
+		updated = append(updated, rs)
+	}
+
+	delete(known, pnpNotificationReader)
+	for reader, rs := range known {
+		if rs.CurrentState&scard.StatePresent != 0 {
+			w.emit(&WatchEvent{Event: WatchEventRemoved, Reader: reader})
+		}
+		w.emit(&WatchEvent{Event: WatchEventReaderRemoved, Reader: reader})
+	}
+
+	return updated, nil
+}
+
+func (w *Watcher) handleStateChange(rs *scard.ReaderState) {
+	wasPresent := rs.CurrentState&scard.StatePresent != 0
+	isPresent := rs.EventState&scard.StatePresent != 0
+
+	switch {
+	case isPresent && !wasPresent:
+		atr := hex.EncodeToString(rs.Atr)
+		w.emit(&WatchEvent{Event: WatchEventInserted, Reader: rs.Reader, ATR: atr})
+		if w.command != "" {
+			w.wg.Add(1)
+			go w.exec(rs.Reader, atr)
+		}
+	case wasPresent && !isPresent:
+		w.emit(&WatchEvent{Event: WatchEventRemoved, Reader: rs.Reader})
+	}
+}
+
+// exec runs the command for the card inserted in reader. Its output goes to stderr to keep stdout for the events.
+func (w *Watcher) exec(reader string, atr string) {
+	defer w.wg.Done()
+
+	cmd := exec.Command("sh", "-c", w.command)
+	cmd.Env = append(os.Environ(), "KEYCARD_READER="+reader, "KEYCARD_ATR="+atr)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	event := &WatchEvent{Event: WatchEventExec, Reader: reader, ATR: atr}
+	err := cmd.Run()
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		code := 0
+		event.ExitCode = &code
+	case errors.As(err, &exitErr):
+		code := exitErr.ExitCode()
+		event.ExitCode = &code
+		event.Error = err.Error()
+	default:
+		event.Error = err.Error()
+	}
+
+	w.emit(event)
+}
+
+func (w *Watcher) emit(event *WatchEvent) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	event.Time = time.Now().UTC()
+	line, err := json.Marshal(event)
+	if err != nil {
+		logger.Error("error encoding watch event", "error", err)
+		return
+	}
+
+	if _, err = w.out.Write(append(line, '\n')); err != nil {
+		logger.Error("error writing watch event", "error", err)
+	}
+}